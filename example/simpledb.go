@@ -1,21 +1,41 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/emicklei/go-restful"
 	"github.com/jinzhu/gorm"
 	"github.com/johnwilson/restapi"
+	"github.com/johnwilson/restapi/middleware"
 	"github.com/johnwilson/restapi/plugins"
+	"github.com/johnwilson/restapi/resource"
 	"github.com/johnwilson/restapi/system"
 )
 
 type MainController struct {
 	system.Controller
+	DB *gorm.DB              `inject:"orm"`
+	QM *plugins.QueryManager `inject:"qm"`
 }
 
-func (ct *MainController) SendMail(p system.JobParams) interface{} {
+type MailRequest struct {
+	From string `path:"from" validate:"required,email" description:"sender address"`
+	To   string `path:"to" validate:"required,email" description:"recipient address"`
+}
+
+type Note struct {
+	ID        int        `json:"id"`
+	Title     string     `json:"title" validate:"required,max=200"`
+	Body      string     `json:"body"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+func (ct *MainController) SendMail(ctx context.Context, p system.JobParams) interface{} {
 	// get values
 	from := p["from"].(string)
 	to := p["to"].(string)
@@ -23,46 +43,57 @@ func (ct *MainController) SendMail(p system.JobParams) interface{} {
 
 	// simulate send mail
 	time.Sleep(5 * time.Second)
+	system.Logger(ctx).Info(msg) // tagged with the request ID and trace
 
 	return map[string]string{"status": msg}
 }
 
 func (ct *MainController) Register(container *restful.Container) {
 	ct.Controller.Register(container)
-	ct.NewJobQueue("mailer", ct.SendMail, 2) // 2 workers
+	ct.NewContextJobQueue("mailer", ct.SendMail, 2) // 2 workers
 
-	ws := new(restful.WebService)
+	ws := ct.WebService("/")
 	ws.Route(ws.GET("/").To(ct.Index))
-	ws.Route(ws.GET("/dbversion").To(ct.DBVersion))
-	ws.Route(ws.GET("/mailer/{from}/{to}").To(ct.Mailer))
-	container.Add(ws)
+	ws.Route(ws.GET("/dbversion").
+		Do(middleware.Cached(middleware.CachePolicy{TTL: time.Minute})).
+		To(ct.DBVersion))
+	ws.Route(ws.GET("/mailer/{from}/{to}").
+		Do(system.DocParams(MailRequest{})).
+		To(ct.Mailer))
+	ct.Add(ws)
 }
 
 func (ct *MainController) Index(r *restful.Request, w *restful.Response) {
 	msg := map[string]string{"welcome": "hello world"}
-	w.WriteJson(msg, "application/json")
+	ct.Write(r, w, msg)
 }
 
 func (ct *MainController) DBVersion(r *restful.Request, w *restful.Response) {
-	orm := ct.GetPlugin("orm", r).(*gorm.DB)
-	qm := ct.GetPlugin("qm", r).(*plugins.QueryManager)
-	res := orm.Raw(qm.Get("version"))
 	var version string
-	res.Row().Scan(&version)
+	if err := plugins.SQLQueryRow(ct.Context(r), ct.DB, ct.QM.Get("version")).Scan(&version); err != nil {
+		ct.WriteError(r, w, err)
+		return
+	}
 	msg := map[string]string{"db": version}
-	w.WriteJson(msg, "application/json")
+	ct.Write(r, w, msg)
 }
 
 func (ct *MainController) Mailer(r *restful.Request, w *restful.Response) {
-	j := system.NewAsyncJob(make(chan interface{}))
-	j.Set("from", r.PathParameter("from"))
-	j.Set("to", r.PathParameter("to"))
+	var mr MailRequest
+	if err := ct.Bind(r, &mr); err != nil {
+		ct.WriteError(r, w, err)
+		return
+	}
+
+	j := system.NewAsyncJobContext(ct.Context(r), make(chan interface{}))
+	j.Set("from", mr.From)
+	j.Set("to", mr.To)
 
 	ct.AddJob("mailer", j)
 
 	reply := <-j.Result
 
-	w.WriteJson(reply, "application/json")
+	ct.Write(r, w, reply)
 }
 
 func main() {
@@ -72,7 +103,14 @@ func main() {
 	app.RegisterPlugin("orm", new(plugins.Gorm))
 	app.RegisterPlugin("qm", new(plugins.QM))
 
-	ct := MainController{}
-	ct.Register(app.Container)
+	app.RegisterController(&MainController{}, "") // [ratelimit] applies to every route
+
+	// CRUD resource
+	app.GetPlugin("orm").(*gorm.DB).AutoMigrate(&Note{})
+	notes := resource.New("/notes", Note{})
+	notes.VersionField = "Version"
+	notes.List = system.ListOptions{Sortable: []string{"title", "created_at"}, Filterable: []string{"title"}}
+	notes.Mount(app)
+
 	app.Start()
 }
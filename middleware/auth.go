@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+// Route access levels stored in the "auth" route metadata.
+const (
+	AccessPublic        = "public"
+	AccessAuthenticated = "authenticated"
+)
+
+// Authenticator verifies the credentials of a request for one scheme. It
+// returns nil and no error when the request carries no credentials it
+// understands. Errors reject the credentials with a 401, except ApiErrors,
+// like a failing key lookup, which are written as is.
+type Authenticator interface {
+	Scheme() string
+	Authenticate(req *restful.Request) (*system.Principal, error)
+}
+
+// Auth is a middleware which authenticates requests and stores the
+// principal on the request. It is configured from the [auth] section:
+//
+//	[auth]
+//	default = "public" # access level of routes which don't declare one
+//	realm = "restapi"
+//	methods = ["jwt", "apikey", "basic", "mtls"]
+//
+// Routes declare their access level when they are registered:
+//
+//	ws.Route(ws.GET("/").Do(middleware.Public).To(ct.Index))
+//	ws.Route(ws.GET("/me").Do(middleware.Authenticated).To(ct.Me))
+type Auth struct {
+	Authenticators []Authenticator
+	Default        string
+	Realm          string
+
+	app *system.Application
+}
+
+// NewAuth creates the authentication middleware and the authenticators
+// listed in auth.methods.
+func NewAuth(a *system.Application) *Auth {
+	au := &Auth{
+		Default: a.Config.GetDefault("auth.default", AccessPublic).(string),
+		Realm:   a.Config.GetDefault("auth.realm", "restapi").(string),
+		app:     a,
+	}
+
+	for _, m := range stringList(a.Config, "auth.methods", []string{}) {
+		var auth Authenticator
+		var err error
+		switch m {
+		case "jwt":
+			auth, err = NewJWTAuthenticator(a.Config)
+		case "apikey":
+			auth, err = NewAPIKeyAuthenticator(a)
+		case "basic":
+			auth, err = NewBasicAuthenticator(a.Config)
+		case "mtls":
+			auth, err = NewMTLSAuthenticator(a.Config)
+		default:
+			err = fmt.Errorf("unknown method %q", m)
+		}
+		if err != nil {
+			log.Fatalf("Authentication initialization error:\n%s", err)
+		}
+		au.Authenticators = append(au.Authenticators, auth)
+	}
+
+	return au
+}
+
+// Public marks a route as accessible without credentials.
+func Public(rb *restful.RouteBuilder) {
+	rb.Metadata("auth", AccessPublic)
+}
+
+// Authenticated marks a route as requiring an authenticated principal.
+func Authenticated(rb *restful.RouteBuilder) {
+	rb.Metadata("auth", AccessAuthenticated)
+}
+
+// Filter authenticates the request. Invalid credentials are always rejected,
+// missing credentials only on routes requiring authentication.
+func (au *Auth) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	for _, a := range au.Authenticators {
+		p, err := a.Authenticate(req)
+		var ae system.ApiError
+		if errors.As(err, &ae) {
+			system.WriteRequestError(err, req, resp)
+			return
+		}
+		if err != nil {
+			au.unauthorized(req, resp, fmt.Sprintf("%s authentication failed: %s", a.Scheme(), err))
+			return
+		}
+		if p != nil {
+			system.SetPrincipal(req, p)
+			req.SetAttribute(UserKey, p.Name)
+			break
+		}
+	}
+
+	if system.GetPrincipal(req) == nil && au.access(req) == AccessAuthenticated {
+		au.unauthorized(req, resp, "authentication required")
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
+
+// access returns the access level declared by the selected route.
+func (au *Auth) access(req *restful.Request) string {
+	r := au.app.SelectedRoute(req)
+	if r == nil {
+		// unknown routes are answered with 404/405 further down
+		return AccessPublic
+	}
+	if v, ok := r.Metadata["auth"].(string); ok {
+		return v
+	}
+	return au.Default
+}
+
+func (au *Auth) unauthorized(req *restful.Request, resp *restful.Response, msg string) {
+	for _, a := range au.Authenticators {
+		if a.Scheme() == "mtls" {
+			continue // no HTTP challenge
+		}
+		resp.Header().Add("WWW-Authenticate", fmt.Sprintf("%s realm=%q", authScheme(a), au.Realm))
+	}
+	e := system.NewTypedError("unauthorized", msg, nil)
+	system.WriteRequestError(e, req, resp)
+}
+
+// authScheme maps an authenticator to its WWW-Authenticate scheme.
+func authScheme(a Authenticator) string {
+	switch a.Scheme() {
+	case "jwt":
+		return "Bearer"
+	case "basic":
+		return "Basic"
+	case "apikey":
+		return "ApiKey"
+	}
+	return a.Scheme()
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	"github.com/pelletier/go-toml"
+)
+
+// APIKeyAuthenticator verifies keys sent in a request header against a
+// static list or a database table. It is configured from the [auth.apikey]
+// section:
+//
+//	[auth.apikey]
+//	header = "X-Api-Key"
+//	orm_plugin = "orm"
+//	# looked up with the sha256 hex digest of the key, returns name and
+//	# a comma separated list of roles
+//	query = "SELECT name, roles FROM api_keys WHERE key_hash = ? AND active = 1"
+//
+//	[auth.apikey.keys] # static keys: key = "name"
+//	"5f4dcc3b5aa765d61d8327deb882cf99" = "reporting"
+type APIKeyAuthenticator struct {
+	Header string
+
+	keys   map[string]string // sha256 hex digest of the key: name
+	query  string
+	plugin string
+	app    *system.Application
+}
+
+func NewAPIKeyAuthenticator(a *system.Application) (*APIKeyAuthenticator, error) {
+	k := &APIKeyAuthenticator{
+		Header: a.Config.GetDefault("auth.apikey.header", "X-Api-Key").(string),
+		keys:   map[string]string{},
+		query:  a.Config.GetDefault("auth.apikey.query", "").(string),
+		plugin: a.Config.GetDefault("auth.apikey.orm_plugin", "orm").(string),
+		app:    a,
+	}
+
+	if t := a.Config.Get("auth.apikey.keys"); t != nil {
+		tree, ok := t.(*toml.TomlTree)
+		if !ok {
+			return nil, fmt.Errorf("apikey: auth.apikey.keys must be a table")
+		}
+		for _, key := range tree.Keys() {
+			// keys may contain dots, which Get would split on
+			name, ok := tree.GetPath([]string{key}).(string)
+			if !ok {
+				return nil, fmt.Errorf("apikey: name of key %q must be a string", key)
+			}
+			k.keys[hashKey(key)] = name
+		}
+	}
+
+	return k, nil
+}
+
+func (k *APIKeyAuthenticator) Scheme() string {
+	return "apikey"
+}
+
+func (k *APIKeyAuthenticator) Authenticate(req *restful.Request) (*system.Principal, error) {
+	key := req.HeaderParameter(k.Header)
+	if key == "" {
+		return nil, nil
+	}
+
+	// static keys are looked up by digest, so that the lookup time tells
+	// nothing about the keys
+	digest := hashKey(key)
+	if name, ok := k.keys[digest]; ok {
+		return &system.Principal{ID: name, Name: name, Method: "apikey"}, nil
+	}
+
+	if k.query == "" {
+		return nil, fmt.Errorf("invalid api key")
+	}
+
+	// keys are stored hashed
+	db, ok := k.app.GetPlugin(k.plugin).(*gorm.DB)
+	if !ok {
+		return nil, system.NewTypedError("internal_error", fmt.Sprintf("apikey: orm plugin %q isn't registered", k.plugin), nil)
+	}
+	var name, roles string
+	err := db.Raw(k.query, digest).Row().Scan(&name, &roles)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	if err != nil {
+		// the key may be valid, don't answer with a 401
+		return nil, system.WrapError(err, "service_unavailable", "apikey: key lookup failed", nil)
+	}
+
+	p := &system.Principal{ID: name, Name: name, Method: "apikey"}
+	for _, r := range strings.Split(roles, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			p.Roles = append(p.Roles, r)
+		}
+	}
+	return p, nil
+}
+
+// hashKey returns the sha256 hex digest of an API key.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
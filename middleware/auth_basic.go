@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+	"github.com/pelletier/go-toml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthenticator verifies HTTP Basic credentials against bcrypt hashed
+// passwords listed in the [auth.basic.users] section:
+//
+//	[auth.basic.users]
+//	admin = "$2a$10$..."
+type BasicAuthenticator struct {
+	users map[string][]byte
+	dummy []byte
+}
+
+func NewBasicAuthenticator(config *toml.TomlTree) (*BasicAuthenticator, error) {
+	b := &BasicAuthenticator{users: map[string][]byte{}}
+
+	if t := config.Get("auth.basic.users"); t != nil {
+		tree, ok := t.(*toml.TomlTree)
+		if !ok {
+			return nil, fmt.Errorf("basic: auth.basic.users must be a table")
+		}
+		for _, u := range tree.Keys() {
+			// user names may contain dots, which Get would split on
+			hash, ok := tree.GetPath([]string{u}).(string)
+			if !ok {
+				return nil, fmt.Errorf("basic: password hash of %q must be a string", u)
+			}
+			b.users[u] = []byte(hash)
+		}
+	}
+
+	// compared against for unknown users so they take as long as known ones
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("basic: %s", err)
+	}
+	b.dummy = dummy
+
+	return b, nil
+}
+
+func (b *BasicAuthenticator) Scheme() string {
+	return "basic"
+}
+
+func (b *BasicAuthenticator) Authenticate(req *restful.Request) (*system.Principal, error) {
+	user, pass, ok := req.Request.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, found := b.users[user]
+	if !found {
+		hash = b.dummy
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err != nil || !found {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+
+	return &system.Principal{ID: user, Name: user, Method: "basic"}, nil
+}
@@ -0,0 +1,505 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+	"github.com/pelletier/go-toml"
+)
+
+// JWTAuthenticator verifies bearer tokens signed with HMAC (HS256/384/512),
+// RSA (RS256/384/512) or ECDSA (ES256/384/512). It is configured from the
+// [auth.jwt] section:
+//
+//	[auth.jwt]
+//	algorithms = ["RS256"]
+//	secret = ""          # HS* shared secret
+//	public_key_file = "" # PEM encoded RSA or ECDSA public key
+//	jwks_file = ""       # JSON Web Key Set
+//	jwks_url = ""
+//	jwks_refresh = 3600  # seconds
+//	issuer = ""
+//	audience = ""
+//	roles_claim = "roles"
+//	require_exp = true   # reject tokens without an expiry
+type JWTAuthenticator struct {
+	Algorithms []string
+	Issuer     string
+	Audience   string
+	RolesClaim string
+	RequireExp bool
+
+	secret    []byte
+	publicKey crypto.PublicKey
+	jwks      *jwks
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+func NewJWTAuthenticator(config *toml.TomlTree) (*JWTAuthenticator, error) {
+	j := &JWTAuthenticator{
+		Algorithms: stringList(config, "auth.jwt.algorithms", []string{"HS256"}),
+		Issuer:     config.GetDefault("auth.jwt.issuer", "").(string),
+		Audience:   config.GetDefault("auth.jwt.audience", "").(string),
+		RolesClaim: config.GetDefault("auth.jwt.roles_claim", "roles").(string),
+		RequireExp: config.GetDefault("auth.jwt.require_exp", true).(bool),
+		secret:     []byte(config.GetDefault("auth.jwt.secret", "").(string)),
+	}
+
+	if fp := config.GetDefault("auth.jwt.public_key_file", "").(string); fp != "" {
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: public key loading failed:\n%s", err)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("jwt: public key %q isn't PEM encoded", fp)
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("jwt: certificate parsing failed:\n%s", err)
+			}
+			j.publicKey = cert.PublicKey
+		} else {
+			j.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("jwt: public key parsing failed:\n%s", err)
+			}
+		}
+	}
+
+	file := config.GetDefault("auth.jwt.jwks_file", "").(string)
+	url := config.GetDefault("auth.jwt.jwks_url", "").(string)
+	if file != "" || url != "" {
+		refresh := time.Duration(config.GetDefault("auth.jwt.jwks_refresh", int64(3600)).(int64))
+		j.jwks = &jwks{file: file, url: url, refresh: refresh * time.Second}
+		if err := j.jwks.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+func (j *JWTAuthenticator) Scheme() string {
+	return "jwt"
+}
+
+func (j *JWTAuthenticator) Authenticate(req *restful.Request) (*system.Principal, error) {
+	h := req.HeaderParameter("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return nil, nil
+	}
+
+	claims, err := j.Verify(strings.TrimSpace(h[7:]))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &system.Principal{Method: "jwt", Claims: claims}
+	p.ID, _ = claims["sub"].(string)
+	if n, ok := claims["name"].(string); ok {
+		p.Name = n
+	} else {
+		p.Name = p.ID
+	}
+	p.Roles = claimList(claims[j.RolesClaim])
+	if s, ok := claims["scope"].(string); ok {
+		p.Scopes = strings.Fields(s)
+	} else {
+		p.Scopes = claimList(claims["scp"])
+	}
+
+	return p, nil
+}
+
+// Verify checks the signature and the registered claims of a compact
+// serialized token and returns its claims.
+func (j *JWTAuthenticator) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	if !containsFold(j.Algorithms, header.Alg) {
+		return nil, fmt.Errorf("algorithm %q isn't allowed", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %s", err)
+	}
+	if err := j.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+	if err := j.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (j *JWTAuthenticator) verifySignature(alg, kid, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hash, ok := jwtHashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	key, err := j.key(alg, kid)
+	if err != nil {
+		return err
+	}
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("no HMAC secret configured")
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key isn't an RSA public key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key isn't an ECDSA public key")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// key selects the verification key for a token.
+func (j *JWTAuthenticator) key(alg, kid string) (interface{}, error) {
+	if j.jwks != nil {
+		if k := j.jwks.get(kid); k != nil {
+			// a key is only trusted for the algorithm it declares, the
+			// only key of the set is skipped for tokens naming none
+			switch {
+			case k.alg == "" || k.alg == alg:
+				return k.key, nil
+			case kid != "":
+				return nil, fmt.Errorf("key %q is for %s, not %s", kid, k.alg, alg)
+			}
+		}
+	}
+	if alg[:2] == "HS" && len(j.secret) > 0 {
+		return j.secret, nil
+	}
+	if alg[:2] != "HS" && j.publicKey != nil {
+		return j.publicKey, nil
+	}
+	return nil, fmt.Errorf("no key found for kid %q", kid)
+}
+
+func (j *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := float64(time.Now().Unix())
+	const leeway = 30 // seconds
+
+	exp, ok := claims["exp"].(float64)
+	if !ok && j.RequireExp {
+		return fmt.Errorf("token has no expiry")
+	}
+	if ok && now > exp+leeway {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf-leeway {
+		return fmt.Errorf("token not valid yet")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return fmt.Errorf("invalid issuer")
+	}
+	if j.Audience != "" {
+		aud := claimList(claims["aud"])
+		if s, ok := claims["aud"].(string); ok {
+			aud = []string{s}
+		}
+		found := false
+		for _, a := range aud {
+			if a == j.Audience {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid audience")
+		}
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimList converts a JSON array claim into a list of strings.
+func claimList(v interface{}) []string {
+	list := []string{}
+	items, ok := v.([]interface{})
+	if !ok {
+		return list
+	}
+	for _, i := range items {
+		if s, ok := i.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// jwks is a JSON Web Key Set loaded from a file or URL and refreshed
+// periodically. Failed refreshes aren't retried before the next period,
+// and a single refresh runs at a time.
+type jwks struct {
+	file    string
+	url     string
+	refresh time.Duration
+
+	mu        sync.RWMutex
+	keys      map[string]*webKey
+	attempted time.Time     // start of the last load, successful or not
+	loading   chan struct{} // closed when the running load ends
+}
+
+// webKey is a verification key and the algorithm it is restricted to.
+type webKey struct {
+	key interface{}
+	alg string
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (s *jwks) get(kid string) *webKey {
+	s.mu.RLock()
+	since := time.Since(s.attempted)
+	k, ok := s.lookup(kid)
+	s.mu.RUnlock()
+
+	// refresh on schedule, or early when an unknown key id shows up
+	if since > s.refresh || (!ok && since > time.Minute) {
+		s.reload()
+		s.mu.RLock()
+		k, ok = s.lookup(kid)
+		s.mu.RUnlock()
+	}
+	if !ok {
+		return nil
+	}
+	return k
+}
+
+// reload refreshes the keys, or waits for the refresh already running.
+func (s *jwks) reload() {
+	s.mu.Lock()
+	if wait := s.loading; wait != nil {
+		s.mu.Unlock()
+		<-wait
+		return
+	}
+	done := make(chan struct{})
+	s.loading = done
+	s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		log.Printf("jwt: jwks refresh failed: %s", err)
+	}
+
+	s.mu.Lock()
+	s.loading = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+// lookup finds a key by id. Tokens without a key id can only be verified
+// against a set holding a single key.
+func (s *jwks) lookup(kid string) (*webKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+func (s *jwks) load() error {
+	s.mu.Lock()
+	s.attempted = time.Now()
+	s.mu.Unlock()
+
+	var r io.ReadCloser
+	if s.url != "" {
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(s.url)
+		if err != nil {
+			return fmt.Errorf("jwt: jwks download failed:\n%s", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("jwt: jwks download failed: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(s.file)
+		if err != nil {
+			return fmt.Errorf("jwt: jwks file loading failed:\n%s", err)
+		}
+		r = f
+	}
+	defer r.Close()
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return fmt.Errorf("jwt: jwks parsing failed:\n%s", err)
+	}
+
+	keys := map[string]*webKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.publicKey()
+		if err != nil {
+			return fmt.Errorf("jwt: jwks key %q: %s", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = &webKey{k, jwk.Alg}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+	"github.com/pelletier/go-toml"
+)
+
+// MTLSAuthenticator authenticates clients by the certificate they presented
+// over mutual TLS, see the [tls] section. Roles are granted per certificate
+// identity in the [auth.mtls.roles] section:
+//
+//	[auth.mtls.roles] # identity = [roles]
+//	"spiffe://example.org/billing" = ["service"]
+type MTLSAuthenticator struct {
+	roles map[string][]string
+}
+
+func NewMTLSAuthenticator(config *toml.TomlTree) (*MTLSAuthenticator, error) {
+	m := &MTLSAuthenticator{roles: map[string][]string{}}
+
+	if t := config.Get("auth.mtls.roles"); t != nil {
+		tree, ok := t.(*toml.TomlTree)
+		if !ok {
+			return nil, fmt.Errorf("mtls: auth.mtls.roles must be a table")
+		}
+		for _, id := range tree.Keys() {
+			// identities contain dots, which Get would split on
+			roles, ok := tree.GetPath([]string{id}).([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("mtls: roles of %q must be a list", id)
+			}
+			for _, r := range roles {
+				m.roles[id] = append(m.roles[id], fmt.Sprint(r))
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func (m *MTLSAuthenticator) Scheme() string {
+	return "mtls"
+}
+
+func (m *MTLSAuthenticator) Authenticate(req *restful.Request) (*system.Principal, error) {
+	cert := system.ClientCertificate(req)
+	if cert == nil {
+		return nil, nil
+	}
+
+	id := system.CertificateIdentity(cert)
+	uris := []string{}
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	p := &system.Principal{
+		ID:     id,
+		Name:   cert.Subject.CommonName,
+		Method: "mtls",
+		Roles:  m.roles[id],
+		Claims: map[string]interface{}{
+			"subject": cert.Subject.String(),
+			"issuer":  cert.Issuer.String(),
+			"serial":  cert.SerialNumber.String(),
+			"dns":     cert.DNSNames,
+			"uris":    uris,
+			"emails":  cert.EmailAddresses,
+		},
+	}
+	return p, nil
+}
@@ -0,0 +1,306 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPlugin registers a value as a plugin.
+type testPlugin struct {
+	v interface{}
+}
+
+func (p testPlugin) Init(a *system.Application) error { return nil }
+func (p testPlugin) Close() error                     { return nil }
+func (p testPlugin) Get() interface{}                 { return p.v }
+
+func segment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signHS256(secret string, header, claims map[string]interface{}) string {
+	signed := segment(header) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	signed := segment(header) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// jwksServer serves a key set holding the public key of key under kid,
+// counting the downloads.
+func jwksServer(t *testing.T, key *rsa.PrivateKey, kid, alg string, fail *int32) (*httptest.Server, *int32) {
+	loads := new(int32)
+	set := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": alg,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(loads, 1)
+		if fail != nil && atomic.LoadInt32(fail) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, loads
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := jwksServer(t, rsaKey, "k1", "RS256", nil)
+
+	a := newTestApp(t, fmt.Sprintf(`
+[auth.jwt]
+algorithms = ["HS256", "RS256"]
+secret = "s3cret"
+jwks_url = %q
+issuer = "https://issuer"
+audience = "api"
+`, srv.URL))
+	j, err := NewJWTAuthenticator(a.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "iss": "https://issuer", "aud": "api", "exp": now + 60}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"hmac", signHS256("s3cret", hs, claims(nil)), ""},
+		{"jwks", signRS256(rsaKey, rs, claims(nil)), ""},
+		{"wrong secret", signHS256("other", hs, claims(nil)), "invalid signature"},
+		{"algorithm not allowed", signHS256("s3cret", map[string]interface{}{"alg": "HS512"}, claims(nil)), "isn't allowed"},
+		{"none", segment(map[string]string{"alg": "none"}) + "." + segment(claims(nil)) + ".", "isn't allowed"},
+		{"key algorithm mismatch", signHS256("s3cret", map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims(nil)), "is for RS256"},
+		{"unknown kid", signRS256(rsaKey, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil)), "no key found"},
+		{"expired", signHS256("s3cret", hs, claims(map[string]interface{}{"exp": now - 60})), "expired"},
+		{"no expiry", signHS256("s3cret", hs, claims(map[string]interface{}{"exp": nil})), "no expiry"},
+		{"not yet valid", signHS256("s3cret", hs, claims(map[string]interface{}{"nbf": now + 60})), "not valid yet"},
+		{"issuer", signHS256("s3cret", hs, claims(map[string]interface{}{"iss": "other"})), "invalid issuer"},
+		{"audience list", signHS256("s3cret", hs, claims(map[string]interface{}{"aud": []string{"web", "api"}})), ""},
+		{"audience", signHS256("s3cret", hs, claims(map[string]interface{}{"aud": "web"})), "invalid audience"},
+		{"malformed", "abc.def", "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := j.Verify(tt.token)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	j.RequireExp = false
+	if _, err := j.Verify(signHS256("s3cret", hs, claims(map[string]interface{}{"exp": nil}))); err != nil {
+		t.Errorf("token without expiry and require_exp = false: %s", err)
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := new(int32)
+	srv, loads := jwksServer(t, rsaKey, "k1", "RS256", fail)
+	s := &jwks{url: srv.URL, refresh: time.Hour}
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown key ids only trigger a refresh once a minute
+	if k := s.get("k2"); k != nil || atomic.LoadInt32(loads) != 1 {
+		t.Errorf("got %v after %d loads, want no key and no refresh", k, atomic.LoadInt32(loads))
+	}
+
+	// concurrent requests share a single refresh
+	atomic.StoreInt32(fail, 1)
+	s.mu.Lock()
+	s.attempted = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.get("k1")
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(loads); n != 2 {
+		t.Errorf("%d loads, want 2", n)
+	}
+
+	// a failed refresh keeps the keys and isn't retried right away
+	if k := s.get("k1"); k == nil || k.alg != "RS256" {
+		t.Errorf("got %v, want the previous key", k)
+	}
+	if k := s.get("k2"); k != nil || atomic.LoadInt32(loads) != 2 {
+		t.Errorf("got %v after %d loads, want no key and no retry", k, atomic.LoadInt32(loads))
+	}
+}
+
+func newAPIKeyTestApp(t *testing.T, query string) http.Handler {
+	a := newTestApp(t, fmt.Sprintf(`
+[auth]
+default = "authenticated"
+methods = ["apikey"]
+
+[auth.apikey]
+query = %q
+
+[auth.apikey.keys]
+"static-key" = "reporting"
+"static.key" = "ops"
+`, query))
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orm := &db
+	t.Cleanup(func() { orm.Close() })
+	orm.DB().SetMaxOpenConns(1)
+	if err := orm.Exec("CREATE TABLE api_keys (key_hash TEXT, name TEXT, roles TEXT)").Error; err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("db-key"))
+	if err := orm.Exec("INSERT INTO api_keys VALUES (?, 'billing', 'admin, reader')", fmt.Sprintf("%x", sum)).Error; err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterPlugin("orm", testPlugin{orm})
+
+	au := NewAuth(a)
+	ws := new(restful.WebService).Path("/me")
+	ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+		p := system.GetPrincipal(req)
+		fmt.Fprintf(resp, "%s %s %v", p.ID, req.Attribute(UserKey), p.Roles)
+	}))
+	a.Container.Add(ws)
+	a.Container.Filter(au.Filter)
+	return a.Container
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	const query = "SELECT name, roles FROM api_keys WHERE key_hash = ?"
+	tests := []struct {
+		name   string
+		query  string
+		key    string
+		status int
+		body   string
+	}{
+		{"static key", query, "static-key", 200, "reporting reporting []"},
+		{"dotted static key", query, "static.key", 200, "ops ops []"},
+		{"database key", query, "db-key", 200, "billing billing [admin reader]"},
+		{"unknown key", query, "other", 401, ""},
+		{"no key", query, "", 401, ""},
+		{"database error", "SELECT name, roles FROM missing WHERE key_hash = ?", "db-key", 503, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newAPIKeyTestApp(t, tt.query)
+			w := do(h, "GET", "/me", map[string]string{"X-Api-Key": tt.key})
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.body)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); (tt.status == 401) != (got != "") {
+				t.Errorf("WWW-Authenticate %q on a %d", got, w.Code)
+			}
+		})
+	}
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestApp(t, fmt.Sprintf(`
+[auth.basic.users]
+admin = %q
+"john.doe" = %q
+`, hash, hash))
+	b, err := NewBasicAuthenticator(a.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		pass string
+		id   string
+		err  bool
+	}{
+		{"user", "admin", "secret", "admin", false},
+		{"dotted user", "john.doe", "secret", "john.doe", false},
+		{"wrong password", "john.doe", "other", "", true},
+		{"unknown user", "john", "secret", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(tt.user, tt.pass)
+			p, err := b.Authenticate(restful.NewRequest(r))
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if p != nil && p.ID != tt.id {
+				t.Errorf("principal %q, want %q", p.ID, tt.id)
+			}
+		})
+	}
+}
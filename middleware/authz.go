@@ -0,0 +1,376 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	"github.com/pelletier/go-toml"
+)
+
+// Route metadata keys holding authorisation requirements.
+const (
+	RolesKey       = "authz.roles"
+	ScopesKey      = "authz.scopes"
+	PermissionsKey = "authz.permissions"
+)
+
+// PolicyProvider resolves the roles of a principal and the permissions
+// granted to each role.
+type PolicyProvider interface {
+	Roles(p *system.Principal) ([]string, error)
+	Permissions(role string) ([]string, error)
+}
+
+// Authorizer is a middleware enforcing the roles, scopes and permissions
+// routes declare when they are registered:
+//
+//	ws.Route(ws.DELETE("/users/{id}").
+//		Do(middleware.RequireRoles("admin")).
+//		Do(middleware.RequirePermissions("users:delete")).
+//		To(ct.DeleteUser))
+//
+// It must run after the Auth middleware.
+type Authorizer struct {
+	Policy PolicyProvider
+
+	app *system.Application
+}
+
+// NewAuthorizer creates the authorisation middleware using the policy
+// selected in the [authz] section:
+//
+//	[authz]
+//	policy = "static" # or "sql"
+//
+//	[authz.roles] # static policy: role = [permissions]
+//	admin = ["users:read", "users:write"]
+//
+//	[authz.sql] # names of queries loaded by the QM plugin
+//	orm_plugin = "orm"
+//	qm_plugin = "qm"
+//	roles_query = "user-roles" # principal ID and authentication method
+//	permissions_query = "role-permissions"
+//	cache_ttl = 60 # seconds
+func NewAuthorizer(a *system.Application) *Authorizer {
+	az := &Authorizer{app: a}
+
+	switch p := a.Config.GetDefault("authz.policy", "static").(string); p {
+	case "static":
+		policy, err := NewStaticPolicy(a.Config)
+		if err != nil {
+			log.Fatalf("Authorisation initialization error:\n%s", err)
+		}
+		az.Policy = policy
+	case "sql":
+		az.Policy = NewSQLPolicy(a)
+	default:
+		log.Fatalf("Authorisation initialization error:\nunknown policy %q", p)
+	}
+
+	return az
+}
+
+// RequireRoles restricts a route to principals having any of roles.
+func RequireRoles(roles ...string) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rb.Metadata(RolesKey, roles)
+		documentAuthz(rb, "roles", roles)
+	}
+}
+
+// RequireScopes restricts a route to principals granted all scopes.
+func RequireScopes(scopes ...string) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rb.Metadata(ScopesKey, scopes)
+		documentAuthz(rb, "scopes", scopes)
+	}
+}
+
+// RequirePermissions restricts a route to principals whose roles grant all
+// permissions.
+func RequirePermissions(perms ...string) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rb.Metadata(PermissionsKey, perms)
+		documentAuthz(rb, "permissions", perms)
+	}
+}
+
+// documentAuthz lists the requirement in the swagger response messages.
+func documentAuthz(rb *restful.RouteBuilder, kind string, values []string) {
+	rb.Do(Authenticated)
+	rb.ReturnsError(401, "Unauthorized (unauthorized)", system.ProblemDetails{})
+	rb.ReturnsError(403, fmt.Sprintf("Forbidden (forbidden). Requires %s: %s", kind, strings.Join(values, ", ")), system.ProblemDetails{})
+}
+
+// Filter enforces the requirements of the selected route.
+func (az *Authorizer) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	r := az.app.SelectedRoute(req)
+	if r == nil || !requiresAuthz(r) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	p := system.GetPrincipal(req)
+	if p == nil {
+		e := system.NewTypedError("unauthorized", "authorisation requires an authenticated principal", nil)
+		system.WriteRequestError(e, req, resp)
+		return
+	}
+
+	if err := az.Authorize(p, r); err != nil {
+		var ae system.ApiError
+		if errors.As(err, &ae) {
+			// the policy couldn't be evaluated, the request may be allowed
+			system.WriteRequestError(err, req, resp)
+			return
+		}
+		e := system.NewTypedError(
+			"forbidden",
+			fmt.Sprintf("%s %q denied %s %s: %s", p.Method, p.ID, r.Method, r.Path, err),
+			nil,
+		)
+		system.WriteRequestError(e, req, resp)
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
+
+// Authorize checks the principal against the requirements of a route.
+// Policy lookup failures are returned as service_unavailable ApiErrors,
+// unless the policy failed with an ApiError of its own, denials as plain
+// errors.
+func (az *Authorizer) Authorize(p *system.Principal, r *restful.Route) error {
+	roles, err := az.Policy.Roles(p)
+	if err != nil {
+		return lookupError(err, "authz: roles lookup failed")
+	}
+	// policies may return cached slices, don't append to them
+	roles = append(append([]string{}, roles...), p.Roles...)
+
+	if required, ok := r.Metadata[RolesKey].([]string); ok {
+		if !anyOf(roles, required) {
+			return fmt.Errorf("missing role, one of %v required", required)
+		}
+	}
+
+	if required, ok := r.Metadata[ScopesKey].([]string); ok {
+		for _, s := range required {
+			if !p.HasScope(s) {
+				return fmt.Errorf("missing scope %q", s)
+			}
+		}
+	}
+
+	if required, ok := r.Metadata[PermissionsKey].([]string); ok {
+		granted := []string{}
+		for _, role := range roles {
+			perms, err := az.Policy.Permissions(role)
+			if err != nil {
+				return lookupError(err, "authz: permissions lookup failed")
+			}
+			granted = append(granted, perms...)
+		}
+		for _, perm := range required {
+			if !anyOf(granted, []string{perm}) {
+				return fmt.Errorf("missing permission %q", perm)
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookupError wraps a policy lookup failure. ApiErrors of the policy keep
+// their status, other failures are answered with a 503.
+func lookupError(err error, sm string) error {
+	var ae system.ApiError
+	if errors.As(err, &ae) {
+		return fmt.Errorf("%s: %w", sm, err)
+	}
+	return system.WrapError(err, "service_unavailable", sm, nil)
+}
+
+func requiresAuthz(r *restful.Route) bool {
+	for _, k := range []string{RolesKey, ScopesKey, PermissionsKey} {
+		if _, ok := r.Metadata[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func anyOf(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StaticPolicy grants permissions to roles as listed in [authz.roles].
+// Principals keep the roles they were authenticated with.
+type StaticPolicy map[string][]string
+
+func NewStaticPolicy(config *toml.TomlTree) (StaticPolicy, error) {
+	policy := StaticPolicy{}
+	t := config.Get("authz.roles")
+	if t == nil {
+		return policy, nil
+	}
+	tree, ok := t.(*toml.TomlTree)
+	if !ok {
+		return nil, fmt.Errorf("authz: authz.roles must be a table")
+	}
+	for _, role := range tree.Keys() {
+		// role names may contain dots, which Get would split on
+		perms, ok := tree.GetPath([]string{role}).([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("authz: permissions of role %q must be a list", role)
+		}
+		policy[role] = []string{}
+		for _, perm := range perms {
+			policy[role] = append(policy[role], fmt.Sprint(perm))
+		}
+	}
+	return policy, nil
+}
+
+func (sp StaticPolicy) Roles(p *system.Principal) ([]string, error) {
+	return []string{}, nil
+}
+
+func (sp StaticPolicy) Permissions(role string) ([]string, error) {
+	return sp[role], nil
+}
+
+// SQLPolicy looks roles and permissions up in the database, using queries
+// loaded by the QM plugin. The roles query receives the principal ID and
+// its authentication method ("basic", "apikey", "jwt" or "mtls"), so that
+// a user and an API key of the same name don't share roles:
+//
+//	SELECT role FROM user_roles WHERE user = ? AND method = ?
+//
+// The permissions query receives a role name. Both return a single column.
+// Results are cached for cache_ttl seconds, expired results are dropped
+// every so often.
+type SQLPolicy struct {
+	app              *system.Application
+	ormPlugin        string
+	qmPlugin         string
+	rolesQuery       string
+	permissionsQuery string
+	ttl              time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedList
+	calls int
+}
+
+type cachedList struct {
+	values  []string
+	expires time.Time
+}
+
+func NewSQLPolicy(a *system.Application) *SQLPolicy {
+	return &SQLPolicy{
+		app:              a,
+		ormPlugin:        a.Config.GetDefault("authz.sql.orm_plugin", "orm").(string),
+		qmPlugin:         a.Config.GetDefault("authz.sql.qm_plugin", "qm").(string),
+		rolesQuery:       a.Config.GetDefault("authz.sql.roles_query", "user-roles").(string),
+		permissionsQuery: a.Config.GetDefault("authz.sql.permissions_query", "role-permissions").(string),
+		ttl:              time.Duration(a.Config.GetDefault("authz.sql.cache_ttl", int64(60)).(int64)) * time.Second,
+		cache:            map[string]cachedList{},
+	}
+}
+
+func (sp *SQLPolicy) Roles(p *system.Principal) ([]string, error) {
+	return sp.list(sp.rolesQuery, p.ID, p.Method)
+}
+
+func (sp *SQLPolicy) Permissions(role string) ([]string, error) {
+	return sp.list(sp.permissionsQuery, role)
+}
+
+// list runs a query and caches its result by name and arguments.
+func (sp *SQLPolicy) list(name string, args ...string) ([]string, error) {
+	key := name
+	params := make([]interface{}, len(args))
+	for i, a := range args {
+		key += ":" + strconv.Quote(a) // IDs may contain colons
+		params[i] = a
+	}
+
+	sp.mu.Lock()
+	c, ok := sp.cache[key]
+	sp.mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.values, nil
+	}
+
+	db, ok := sp.app.GetPlugin(sp.ormPlugin).(*gorm.DB)
+	if !ok {
+		return nil, fmt.Errorf("orm plugin %q isn't registered", sp.ormPlugin)
+	}
+	qm, ok := sp.app.GetPlugin(sp.qmPlugin).(interface {
+		Get(name string) string
+	})
+	if !ok {
+		return nil, fmt.Errorf("qm plugin %q isn't registered", sp.qmPlugin)
+	}
+	q := qm.Get(name)
+	if q == "" {
+		return nil, fmt.Errorf("query %q not found", name)
+	}
+
+	rows, err := db.Raw(q, params...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sp.mu.Lock()
+	sp.sweep(now)
+	sp.cache[key] = cachedList{values, now.Add(sp.ttl)}
+	sp.mu.Unlock()
+
+	return values, nil
+}
+
+// sweep drops expired results every so often to bound memory usage.
+func (sp *SQLPolicy) sweep(now time.Time) {
+	sp.calls++
+	if sp.calls < 1000 {
+		return
+	}
+	sp.calls = 0
+	for k, c := range sp.cache {
+		if now.After(c.expires) {
+			delete(sp.cache, k)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+)
+
+const authzTestConfig = `
+[authz]
+policy = "static"
+
+[authz.roles]
+admin = ["users:read", "users:write"]
+reader = ["users:read"]
+"users.reader" = ["users:read"]
+`
+
+func newAuthzTestApp(t *testing.T) (*Authorizer, http.Handler) {
+	a := newTestApp(t, authzTestConfig)
+	az := NewAuthorizer(a)
+	ok := func(req *restful.Request, resp *restful.Response) {}
+
+	ws := new(restful.WebService).Path("/users")
+	ws.Route(ws.GET("/open").To(ok))
+	ws.Route(ws.GET("/admin").Do(RequireRoles("admin")).To(ok))
+	ws.Route(ws.GET("/scoped").Do(RequireScopes("users")).To(ok))
+	ws.Route(ws.GET("").Do(RequirePermissions("users:read")).To(ok))
+	ws.Route(ws.DELETE("").Do(RequirePermissions("users:read", "users:write")).To(ok))
+	a.Container.Add(ws)
+
+	// X-Test-Roles and X-Test-Scopes list the grants of the principal
+	a.Container.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		if id := req.HeaderParameter("X-Test-User"); id != "" {
+			system.SetPrincipal(req, &system.Principal{
+				ID:     id,
+				Method: "test",
+				Roles:  split(req.HeaderParameter("X-Test-Roles")),
+				Scopes: split(req.HeaderParameter("X-Test-Scopes")),
+			})
+		}
+		chain.ProcessFilter(req, resp)
+	})
+	a.Container.Filter(az.Filter)
+	return az, a.Container
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func TestAuthorizer(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		user   string
+		roles  string
+		scopes string
+		status int
+	}{
+		{"no requirements", "GET", "/users/open", "", "", "", 200},
+		{"anonymous", "GET", "/users/admin", "", "", "", 401},
+		{"role granted", "GET", "/users/admin", "alice", "admin", "", 200},
+		{"role missing", "GET", "/users/admin", "bob", "reader", "", 403},
+		{"scope granted", "GET", "/users/scoped", "alice", "", "users,orders", 200},
+		{"scope missing", "GET", "/users/scoped", "alice", "admin", "orders", 403},
+		{"permission granted", "GET", "/users", "bob", "reader", "", 200},
+		{"permission missing", "DELETE", "/users", "bob", "reader", "", 403},
+		{"permissions of several roles", "DELETE", "/users", "alice", "reader,admin", "", 200},
+		{"unknown role", "GET", "/users", "carol", "guest", "", 403},
+		{"dotted role", "GET", "/users", "dave", "users.reader", "", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h := newAuthzTestApp(t)
+			w := do(h, tt.method, tt.path, map[string]string{
+				"X-Test-User":   tt.user,
+				"X-Test-Roles":  tt.roles,
+				"X-Test-Scopes": tt.scopes,
+			})
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+// sharedPolicy returns the same roles slice to every caller, like a cache
+// does, with room to append to it.
+type sharedPolicy struct {
+	roles []string
+}
+
+func (sp sharedPolicy) Roles(p *system.Principal) ([]string, error) {
+	return sp.roles, nil
+}
+
+func (sp sharedPolicy) Permissions(role string) ([]string, error) {
+	return []string{role + ":read"}, nil
+}
+
+func TestAuthorizeConcurrent(t *testing.T) {
+	roles := make([]string, 1, 16)
+	roles[0] = "reader"
+	az := &Authorizer{Policy: sharedPolicy{roles}}
+	route := &restful.Route{Method: "GET", Path: "/users", Metadata: map[string]interface{}{
+		RolesKey:       []string{"reader"},
+		PermissionsKey: []string{"reader:read"},
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := &system.Principal{ID: "u", Roles: []string{strings.Repeat("x", i)}}
+			if err := az.Authorize(p, route); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(roles) != 1 || roles[:2][1] != "" {
+		t.Errorf("policy roles modified: %v", roles[:2])
+	}
+}
+
+// failingPolicy fails its lookups with err.
+type failingPolicy struct {
+	err error
+}
+
+func (fp failingPolicy) Roles(p *system.Principal) ([]string, error) { return nil, fp.err }
+func (fp failingPolicy) Permissions(role string) ([]string, error)   { return nil, fp.err }
+
+func TestAuthorizerPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"plain", fmt.Errorf("connection reset"), 503},
+		{"api error", system.NewTypedError("timeout", "policy timed out", nil), 504},
+		{"wrapped api error", fmt.Errorf("lookup: %w", system.NewTypedError("timeout", "policy timed out", nil)), 504},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			az, h := newAuthzTestApp(t)
+			az.Policy = failingPolicy{tt.err}
+			if w := do(h, "GET", "/users/admin", map[string]string{"X-Test-User": "alice"}); w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+// testQueries is a QM plugin holding queries by name.
+type testQueries map[string]string
+
+func (q testQueries) Get(name string) string { return q[name] }
+
+// newSQLPolicyTestApp serves GET /users, which requires the users:read
+// permission, with the SQL policy. The database grants it to alice.
+func newSQLPolicyTestApp(t *testing.T, queries testQueries, orm bool) (*SQLPolicy, http.Handler) {
+	s := newTestServer(t, "[authz]\npolicy = \"sql\"\n")
+	if orm {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		orm := &db
+		t.Cleanup(func() { orm.Close() })
+		orm.DB().SetMaxOpenConns(1)
+		for _, q := range []string{
+			"CREATE TABLE user_roles (user TEXT, method TEXT, role TEXT)",
+			"CREATE TABLE role_permissions (role TEXT, permission TEXT)",
+			"INSERT INTO user_roles VALUES ('alice', 'test', 'reader')",
+			"INSERT INTO role_permissions VALUES ('reader', 'users:read')",
+		} {
+			if err := orm.Exec(q).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.RegisterPlugin("orm", testPlugin{orm})
+	}
+	s.RegisterPlugin("qm", testPlugin{queries})
+	az := NewAuthorizer(s.Application)
+
+	ws := new(restful.WebService).Path("/users")
+	ws.Route(ws.GET("").Do(RequirePermissions("users:read")).To(func(req *restful.Request, resp *restful.Response) {}))
+	return az.Policy.(*SQLPolicy), s.serve(ws, az.Filter)
+}
+
+func TestSQLPolicy(t *testing.T) {
+	queries := testQueries{
+		"user-roles":       "SELECT role FROM user_roles WHERE user = ? AND method = ?",
+		"role-permissions": "SELECT permission FROM role_permissions WHERE role = ?",
+	}
+	tests := []struct {
+		name    string
+		queries testQueries
+		orm     bool
+		user    string
+		status  int
+	}{
+		{"granted", queries, true, "alice", 200},
+		{"denied", queries, true, "bob", 403},
+		{"orm plugin missing", queries, false, "alice", 503},
+		{"query missing", testQueries{"user-roles": queries["user-roles"]}, true, "alice", 503},
+		{"query failure", testQueries{"user-roles": "SELECT role FROM missing WHERE user = ? AND method = ?"}, true, "alice", 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h := newSQLPolicyTestApp(t, tt.queries, tt.orm)
+			if w := do(h, "GET", "/users", map[string]string{"X-Test-User": tt.user}); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSQLPolicyCacheSweep(t *testing.T) {
+	sp, _ := newSQLPolicyTestApp(t, testQueries{"user-roles": "SELECT role FROM user_roles WHERE user = ? AND method = ?"}, true)
+	expired := time.Now().Add(-time.Second)
+	for i := 0; i < 1000; i++ {
+		sp.cache[fmt.Sprint("user-roles:", i)] = cachedList{nil, expired}
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := sp.Roles(&system.Principal{ID: fmt.Sprint("user", i), Method: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, c := range sp.cache {
+		if c.expires.Before(time.Now()) {
+			t.Fatalf("expired result %q kept", k)
+		}
+	}
+}
+
+func TestSQLPolicyMethods(t *testing.T) {
+	sp, _ := newSQLPolicyTestApp(t, testQueries{"user-roles": "SELECT role FROM user_roles WHERE user = ? AND method = ?"}, true)
+	tests := []struct {
+		method string
+		roles  int
+	}{
+		{"test", 1},
+		{"apikey", 0},
+		{"test", 1}, // cached
+		{"apikey", 0},
+	}
+	for _, tt := range tests {
+		roles, err := sp.Roles(&system.Principal{ID: "alice", Method: tt.method})
+		if err != nil || len(roles) != tt.roles {
+			t.Errorf("%s: roles %v (%v), want %d", tt.method, roles, err, tt.roles)
+		}
+	}
+}
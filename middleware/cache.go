@@ -0,0 +1,578 @@
+package middleware
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/garyburd/redigo/redis"
+	"github.com/johnwilson/restapi/system"
+)
+
+// CacheKey is the route metadata holding the CachePolicy of a route.
+const CacheKey = "cache"
+
+// CachePolicy describes how the responses of a route are cached.
+type CachePolicy struct {
+	TTL   time.Duration
+	Vary  []string // request headers which select a different response
+	Query []string // query parameters part of the key, nil for all of them
+	// Shared lets authenticated requests share the responses of anonymous
+	// ones, for routes whose responses don't depend on the caller.
+	Shared bool
+}
+
+// Cached caches the GET responses of a route:
+//
+//	ws.Route(ws.GET("/dbversion").
+//		Do(middleware.Cached(middleware.CachePolicy{TTL: time.Minute})).
+//		To(ct.DBVersion))
+//
+// Responses to authenticated requests are cached per principal, unless the
+// policy is Shared. Requests with an Authorization header but no principal
+// are only cached when Authorization is listed in Vary.
+func Cached(p CachePolicy) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rb.Metadata(CacheKey, p)
+	}
+}
+
+// CachedResponse is a response kept in a cache store.
+type CachedResponse struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// CacheStore keeps cached responses. Responses are grouped by path so that
+// every variant of a path can be invalidated at once.
+type CacheStore interface {
+	Get(group, variant string) (*CachedResponse, error) // nil when missing
+	Set(group, variant string, r *CachedResponse) error
+	Purge(groups ...string) error
+	PurgePrefix(prefix string) error
+}
+
+// Cache is a middleware which caches the responses of routes declaring a
+// CachePolicy. It is configured from the [cache] section:
+//
+//	[cache]
+//	store = "memory" # or "redis"
+//	max_entries = 1000 # memory store size
+//	redis_plugin = "redis"
+//	prefix = "cache:"
+//
+// Request Cache-Control directives are honoured: no-cache skips the lookup,
+// no-store bypasses the cache, max-age bounds the age of cached responses
+// and only-if-cached returns a 504 on misses. Responses marked no-store or
+// private aren't stored. Successful PUT, PATCH, POST and DELETE requests
+// invalidate the cached responses of their path and of its parent
+// collection, e.g. /users/42 and /users.
+type Cache struct {
+	Store  CacheStore
+	Prefix string
+
+	app *system.Application
+}
+
+// NewCache creates the response cache. The redis store looks the pool of
+// the redis plugin up when it's used, so plugins may be registered after
+// the cache is created.
+func NewCache(a *system.Application) *Cache {
+	c := &Cache{
+		Prefix: a.Config.GetDefault("cache.prefix", "cache:").(string),
+		app:    a,
+	}
+
+	switch s := a.Config.GetDefault("cache.store", "memory").(string); s {
+	case "memory":
+		c.Store = NewMemoryCacheStore(int(a.Config.GetDefault("cache.max_entries", int64(1000)).(int64)))
+	case "redis":
+		c.Store = &RedisCacheStore{app: a, plugin: a.Config.GetDefault("cache.redis_plugin", "redis").(string)}
+	default:
+		log.Fatalf("Cache: unknown store %q\n", s)
+	}
+
+	return c
+}
+
+// Invalidate drops the cached responses of the given paths.
+func (c *Cache) Invalidate(paths ...string) error {
+	groups := make([]string, len(paths))
+	for i, p := range paths {
+		groups[i] = c.Prefix + p
+	}
+	return c.Store.Purge(groups...)
+}
+
+// InvalidatePrefix drops the cached responses of every path starting with
+// prefix.
+func (c *Cache) InvalidatePrefix(prefix string) error {
+	return c.Store.PurgePrefix(c.Prefix + prefix)
+}
+
+// Filter serves and stores cached responses.
+func (c *Cache) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	method := req.Request.Method
+	if method != "GET" && method != "HEAD" {
+		chain.ProcessFilter(req, resp)
+		if s := resp.StatusCode(); s >= 200 && s < 300 {
+			if err := c.Invalidate(writePaths(req.Request.URL.Path)...); err != nil {
+				log.Errorf("Cache invalidation error: %s", err)
+			}
+		}
+		return
+	}
+
+	r := c.app.SelectedRoute(req)
+	if r == nil {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	p, ok := r.Metadata[CacheKey].(CachePolicy)
+	anonymous := system.GetPrincipal(req) == nil
+	if !ok || (anonymous && req.HeaderParameter("Authorization") != "" && !containsFold(p.Vary, "Authorization")) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	cc := cacheControl(req.HeaderParameter("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		resp.Header().Set("X-Cache", "BYPASS")
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	group, variant := c.Prefix+req.Request.URL.Path, c.variant(req, p)
+	if _, ok := cc["no-cache"]; !ok {
+		cached, err := c.Store.Get(group, variant)
+		if err != nil {
+			log.Errorf("Cache store error: %s", err)
+		}
+		if cached != nil && fresh(cached, cc) {
+			c.write(resp, cached)
+			return
+		}
+	}
+	if _, ok := cc["only-if-cached"]; ok {
+		system.WriteRequestError(system.NewTypedError(
+			"timeout",
+			"cache: miss for only-if-cached request "+req.Request.URL.String(),
+			"The response isn't cached.",
+		), req, resp)
+		return
+	}
+
+	// buffer the response to store it
+	w := resp.ResponseWriter
+	buf := &bufferedWriter{header: w.Header()}
+	resp.ResponseWriter = buf
+	w.Header().Set("X-Cache", "MISS")
+	func() {
+		// a panic leaves the buffer for the recoverer to write to w
+		defer func() { resp.ResponseWriter = w }()
+		chain.ProcessFilter(req, resp)
+	}()
+
+	if buf.status == 0 {
+		buf.status = http.StatusOK
+	}
+	if buf.status == http.StatusOK && method == "GET" && storable(w.Header()) {
+		now := time.Now()
+		cached := &CachedResponse{
+			Status:  buf.status,
+			Header:  cloneHeader(w.Header()),
+			Body:    buf.body.Bytes(),
+			Stored:  now,
+			Expires: now.Add(p.TTL),
+		}
+		if err := c.Store.Set(group, variant, cached); err != nil {
+			log.Errorf("Cache store error: %s", err)
+		}
+	}
+
+	w.WriteHeader(buf.status)
+	w.Write(buf.body.Bytes())
+}
+
+// variant builds the key of a response within its path from the selected
+// query parameters, vary headers and principal.
+func (c *Cache) variant(req *restful.Request, p CachePolicy) string {
+	query := req.Request.URL.Query()
+	if p.Query != nil {
+		selected := url.Values{}
+		for _, k := range p.Query {
+			if v, ok := query[k]; ok {
+				selected[k] = v
+			}
+		}
+		query = selected
+	}
+
+	parts := []string{query.Encode()} // Encode sorts by key
+	vary := append([]string(nil), p.Vary...)
+	if !containsFold(vary, "Accept") {
+		// responses are negotiated, see system.WriteResponse
+		vary = append(vary, "Accept")
+	}
+	sort.Strings(vary)
+	for _, h := range vary {
+		parts = append(parts, strings.ToLower(h)+"="+req.HeaderParameter(h))
+	}
+	if pr := system.GetPrincipal(req); pr != nil && !p.Shared {
+		parts = append(parts, "principal="+pr.Method+":"+pr.ID)
+	}
+	return strings.Join(parts, "|")
+}
+
+// writePaths returns the paths whose responses a write to path changes: the
+// path itself and its parent collection.
+func writePaths(p string) []string {
+	paths := []string{p}
+	if parent := path.Dir(strings.TrimSuffix(p, "/")); parent != "/" && parent != "." && parent != p {
+		paths = append(paths, parent)
+	}
+	return paths
+}
+
+func (c *Cache) write(resp *restful.Response, cached *CachedResponse) {
+	h := resp.Header()
+	restoreHeader(h, cached.Header)
+	h.Set("X-Cache", "HIT")
+	h.Set("Age", strconv.Itoa(int(time.Since(cached.Stored).Seconds())))
+	resp.WriteHeader(cached.Status)
+	resp.Write(cached.Body)
+}
+
+// cacheControl parses a Cache-Control header into its directives.
+func cacheControl(header string) map[string]string {
+	cc := map[string]string{}
+	for _, d := range strings.Split(header, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "" {
+			continue
+		}
+		if i := strings.Index(d, "="); i > 0 {
+			cc[d[:i]] = strings.Trim(d[i+1:], `"`)
+		} else {
+			cc[d] = ""
+		}
+	}
+	return cc
+}
+
+// fresh reports whether a cached response can be served to a request.
+func fresh(cached *CachedResponse, cc map[string]string) bool {
+	now := time.Now()
+	if now.After(cached.Expires) {
+		return false
+	}
+	if v, ok := cc["max-age"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && now.Sub(cached.Stored) > time.Duration(n)*time.Second {
+			return false
+		}
+	}
+	return true
+}
+
+// storable reports whether the response directives allow shared caching.
+func storable(h http.Header) bool {
+	cc := cacheControl(h.Get("Cache-Control"))
+	_, noStore := cc["no-store"]
+	_, private := cc["private"]
+	return !noStore && !private && h.Get("Set-Cookie") == ""
+}
+
+// cloneHeader copies the headers of a response to store them, without the
+// headers set for each request, like those of CORS and the rate limiter.
+func cloneHeader(h http.Header) http.Header {
+	c := http.Header{}
+	for k, v := range h {
+		if perRequestHeader(k) {
+			continue
+		}
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// perRequestHeader reports whether a header describes the request rather
+// than the response it's part of.
+func perRequestHeader(k string) bool {
+	switch http.CanonicalHeaderKey(k) {
+	case "X-Cache", "Age", "Date", "Retry-After", "Set-Cookie", "Idempotent-Replayed":
+		return true
+	}
+	k = strings.ToLower(k)
+	return strings.HasPrefix(k, "access-control-") || strings.HasPrefix(k, "x-ratelimit-") ||
+		strings.HasPrefix(k, "ratelimit-")
+}
+
+// restoreHeader adds the stored headers of a response to h. Headers already
+// set by the filters run before are kept, Vary values are merged.
+func restoreHeader(h, stored http.Header) {
+	for k, v := range stored {
+		switch {
+		case k == "Vary":
+			for _, s := range v {
+				if !containsFold(h[k], s) {
+					h.Add(k, s)
+				}
+			}
+		case len(h[k]) == 0:
+			h[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+// MemoryCacheStore keeps responses in process memory, evicting the least
+// recently used ones beyond max entries.
+type MemoryCacheStore struct {
+	mu      sync.Mutex
+	max     int
+	lru     *list.List
+	entries map[string]map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	group, variant string
+	resp           *CachedResponse
+}
+
+func NewMemoryCacheStore(max int) *MemoryCacheStore {
+	return &MemoryCacheStore{
+		max:     max,
+		lru:     list.New(),
+		entries: map[string]map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryCacheStore) Get(group, variant string) (*CachedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[group][variant]
+	if !ok {
+		return nil, nil
+	}
+	entry := e.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.resp.Expires) {
+		s.remove(e)
+		return nil, nil
+	}
+	s.lru.MoveToFront(e)
+	return entry.resp, nil
+}
+
+func (s *MemoryCacheStore) Set(group, variant string, r *CachedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[group][variant]; ok {
+		e.Value.(*memoryCacheEntry).resp = r
+		s.lru.MoveToFront(e)
+		return nil
+	}
+
+	variants, ok := s.entries[group]
+	if !ok {
+		variants = map[string]*list.Element{}
+		s.entries[group] = variants
+	}
+	variants[variant] = s.lru.PushFront(&memoryCacheEntry{group, variant, r})
+
+	for s.max > 0 && s.lru.Len() > s.max {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) Purge(groups ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range groups {
+		for _, e := range s.entries[g] {
+			s.remove(e)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) PurgePrefix(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for g, variants := range s.entries {
+		if strings.HasPrefix(g, prefix) {
+			for _, e := range variants {
+				s.remove(e)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) remove(e *list.Element) {
+	entry := e.Value.(*memoryCacheEntry)
+	s.lru.Remove(e)
+	delete(s.entries[entry.group], entry.variant)
+	if len(s.entries[entry.group]) == 0 {
+		delete(s.entries, entry.group)
+	}
+}
+
+// RedisCacheStore keeps responses in redis so that they are shared between
+// instances. Each path is a hash of its variants.
+type RedisCacheStore struct {
+	pool *redis.Pool
+
+	// stores created by NewCache look the pool of the plugin up on use
+	app    *system.Application
+	plugin string
+}
+
+func NewRedisCacheStore(pool *redis.Pool) *RedisCacheStore {
+	return &RedisCacheStore{pool: pool}
+}
+
+func (s *RedisCacheStore) conn() (redis.Conn, error) {
+	if s.pool != nil {
+		return s.pool.Get(), nil
+	}
+	pool, err := redisPool(s.app, s.plugin)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Get(), nil
+}
+
+func (s *RedisCacheStore) Get(group, variant string) (*CachedResponse, error) {
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("HGET", group, variant))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := new(CachedResponse)
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	if time.Now().After(r.Expires) {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (s *RedisCacheStore) Set(group, variant string, r *CachedResponse) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the hash lives as long as its newest variant, older variants are
+	// checked against their own expiry
+	ttl := int64(r.Expires.Sub(r.Stored) / time.Millisecond)
+	conn.Send("MULTI")
+	conn.Send("HSET", group, variant, b)
+	conn.Send("PEXPIRE", group, ttl)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *RedisCacheStore) Purge(groups ...string) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, len(groups))
+	for i, g := range groups {
+		args[i] = g
+	}
+	_, err = conn.Do("DEL", args...)
+	return err
+}
+
+func (s *RedisCacheStore) PurgePrefix(prefix string) error {
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", globEscape(prefix)+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, k := range keys {
+				args[i] = k
+			}
+			if _, err := conn.Do("DEL", args...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// globEscape escapes the metacharacters of a redis glob pattern in s.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// redisPool looks the pool of a redis plugin up.
+func redisPool(a *system.Application, n string) (*redis.Pool, error) {
+	pool, ok := a.GetPlugin(n).(*redis.Pool)
+	if !ok {
+		return nil, fmt.Errorf("redis plugin %q isn't registered", n)
+	}
+	return pool, nil
+}
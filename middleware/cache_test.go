@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+// newCacheTestServer serves /notes and /notes/{id}, answering with the
+// caller.
+func newCacheTestServer(t *testing.T, p CachePolicy) *testServer {
+	s := newTestServer(t, "[cache]\nstore = \"memory\"\n")
+	handler := s.counted(func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte(req.HeaderParameter("X-Test-User")))
+	})
+
+	ws := new(restful.WebService).Path("/notes")
+	ws.Route(ws.GET("").Do(Cached(p)).To(handler))
+	ws.Route(ws.GET("/{id}").Do(Cached(p)).To(handler))
+	ws.Route(ws.PUT("/{id}").To(handler))
+	ws.Route(ws.POST("").To(handler))
+	return s.serve(ws, NewCache(s.Application).Filter)
+}
+
+func TestCachePrincipalIsolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		shared bool
+		users  []string
+		bodies []string
+		calls  int
+	}{
+		{"anonymous", false, []string{"", ""}, []string{"", ""}, 1},
+		{"same principal", false, []string{"alice", "alice"}, []string{"alice", "alice"}, 1},
+		{"other principal", false, []string{"alice", "bob"}, []string{"alice", "bob"}, 2},
+		{"principal after anonymous", false, []string{"", "alice"}, []string{"", "alice"}, 2},
+		{"shared", true, []string{"alice", "bob"}, []string{"alice", "alice"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCacheTestServer(t, CachePolicy{TTL: time.Minute, Shared: tt.shared})
+			for i, u := range tt.users {
+				w := do(h, "GET", "/notes/1", map[string]string{"X-Test-User": u})
+				if w.Code != http.StatusOK || w.Body.String() != tt.bodies[i] {
+					t.Errorf("request %d: got %d %q, want 200 %q", i, w.Code, w.Body.String(), tt.bodies[i])
+				}
+			}
+			if h.Calls() != tt.calls {
+				t.Errorf("handler called %d times, want %d", h.Calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestCacheAuthorizationWithoutPrincipal(t *testing.T) {
+	h := newCacheTestServer(t, CachePolicy{TTL: time.Minute})
+	for i := 0; i < 2; i++ {
+		do(h, "GET", "/notes/1", map[string]string{"Authorization": "Bearer x"})
+	}
+	if h.Calls() != 2 {
+		t.Errorf("handler called %d times, want 2", h.Calls())
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		stale  []string // paths served again by the handler
+		fresh  []string // paths still cached
+	}{
+		{"item update", "PUT", "/notes/1", []string{"/notes/1", "/notes"}, []string{"/notes/2"}},
+		{"collection create", "POST", "/notes", []string{"/notes"}, []string{"/notes/1", "/notes/2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCacheTestServer(t, CachePolicy{TTL: time.Minute})
+			for _, p := range []string{"/notes", "/notes/1", "/notes/2"} {
+				do(h, "GET", p, nil)
+			}
+			do(h, tt.method, tt.url, nil)
+
+			for _, p := range tt.stale {
+				if w := do(h, "GET", p, nil); w.Header().Get("X-Cache") != "MISS" {
+					t.Errorf("%s: X-Cache %q, want MISS", p, w.Header().Get("X-Cache"))
+				}
+			}
+			for _, p := range tt.fresh {
+				if w := do(h, "GET", p, nil); w.Header().Get("X-Cache") != "HIT" {
+					t.Errorf("%s: X-Cache %q, want HIT", p, w.Header().Get("X-Cache"))
+				}
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		cc     string
+		status int
+		xcache string
+	}{
+		{"cached", "", http.StatusOK, "HIT"},
+		{"no-cache", "no-cache", http.StatusOK, "MISS"},
+		{"no-store", "no-store", http.StatusOK, "BYPASS"},
+		{"max-age exceeded", "max-age=0", http.StatusOK, "MISS"},
+		{"only-if-cached hit", "only-if-cached", http.StatusOK, "HIT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCacheTestServer(t, CachePolicy{TTL: time.Minute})
+			do(h, "GET", "/notes/1", nil)
+			w := do(h, "GET", "/notes/1", map[string]string{"Cache-Control": tt.cc})
+			if w.Code != tt.status || w.Header().Get("X-Cache") != tt.xcache {
+				t.Errorf("got %d X-Cache %q, want %d %q", w.Code, w.Header().Get("X-Cache"), tt.status, tt.xcache)
+			}
+		})
+	}
+
+	h := newCacheTestServer(t, CachePolicy{TTL: time.Minute})
+	if w := do(h, "GET", "/notes/1", map[string]string{"Cache-Control": "only-if-cached"}); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached miss: got %d, want 504", w.Code)
+	}
+}
+
+func TestCachePanic(t *testing.T) {
+	s := newTestServer(t, "[cache]\nstore = \"memory\"\n")
+	ws := new(restful.WebService).Path("/notes")
+	ws.Route(ws.GET("/{id}").Do(Cached(CachePolicy{TTL: time.Minute})).To(panicky))
+	h := s.serve(ws, Recoverer, NewCache(s.Application).Filter)
+
+	for i := 0; i < 2; i++ {
+		checkRecovered(t, do(h, "GET", "/notes/1", nil))
+	}
+}
+
+func TestCachePerRequestHeaders(t *testing.T) {
+	s := newTestServer(t, "[cache]\nstore = \"memory\"\n"+corsConfig)
+	ws := new(restful.WebService).Path("/notes")
+	ws.Route(ws.GET("/{id}").Do(Cached(CachePolicy{TTL: time.Minute})).To(s.counted(func(req *restful.Request, resp *restful.Response) {
+		resp.Header().Set("X-Handler", "yes")
+		resp.Write([]byte("note"))
+	})))
+	h := s.serve(ws, newTestCORS(t, s.Application).Filter, NewCache(s.Application).Filter)
+
+	for _, origin := range []string{"https://example.com", "https://api.example.org", ""} {
+		w := do(h, "GET", "/notes/1", map[string]string{"Origin": origin})
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("origin %q: Access-Control-Allow-Origin %q", origin, got)
+		}
+		if w.Header().Get("X-Handler") != "yes" {
+			t.Errorf("origin %q: handler header lost", origin)
+		}
+	}
+	if h.Calls() != 1 {
+		t.Errorf("handler called %d times, want 1", h.Calls())
+	}
+}
+
+func TestPerRequestHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"X-Cache", true},
+		{"Access-Control-Allow-Origin", true},
+		{"X-RateLimit-Remaining", true},
+		{"RateLimit-Remaining", true},
+		{"Content-Type", false},
+		{"ETag", false},
+	}
+	for _, tt := range tests {
+		if got := perRequestHeader(tt.header); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGlobEscape(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"cache:/notes", "cache:/notes"},
+		{"cache:/notes?page=*", `cache:/notes\?page=\*`},
+		{`cache:/[a]\b`, `cache:/\[a\]\\b`},
+	}
+	for _, tt := range tests {
+		if got := globEscape(tt.s); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	"github.com/pelletier/go-toml"
+)
+
+// CORS implements Cross-Origin Resource Sharing for browser clients. It is
+// configured from the [cors] section:
+//
+//	[cors]
+//	allowed_origins = ["https://example.com", "https://*.example.org"]
+//	allowed_origins_regex = ["^https://[a-z]+\\.example\\.net$"]
+//	allowed_methods = ["GET", "POST", "PUT", "PATCH", "DELETE"]
+//	allowed_headers = ["Content-Type", "Authorization"]
+//	exposed_headers = ["X-Request-Id"]
+//	allow_credentials = false
+//	max_age = 600 # seconds
+//
+// Preflight requests are answered directly by the middleware, so routes
+// don't need to declare OPTIONS handlers. Credentials can't be allowed for
+// any origin, list the origins instead of "*".
+type CORS struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+
+	origins  []*regexp.Regexp
+	wildcard bool
+}
+
+// NewCORS creates a CORS middleware from the [cors] config section.
+func NewCORS(config *toml.TomlTree) (*CORS, error) {
+	c := &CORS{
+		AllowedOrigins:   stringList(config, "cors.allowed_origins", []string{"*"}),
+		AllowedMethods:   stringList(config, "cors.allowed_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"}),
+		AllowedHeaders:   stringList(config, "cors.allowed_headers", []string{"Content-Type", "Accept", "Authorization"}),
+		ExposedHeaders:   stringList(config, "cors.exposed_headers", []string{}),
+		AllowCredentials: config.GetDefault("cors.allow_credentials", false).(bool),
+		MaxAge:           int(config.GetDefault("cors.max_age", int64(0)).(int64)),
+	}
+
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			c.wildcard = true
+			continue
+		}
+		// translate wildcards into regular expressions
+		expr := "^" + strings.Replace(regexp.QuoteMeta(o), "\\*", "[^/]*", -1) + "$"
+		c.origins = append(c.origins, regexp.MustCompile(expr))
+	}
+	for _, expr := range stringList(config, "cors.allowed_origins_regex", []string{}) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("cors.allowed_origins_regex: %s", err)
+		}
+		c.origins = append(c.origins, re)
+	}
+
+	if c.wildcard && c.AllowCredentials {
+		// every site could read responses with the credentials of the user
+		return nil, fmt.Errorf("cors.allow_credentials can't be set when cors.allowed_origins has \"*\"")
+	}
+
+	return c, nil
+}
+
+// Filter is the go-restful filter. Install it on the container so that
+// preflight requests are answered for routes which don't exist as OPTIONS
+// routes.
+func (c *CORS) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if c.handle(resp, req.Request) {
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// StaticHandler returns a handler wrapper which applies CORS to requests
+// under prefix. It is meant for paths served outside go-restful web
+// services, such as the swagger UI files.
+func (c *CORS) StaticHandler(prefix string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, prefix) && c.handle(w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handle sets the CORS response headers and reports whether the request was
+// a preflight request which has been answered.
+func (c *CORS) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	if !c.allowedOrigin(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	if c.wildcard {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(c.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	// preflight
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !containsFold(c.AllowedMethods, method) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return true
+	}
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !containsFold(c.AllowedHeaders, h) {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+func (c *CORS) allowedOrigin(origin string) bool {
+	if c.wildcard {
+		return true
+	}
+	for _, re := range c.origins {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList reads an array of strings from the config.
+func stringList(config *toml.TomlTree, key string, def []string) []string {
+	v, ok := config.Get(key).([]interface{})
+	if !ok {
+		return def
+	}
+	list := make([]string, 0, len(v))
+	for _, s := range v {
+		list = append(list, s.(string))
+	}
+	return list
+}
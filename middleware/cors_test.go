@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+const corsConfig = `
+[cors]
+allowed_origins = ["https://example.com", "https://*.example.org"]
+allowed_origins_regex = ["^https://[a-z]+\\.example\\.net$"]
+allowed_methods = ["GET", "POST"]
+allowed_headers = ["Content-Type", "Authorization"]
+exposed_headers = ["X-Request-Id"]
+max_age = 600
+`
+
+func newTestCORS(t *testing.T, a *system.Application) *CORS {
+	c, err := NewCORS(a.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		method   string
+		header   map[string]string
+		status   int
+		response map[string]string // expected headers, "" for absent
+	}{
+		{"no origin", corsConfig, "GET", nil, 200,
+			map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""}},
+		{"allowed origin", corsConfig, "GET", map[string]string{"Origin": "https://example.com"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": "https://example.com", "Access-Control-Expose-Headers": "X-Request-Id", "Vary": "Origin"}},
+		{"wildcard origin", corsConfig, "GET", map[string]string{"Origin": "https://api.example.org"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": "https://api.example.org"}},
+		{"wildcard suffix", corsConfig, "GET", map[string]string{"Origin": "https://example.org.evil.com"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"regex origin", corsConfig, "GET", map[string]string{"Origin": "https://eu.example.net"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": "https://eu.example.net"}},
+		{"denied origin", corsConfig, "GET", map[string]string{"Origin": "https://evil.com"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"}},
+		{"preflight", corsConfig, "OPTIONS", map[string]string{
+			"Origin": "https://example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type, authorization",
+		}, 204, map[string]string{
+			"Access-Control-Allow-Origin": "https://example.com", "Access-Control-Allow-Methods": "GET, POST",
+			"Access-Control-Allow-Headers": "Content-Type, Authorization", "Access-Control-Max-Age": "600",
+		}},
+		{"preflight denied origin", corsConfig, "OPTIONS", map[string]string{
+			"Origin": "https://evil.com", "Access-Control-Request-Method": "POST",
+		}, 403, map[string]string{"Access-Control-Allow-Origin": ""}},
+		{"preflight denied method", corsConfig, "OPTIONS", map[string]string{
+			"Origin": "https://example.com", "Access-Control-Request-Method": "DELETE",
+		}, 405, map[string]string{"Access-Control-Allow-Methods": ""}},
+		{"preflight denied header", corsConfig, "OPTIONS", map[string]string{
+			"Origin": "https://example.com", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Custom",
+		}, 403, map[string]string{"Access-Control-Allow-Headers": ""}},
+		{"any origin", "", "GET", map[string]string{"Origin": "https://any.com"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": ""}},
+		{"listed origin with credentials", "[cors]\nallowed_origins = [\"https://example.com\"]\nallow_credentials = true\n", "GET", map[string]string{"Origin": "https://example.com"}, 200,
+			map[string]string{"Access-Control-Allow-Origin": "https://example.com", "Access-Control-Allow-Credentials": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, tt.config)
+			called := false
+			ws := new(restful.WebService).Path("/items")
+			ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+				called = true
+			}))
+			a.Container.Add(ws)
+			a.Container.Filter(newTestCORS(t, a).Filter)
+
+			w := do(a.Container, tt.method, "/items", tt.header)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if called != (tt.method != "OPTIONS") {
+				t.Errorf("handler called %v for %s", called, tt.method)
+			}
+			for k, v := range tt.response {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("%s %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSStaticHandler(t *testing.T) {
+	a := newTestApp(t, corsConfig)
+	files := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("file"))
+	})
+	h := newTestCORS(t, a).StaticHandler("/apidocs/")(files)
+
+	tests := []struct {
+		path   string
+		method string
+		status int
+		origin string
+	}{
+		{"/apidocs/index.html", "GET", 200, "https://example.com"},
+		{"/apidocs/index.html", "OPTIONS", 204, "https://example.com"},
+		{"/other", "GET", 200, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Origin", "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		w := serve(h, r)
+		if w.Code != tt.status || w.Header().Get("Access-Control-Allow-Origin") != tt.origin {
+			t.Errorf("%s %s: %d %q, want %d %q", tt.method, tt.path, w.Code, w.Header().Get("Access-Control-Allow-Origin"), tt.status, tt.origin)
+		}
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"defaults", "[cors]\n", true},
+		{"listed origins with credentials", "[cors]\nallowed_origins = [\"https://example.com\"]\nallow_credentials = true\n", true},
+		{"any origin with credentials", "[cors]\nallow_credentials = true\n", false},
+		{"listed and any origin with credentials", "[cors]\nallowed_origins = [\"https://example.com\", \"*\"]\nallow_credentials = true\n", false},
+		{"invalid regex", "[cors]\nallowed_origins_regex = [\"(\"]\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCORS(newTestApp(t, tt.config).Config)
+			if (err == nil) != tt.valid {
+				t.Errorf("error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+// Route metadata keys of conditional requests.
+const (
+	ConditionalKey = "conditional" // the route evaluates its preconditions
+	ValidatorKey   = "validator"   // ValidatorFunc of the route
+)
+
+// Conditional marks a route as evaluating its preconditions itself, which
+// the ETags middleware then leaves alone. Writes should check them in the
+// transaction changing the resource, like resource.Resource does.
+func Conditional(rb *restful.RouteBuilder) {
+	rb.Metadata(ConditionalKey, true)
+}
+
+// ValidatorFunc returns the current ETag and modification time of the
+// resource a request writes, an empty ETag when it doesn't exist.
+type ValidatorFunc func(req *restful.Request) (etag string, modified time.Time, err error)
+
+// Validated lets the ETags middleware evaluate the preconditions of a write
+// route against the validators returned by fn:
+//
+//	ws.Route(ws.PUT("/{id}").Do(middleware.Validated(ct.NoteValidators)).To(ct.PutNote))
+func Validated(fn ValidatorFunc) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rb.Metadata(ValidatorKey, fn)
+	}
+}
+
+// ETags is a middleware which adds entity tags to responses and enforces
+// conditional requests. It is configured from the [etag] section:
+//
+//	[etag]
+//	weak = false             # generate weak instead of strong tags
+//	require_if_match = false # reject PUT, PATCH and DELETE without If-Match
+//
+// Successful GET responses are buffered and tagged with a hash of their
+// body unless the handler set an ETag, then If-None-Match and
+// If-Modified-Since are answered with a 304. PUT, PATCH and DELETE
+// requests carrying preconditions are checked against the validators of
+// Validated routes and get a 412 on mismatch, or on routes which can't
+// evaluate preconditions. If-Match uses strong comparison, so weak tags
+// never satisfy it.
+type ETags struct {
+	Weak           bool
+	RequireIfMatch bool
+
+	app *system.Application
+}
+
+// NewETags creates the conditional request middleware.
+func NewETags(a *system.Application) *ETags {
+	return &ETags{
+		Weak:           a.Config.GetDefault("etag.weak", false).(bool),
+		RequireIfMatch: a.Config.GetDefault("etag.require_if_match", false).(bool),
+		app:            a,
+	}
+}
+
+// Filter tags responses and evaluates preconditions.
+func (e *ETags) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	r := e.app.SelectedRoute(req)
+	if r != nil && r.Metadata[ConditionalKey] == true {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	switch req.Request.Method {
+	case "GET", "HEAD":
+		e.tag(req, resp, chain)
+	case "PUT", "PATCH", "DELETE":
+		var validator ValidatorFunc
+		if r != nil {
+			validator, _ = r.Metadata[ValidatorKey].(ValidatorFunc)
+		}
+		if e.check(req, resp, validator) {
+			chain.ProcessFilter(req, resp)
+		}
+	default:
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+// tag buffers the response to compute its entity tag.
+func (e *ETags) tag(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	w := resp.ResponseWriter
+	buf := &bufferedWriter{header: w.Header()}
+	resp.ResponseWriter = buf
+	func() {
+		// a panic leaves the buffer for the recoverer to write to w
+		defer func() { resp.ResponseWriter = w }()
+		chain.ProcessFilter(req, resp)
+	}()
+
+	if buf.status == 0 {
+		buf.status = http.StatusOK
+	}
+	if buf.status == http.StatusOK {
+		etag := w.Header().Get("ETag")
+		if etag == "" && req.Request.Method == "GET" {
+			etag = system.HashETag(buf.body.Bytes(), e.Weak)
+		}
+		modified, _ := http.ParseTime(w.Header().Get("Last-Modified"))
+		if !system.CheckConditions(req, resp, etag, modified) {
+			return
+		}
+	}
+
+	w.WriteHeader(buf.status)
+	w.Write(buf.body.Bytes())
+}
+
+// check evaluates the preconditions of a write against the validators of
+// the route. It returns false after writing an error.
+func (e *ETags) check(req *restful.Request, resp *restful.Response, validator ValidatorFunc) bool {
+	h := req.Request.Header
+	if h.Get("If-Match") == "" && h.Get("If-None-Match") == "" && h.Get("If-Unmodified-Since") == "" {
+		if e.RequireIfMatch {
+			system.WriteRequestError(system.NewTypedError(
+				"precondition_required",
+				req.Request.Method+" "+req.Request.URL.Path+": missing If-Match",
+				"This request must be conditional, send the ETag of the resource in If-Match.",
+			), req, resp)
+			return false
+		}
+		return true
+	}
+
+	if validator == nil {
+		// the conditions can't be known to hold
+		system.WriteRequestError(system.NewTypedError(
+			"precondition_failed",
+			req.Request.Method+" "+req.Request.URL.Path+": route has no validators",
+			"Preconditions aren't supported by this resource.",
+		), req, resp)
+		return false
+	}
+	etag, modified, err := validator(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return false
+	}
+	if system.EvaluateConditions(req, etag, modified) != 0 {
+		system.WriteRequestError(system.PreconditionError(req), req, resp)
+		return false
+	}
+	return true
+}
+
+// bufferedWriter holds the status and body of a response.
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+// newETagTestServer serves a note whose current ETag is "v1". Only its GET
+// handler is counted.
+func newETagTestServer(t *testing.T, config string) *testServer {
+	s := newTestServer(t, config)
+	ok := func(req *restful.Request, resp *restful.Response) {}
+	validator := func(req *restful.Request) (string, time.Time, error) {
+		if req.PathParameter("id") != "1" {
+			return "", time.Time{}, system.NewTypedError("not_found", "no note", nil)
+		}
+		return `"v1"`, time.Time{}, nil
+	}
+
+	ws := new(restful.WebService).Path("/notes")
+	ws.Route(ws.GET("/{id}").To(s.counted(func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte("note " + req.PathParameter("id")))
+	})))
+	ws.Route(ws.GET("/{id}/tagged").To(func(req *restful.Request, resp *restful.Response) {
+		resp.Header().Set("ETag", `"v1"`)
+		resp.Write([]byte("note"))
+	}))
+	ws.Route(ws.PUT("/{id}").Do(Validated(validator)).To(ok))
+	ws.Route(ws.DELETE("/{id}").To(ok))
+	ws.Route(ws.PATCH("/{id}").Do(Conditional).To(ok))
+	return s.serve(ws, NewETags(s.Application).Filter)
+}
+
+func TestETagsRead(t *testing.T) {
+	plain := newETagTestServer(t, "")
+	tag := do(plain, "GET", "/notes/1", nil).Header().Get("ETag")
+	if tag == "" || tag[0] != '"' {
+		t.Fatalf("ETag %q, want a strong tag", tag)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		path   string
+		header map[string]string
+		status int
+		etag   string
+	}{
+		{"tagged", "", "/notes/1", nil, 200, tag},
+		{"not modified", "", "/notes/1", map[string]string{"If-None-Match": tag}, 304, tag},
+		{"modified", "", "/notes/1", map[string]string{"If-None-Match": `"other"`}, 200, tag},
+		{"weak", "[etag]\nweak = true\n", "/notes/1", nil, 200, "W/" + tag},
+		{"weak not modified", "[etag]\nweak = true\n", "/notes/1", map[string]string{"If-None-Match": tag}, 304, "W/" + tag},
+		{"handler tag", "", "/notes/1/tagged", nil, 200, `"v1"`},
+		{"handler tag not modified", "", "/notes/1/tagged", map[string]string{"If-None-Match": `"v1"`}, 304, `"v1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newETagTestServer(t, tt.config)
+			w := do(h, "GET", tt.path, tt.header)
+			if w.Code != tt.status || w.Header().Get("ETag") != tt.etag {
+				t.Errorf("got %d ETag %q, want %d %q", w.Code, w.Header().Get("ETag"), tt.status, tt.etag)
+			}
+		})
+	}
+}
+
+func TestETagsWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		method string
+		path   string
+		header map[string]string
+		status int
+	}{
+		{"unconditional", "", "PUT", "/notes/1", nil, 200},
+		{"if-match", "", "PUT", "/notes/1", map[string]string{"If-Match": `"v1"`}, 200},
+		{"if-match any", "", "PUT", "/notes/1", map[string]string{"If-Match": "*"}, 200},
+		{"if-match stale", "", "PUT", "/notes/1", map[string]string{"If-Match": `"v0"`}, 412},
+		{"if-match weak", "", "PUT", "/notes/1", map[string]string{"If-Match": `W/"v1"`}, 412},
+		{"if-none-match any", "", "PUT", "/notes/1", map[string]string{"If-None-Match": "*"}, 412},
+		{"validator error", "", "PUT", "/notes/2", map[string]string{"If-Match": `"v1"`}, 404},
+		{"no validator", "", "DELETE", "/notes/1", map[string]string{"If-Match": `"v1"`}, 412},
+		{"no validator unconditional", "", "DELETE", "/notes/1", nil, 200},
+		{"conditional route", "", "PATCH", "/notes/1", map[string]string{"If-Match": `"v0"`}, 200},
+		{"if-match required", "[etag]\nrequire_if_match = true\n", "PUT", "/notes/1", nil, 428},
+		{"if-match required and sent", "[etag]\nrequire_if_match = true\n", "PUT", "/notes/1", map[string]string{"If-Match": `"v1"`}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newETagTestServer(t, tt.config)
+			w := do(h, tt.method, tt.path, tt.header)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if h.Calls() != 0 {
+				t.Errorf("GET handler called %d times by a %s", h.Calls(), tt.method)
+			}
+		})
+	}
+}
+
+func TestETagsPanic(t *testing.T) {
+	s := newTestServer(t, "")
+	ws := new(restful.WebService).Path("/notes")
+	ws.Route(ws.GET("/{id}").To(panicky))
+	h := s.serve(ws, Recoverer, NewETags(s.Application).Filter)
+
+	checkRecovered(t, do(h, "GET", "/notes/1", nil))
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newStreamsTestApp(t *testing.T) http.Handler {
+	a := newTestApp(t, "")
+	ws := new(restful.WebService).Path("/")
+	ws.Route(ws.GET("id").To(func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte(GetReqID(req)))
+	}))
+	ws.Route(ws.GET("panic").To(func(req *restful.Request, resp *restful.Response) {
+		panic("boom")
+	}))
+	ws.Route(ws.GET("abort").To(func(req *restful.Request, resp *restful.Response) {
+		panic(http.ErrAbortHandler)
+	}))
+	a.Container.Add(ws)
+	a.Container.Filter(RequestID)
+	a.Container.Filter(Recoverer)
+	return a.Container
+}
+
+// TestStreams runs the filters on concurrent streams of one HTTP/2
+// connection, over TLS and over h2c.
+func TestStreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		start func(h http.Handler) (*httptest.Server, *http.Client)
+	}{
+		{"tls", func(h http.Handler) (*httptest.Server, *http.Client) {
+			srv := httptest.NewUnstartedServer(h)
+			srv.EnableHTTP2 = true
+			srv.StartTLS()
+			return srv, srv.Client()
+		}},
+		{"h2c", func(h http.Handler) (*httptest.Server, *http.Client) {
+			srv := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+			return srv, &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, client := tt.start(newStreamsTestApp(t))
+			defer srv.Close()
+
+			get := func(path string) (int, string, error) {
+				resp, err := client.Get(srv.URL + path)
+				if err != nil {
+					return 0, "", err
+				}
+				defer resp.Body.Close()
+				if resp.ProtoMajor != 2 {
+					t.Errorf("served over %s, want HTTP/2", resp.Proto)
+				}
+				b, err := ioutil.ReadAll(resp.Body)
+				return resp.StatusCode, string(b), err
+			}
+
+			const n = 50
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			ids := map[string]bool{}
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					path := "/id"
+					switch i % 5 {
+					case 1:
+						path = "/panic"
+					case 2:
+						path = "/abort"
+					}
+					status, body, err := get(path)
+					switch path {
+					case "/id":
+						mu.Lock()
+						defer mu.Unlock()
+						if err != nil || status != 200 || body == "" || ids[body] {
+							t.Errorf("/id: %d %q %v, want a new request ID", status, body, err)
+						}
+						ids[body] = true
+					case "/panic":
+						if err != nil || status != 500 {
+							t.Errorf("/panic: %d %v, want a 500", status, err)
+						}
+					case "/abort":
+						if err == nil {
+							t.Errorf("/abort: %d, want the stream reset", status)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			// the connection survives the panics and aborted streams
+			if status, _, err := get("/id"); err != nil || status != 200 {
+				t.Errorf("after the panics: %d %v", status, err)
+			}
+		})
+	}
+}
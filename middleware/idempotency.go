@@ -0,0 +1,463 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/garyburd/redigo/redis"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+)
+
+// IdempotencyRecord is the state of an idempotency key: in flight until
+// the first response is stored.
+type IdempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// IdempotencyStore keeps idempotency records.
+type IdempotencyStore interface {
+	// Begin reserves key for a request. It returns the existing record
+	// when the key is already in use, nil when it was reserved.
+	Begin(key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error)
+	// Complete stores the response of the request holding key.
+	Complete(key string, rec *IdempotencyRecord, ttl time.Duration) error
+	// Release drops the reservation of a request which failed.
+	Release(key string) error
+}
+
+// Idempotency is a middleware which makes retries of POST and PATCH
+// requests carrying an Idempotency-Key header safe. It is configured from
+// the [idempotency] section:
+//
+//	[idempotency]
+//	header = "Idempotency-Key"
+//	methods = ["POST", "PATCH"]
+//	required = false # reject requests without a key
+//	ttl = 86400 # seconds
+//	store = "memory" # memory, redis or sql
+//	redis_plugin = "redis"
+//	orm_plugin = "orm"
+//	table = "idempotency_key"
+//	max_body_bytes = 10485760 # bodies are buffered to fingerprint requests
+//
+// The first response of a key is stored and replayed for retries from the
+// same client, with an Idempotent-Replayed header. Retries while the first
+// request is in flight get a 409, retries with a different method, path or
+// body a 422. Server errors aren't stored so that they can be retried.
+// Bodies larger than max_body_bytes get a 413.
+type Idempotency struct {
+	Header       string
+	Methods      []string
+	Required     bool
+	TTL          time.Duration
+	MaxBodyBytes int64
+	Store        IdempotencyStore
+	Prefix       string
+}
+
+// NewIdempotency creates the idempotency middleware. The redis and sql
+// stores look their plugin up when they're used, so plugins may be
+// registered after the middleware is created.
+func NewIdempotency(a *system.Application) *Idempotency {
+	id := &Idempotency{
+		Header:       a.Config.GetDefault("idempotency.header", "Idempotency-Key").(string),
+		Methods:      stringList(a.Config, "idempotency.methods", []string{"POST", "PATCH"}),
+		Required:     a.Config.GetDefault("idempotency.required", false).(bool),
+		TTL:          time.Duration(a.Config.GetDefault("idempotency.ttl", int64(86400)).(int64)) * time.Second,
+		MaxBodyBytes: a.Config.GetDefault("idempotency.max_body_bytes", int64(10<<20)).(int64),
+		Prefix:       "idempotency:",
+	}
+	if id.MaxBodyBytes < 1 {
+		log.Fatalf("Idempotency: max_body_bytes must be positive\n")
+	}
+
+	switch s := a.Config.GetDefault("idempotency.store", "memory").(string); s {
+	case "memory":
+		id.Store = NewMemoryIdempotencyStore()
+	case "redis":
+		id.Store = &RedisIdempotencyStore{
+			app:    a,
+			plugin: a.Config.GetDefault("idempotency.redis_plugin", "redis").(string),
+		}
+	case "sql":
+		id.Store = &SQLIdempotencyStore{
+			table:  a.Config.GetDefault("idempotency.table", "idempotency_key").(string),
+			app:    a,
+			plugin: a.Config.GetDefault("idempotency.orm_plugin", "orm").(string),
+		}
+	default:
+		log.Fatalf("Idempotency: unknown store %q\n", s)
+	}
+
+	return id
+}
+
+// Filter replays the stored responses of idempotency keys.
+func (id *Idempotency) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if !containsFold(id.Methods, req.Request.Method) {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	value := req.HeaderParameter(id.Header)
+	if value == "" {
+		if id.Required {
+			system.WriteRequestError(system.NewTypedError(
+				"bad_request",
+				fmt.Sprintf("idempotency: missing %s header", id.Header),
+				fmt.Sprintf("The %s header is required.", id.Header),
+			), req, resp)
+			return
+		}
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	if len(value) > 255 {
+		system.WriteRequestError(system.NewTypedError(
+			"bad_request",
+			"idempotency: key too long",
+			fmt.Sprintf("The %s header must be at most 255 characters long.", id.Header),
+		), req, resp)
+		return
+	}
+
+	if err := system.LimitBody(req.Request, id.MaxBodyBytes); err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	req.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// keys are scoped to the client
+	sum := sha256.Sum256([]byte(KeyByUser(req) + "\x00" + value))
+	key := id.Prefix + hex.EncodeToString(sum[:])
+	fp := sha256.New()
+	fmt.Fprintf(fp, "%s %s\x00", req.Request.Method, req.Request.URL.RequestURI())
+	fp.Write(body)
+	fingerprint := hex.EncodeToString(fp.Sum(nil))
+
+	rec, err := id.Store.Begin(key, fingerprint, id.TTL)
+	if err != nil {
+		// don't reject traffic because the store is unavailable
+		log.Errorf("Idempotency store error: %s", err)
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	if rec != nil {
+		id.replay(req, resp, rec, fingerprint)
+		return
+	}
+
+	completed := false
+	defer func() {
+		// release the key of requests which panicked
+		if !completed {
+			if err := id.Store.Release(key); err != nil {
+				log.Errorf("Idempotency store error: %s", err)
+			}
+		}
+	}()
+
+	w := resp.ResponseWriter
+	buf := &bufferedWriter{header: w.Header()}
+	resp.ResponseWriter = buf
+	func() {
+		// a panic leaves the buffer for the recoverer to write to w, and
+		// the key is released after
+		defer func() { resp.ResponseWriter = w }()
+		chain.ProcessFilter(req, resp)
+	}()
+
+	if buf.status == 0 {
+		buf.status = http.StatusOK
+	}
+	if buf.status < 500 {
+		rec := &IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      buf.status,
+			Header:      cloneHeader(w.Header()),
+			Body:        buf.body.Bytes(),
+		}
+		if err := id.Store.Complete(key, rec, id.TTL); err != nil {
+			log.Errorf("Idempotency store error: %s", err)
+		}
+		completed = true
+	}
+
+	w.WriteHeader(buf.status)
+	w.Write(buf.body.Bytes())
+}
+
+func (id *Idempotency) replay(req *restful.Request, resp *restful.Response, rec *IdempotencyRecord, fingerprint string) {
+	switch {
+	case rec.Fingerprint != fingerprint:
+		system.WriteRequestError(system.NewTypedError(
+			"idempotency_key_reused",
+			"idempotency: key reused with a different request",
+			fmt.Sprintf("This %s was used for a different request.", id.Header),
+		), req, resp)
+	case !rec.Done:
+		resp.Header().Set("Retry-After", "1")
+		system.WriteRequestError(system.NewTypedError(
+			"conflict",
+			"idempotency: request in flight",
+			"A request with this key is being processed, retry later.",
+		), req, resp)
+	default:
+		h := resp.Header()
+		restoreHeader(h, rec.Header)
+		h.Set("Idempotent-Replayed", "true")
+		resp.WriteHeader(rec.Status)
+		resp.Write(rec.Body)
+	}
+}
+
+// MemoryIdempotencyStore keeps idempotency records in process memory. It
+// is only suitable for single instance deployments.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]*memoryIdempotencyRecord
+	calls   int
+}
+
+type memoryIdempotencyRecord struct {
+	rec     IdempotencyRecord
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: map[string]*memoryIdempotencyRecord{}}
+}
+
+func (s *MemoryIdempotencyStore) Begin(key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	if r, ok := s.records[key]; ok && now.Before(r.expires) {
+		rec := r.rec
+		return &rec, nil
+	}
+	s.records[key] = &memoryIdempotencyRecord{IdempotencyRecord{Fingerprint: fingerprint}, now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = &memoryIdempotencyRecord{*rec, time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// sweep drops expired records every so often to bound memory usage.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	s.calls++
+	if s.calls < 1000 {
+		return
+	}
+	s.calls = 0
+	for k, r := range s.records {
+		if now.After(r.expires) {
+			delete(s.records, k)
+		}
+	}
+}
+
+// RedisIdempotencyStore keeps idempotency records in redis so that they
+// are shared between instances.
+type RedisIdempotencyStore struct {
+	pool *redis.Pool
+
+	// stores created by NewIdempotency look the pool of the plugin up on use
+	app    *system.Application
+	plugin string
+}
+
+func NewRedisIdempotencyStore(pool *redis.Pool) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{pool: pool}
+}
+
+func (s *RedisIdempotencyStore) conn() (redis.Conn, error) {
+	if s.pool != nil {
+		return s.pool.Get(), nil
+	}
+	pool, err := redisPool(s.app, s.plugin)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Get(), nil
+}
+
+func (s *RedisIdempotencyStore) Begin(key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	b, err := json.Marshal(IdempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ok, err := redis.String(conn.Do("SET", key, b, "PX", int64(ttl/time.Millisecond), "NX"))
+	if err == nil && ok == "OK" {
+		return nil, nil
+	}
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	existing, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		// expired in between, the retry will reserve it
+		return &IdempotencyRecord{Fingerprint: fingerprint}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := new(IdempotencyRecord)
+	if err := json.Unmarshal(existing, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *RedisIdempotencyStore) Complete(key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("SET", key, b, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (s *RedisIdempotencyStore) Release(key string) error {
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEL", key)
+	return err
+}
+
+// SQLIdempotencyStore keeps idempotency records in a table of the orm
+// plugin database, see create-idempotency-key-table in queries-sample.sql.
+type SQLIdempotencyStore struct {
+	db    *gorm.DB
+	table string
+
+	// stores created by NewIdempotency look the database of the plugin up
+	// on use
+	app    *system.Application
+	plugin string
+}
+
+func NewSQLIdempotencyStore(db *gorm.DB, table string) *SQLIdempotencyStore {
+	return &SQLIdempotencyStore{db: db, table: table}
+}
+
+func (s *SQLIdempotencyStore) orm() (*gorm.DB, error) {
+	if s.db != nil {
+		return s.db, nil
+	}
+	db, ok := s.app.GetPlugin(s.plugin).(*gorm.DB)
+	if !ok {
+		return nil, fmt.Errorf("orm plugin %q isn't registered", s.plugin)
+	}
+	return db, nil
+}
+
+func (s *SQLIdempotencyStore) Begin(key, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	db, err := s.orm()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if err := db.Exec("DELETE FROM "+s.table+" WHERE id = ? AND expires < ?", key, now).Error; err != nil {
+		return nil, err
+	}
+
+	// the primary key makes concurrent reservations fail
+	err = db.Exec(
+		"INSERT INTO "+s.table+" (id, fingerprint, done, status, header, body, expires) VALUES (?, ?, 0, 0, '', '', ?)",
+		key, fingerprint, now+int64(ttl/time.Second),
+	).Error
+	if err == nil {
+		return nil, nil
+	}
+
+	rec := new(IdempotencyRecord)
+	var header, body []byte
+	row := db.Raw("SELECT fingerprint, done, status, header, body FROM "+s.table+" WHERE id = ?", key).Row()
+	if e := row.Scan(&rec.Fingerprint, &rec.Done, &rec.Status, &header, &body); e == sql.ErrNoRows {
+		return nil, err
+	} else if e != nil {
+		return nil, e
+	}
+	if rec.Done {
+		rec.Body = body
+		if err := json.Unmarshal(header, &rec.Header); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func (s *SQLIdempotencyStore) Complete(key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	db, err := s.orm()
+	if err != nil {
+		return err
+	}
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+	return db.Exec(
+		"UPDATE "+s.table+" SET done = 1, status = ?, header = ?, body = ?, expires = ? WHERE id = ?",
+		rec.Status, header, rec.Body, time.Now().Add(ttl).Unix(), key,
+	).Error
+}
+
+func (s *SQLIdempotencyStore) Release(key string) error {
+	db, err := s.orm()
+	if err != nil {
+		return err
+	}
+	return db.Exec("DELETE FROM "+s.table+" WHERE id = ?", key).Error
+}
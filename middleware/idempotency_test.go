@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+// newIdempotencyTestServer serves POST /orders, answering with the status
+// given in the body. Handlers wait for hold when it is set.
+func newIdempotencyTestServer(t *testing.T, config string, hold func()) *testServer {
+	s := newTestServer(t, "[errors]\nformat = \"problem\"\n"+config)
+	ws := new(restful.WebService).Path("/orders")
+	ws.Route(ws.POST("").To(s.counted(func(req *restful.Request, resp *restful.Response) {
+		if hold != nil {
+			hold()
+		}
+		var body struct{ Status int }
+		req.ReadEntity(&body)
+		if body.Status == 0 {
+			body.Status = http.StatusCreated
+		}
+		resp.WriteHeader(body.Status)
+		resp.Write([]byte("created"))
+	})))
+	return s.serve(ws, NewIdempotency(s.Application).Filter)
+}
+
+func post(h http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func problemType(t *testing.T, w *httptest.ResponseRecorder) string {
+	var p struct{ Type string }
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("invalid problem body %q: %s", w.Body.String(), err)
+	}
+	return p.Type
+}
+
+func TestIdempotency(t *testing.T) {
+	type request struct {
+		key, body string
+		status    int
+		replayed  bool
+		problem   string
+	}
+	tests := []struct {
+		name     string
+		config   string
+		requests []request
+		calls    int
+	}{
+		{"replay", "", []request{
+			{"k1", `{}`, 201, false, ""},
+			{"k1", `{}`, 201, true, ""},
+		}, 1},
+		{"other keys", "", []request{
+			{"k1", `{}`, 201, false, ""},
+			{"k2", `{}`, 201, false, ""},
+		}, 2},
+		{"key reused", "", []request{
+			{"k1", `{}`, 201, false, ""},
+			{"k1", `{"Status":201}`, 422, false, "about:blank#idempotency_key_reused"},
+		}, 1},
+		{"no key", "", []request{
+			{"", `{}`, 201, false, ""},
+			{"", `{}`, 201, false, ""},
+		}, 2},
+		{"required", "[idempotency]\nrequired = true\n", []request{
+			{"", `{}`, 400, false, "about:blank#bad_request"},
+		}, 0},
+		{"server errors retried", "", []request{
+			{"k1", `{"Status":503}`, 503, false, ""},
+			{"k1", `{"Status":503}`, 503, false, ""},
+		}, 2},
+		{"client errors replayed", "", []request{
+			{"k1", `{"Status":400}`, 400, false, ""},
+			{"k1", `{"Status":400}`, 400, true, ""},
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newIdempotencyTestServer(t, tt.config, nil)
+			for i, r := range tt.requests {
+				w := post(h, r.key, r.body)
+				if w.Code != r.status {
+					t.Errorf("request %d: status %d, want %d", i, w.Code, r.status)
+				}
+				if got := w.Header().Get("Idempotent-Replayed") == "true"; got != r.replayed {
+					t.Errorf("request %d: replayed %v, want %v", i, got, r.replayed)
+				}
+				if r.problem != "" {
+					if typ := problemType(t, w); typ != r.problem {
+						t.Errorf("request %d: problem type %q, want %q", i, typ, r.problem)
+					}
+				}
+			}
+			if h.Calls() != tt.calls {
+				t.Errorf("handler called %d times, want %d", h.Calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	entered, block := make(chan struct{}), make(chan struct{})
+	h := newIdempotencyTestServer(t, "", func() {
+		entered <- struct{}{}
+		<-block
+	})
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- post(h, "k1", `{}`) }()
+	<-entered
+
+	w := post(h, "k1", `{}`)
+	close(block)
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" {
+		t.Errorf("retry in flight: status %d Retry-After %q, want 409 and a delay", w.Code, w.Header().Get("Retry-After"))
+	}
+	if f := <-first; f.Code != http.StatusCreated {
+		t.Errorf("first request: status %d, want 201", f.Code)
+	}
+	if h.Calls() != 1 {
+		t.Errorf("handler called %d times, want 1", h.Calls())
+	}
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	s := newTestServer(t, "")
+	ws := new(restful.WebService).Path("/orders")
+	ws.Route(ws.POST("").To(s.counted(panicky)))
+	h := s.serve(ws, Recoverer, NewIdempotency(s.Application).Filter)
+
+	for i := 0; i < 2; i++ {
+		checkRecovered(t, post(h, "k1", `{}`))
+	}
+	if h.Calls() != 2 {
+		t.Errorf("handler called %d times, want the key released after the panic", h.Calls())
+	}
+}
+
+func TestIdempotencyBodyLimit(t *testing.T) {
+	h := newIdempotencyTestServer(t, "[idempotency]\nmax_body_bytes = 16\n", nil)
+	large := `{"status": 201, "padding": "0123456789"}`
+	for _, length := range []int64{int64(len(large)), -1} { // announced and streamed
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(large))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Idempotency-Key", "k1")
+		r.ContentLength = length
+		w := serve(h, r)
+		if w.Code != http.StatusRequestEntityTooLarge || problemType(t, w) != "about:blank#payload_too_large" {
+			t.Errorf("Content-Length %d: status %d %s, want 413", length, w.Code, w.Body.String())
+		}
+	}
+	if w := post(h, "k2", `{}`); w.Code != http.StatusCreated {
+		t.Errorf("small body: status %d, want 201", w.Code)
+	}
+	if h.Calls() != 1 {
+		t.Errorf("handler called %d times, want 1", h.Calls())
+	}
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+// newTestApp initializes an application from a configuration.
+func newTestApp(t *testing.T, config string) *system.Application {
+	dir, err := ioutil.TempDir("", "restapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(f, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(system.Application)
+	a.Init(f)
+	return a
+}
+
+// testServer is a test application counting the calls of its handlers.
+type testServer struct {
+	*system.Application
+	mu    sync.Mutex
+	calls int
+}
+
+// newTestServer initializes an application from a configuration. Requests
+// are authenticated by principalFilter.
+func newTestServer(t *testing.T, config string) *testServer {
+	s := &testServer{Application: newTestApp(t, config)}
+	s.Container.Filter(principalFilter)
+	return s
+}
+
+// serve adds ws and installs filters after principalFilter.
+func (s *testServer) serve(ws *restful.WebService, filters ...restful.FilterFunction) *testServer {
+	s.Container.Add(ws)
+	for _, f := range filters {
+		s.Container.Filter(f)
+	}
+	return s
+}
+
+// counted wraps h to count its calls.
+func (s *testServer) counted(h restful.RouteFunction) restful.RouteFunction {
+	return func(req *restful.Request, resp *restful.Response) {
+		s.mu.Lock()
+		s.calls++
+		s.mu.Unlock()
+		h(req, resp)
+	}
+}
+
+// Calls returns the number of calls of the counted handlers.
+func (s *testServer) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Container.ServeHTTP(w, r)
+}
+
+// principalFilter authenticates requests with the X-Test-User header.
+func principalFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if id := req.HeaderParameter("X-Test-User"); id != "" {
+		system.SetPrincipal(req, &system.Principal{ID: id, Method: "test"})
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// do serves a request and returns the recorded response.
+func do(h http.Handler, method, url string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	return serve(h, r)
+}
+
+func newRequest(method, url, body string) *http.Request {
+	return httptest.NewRequest(method, url, strings.NewReader(body))
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// panicky is a handler which writes part of a response and panics.
+func panicky(req *restful.Request, resp *restful.Response) {
+	resp.Write([]byte("partial"))
+	panic("handler failed")
+}
+
+// checkRecovered fails unless w holds the 500 of the recoverer.
+func checkRecovered(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "partial") {
+		t.Errorf("got %d %q, want the 500 of the recoverer", w.Code, w.Body.String())
+	}
+}
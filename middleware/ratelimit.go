@@ -0,0 +1,397 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/garyburd/redigo/redis"
+	"github.com/johnwilson/restapi/system"
+)
+
+// Rate limiting algorithms.
+const (
+	TokenBucket   = "token_bucket"
+	SlidingWindow = "sliding_window"
+)
+
+// UserKey is the request attribute holding the authenticated user name.
+// The Auth middleware sets it along with the principal.
+const UserKey = "user"
+
+// RateLimit describes how many requests are allowed per window.
+type RateLimit struct {
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+}
+
+// RateLimitResult is the outcome of a rate limit check.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration // time until the limit is fully restored
+}
+
+// RateLimitStore keeps the rate limit state for each key.
+type RateLimitStore interface {
+	Allow(key string, rl RateLimit) (RateLimitResult, error)
+}
+
+// RateLimitKeyFunc extracts the key requests are counted against. An empty
+// key skips rate limiting.
+type RateLimitKeyFunc func(req *restful.Request) string
+
+// KeyByIP counts requests per client IP address.
+func KeyByIP(req *restful.Request) string {
+	host, _, err := net.SplitHostPort(req.Request.RemoteAddr)
+	if err != nil {
+		return req.Request.RemoteAddr
+	}
+	return host
+}
+
+// KeyByAPIKey counts requests per API key sent in header.
+func KeyByAPIKey(header string) RateLimitKeyFunc {
+	return func(req *restful.Request) string {
+		return req.HeaderParameter(header)
+	}
+}
+
+// KeyByUser counts requests per authenticated user, falling back to the
+// client IP for anonymous requests. Without a principal, a user name set in
+// the UserKey attribute is used.
+func KeyByUser(req *restful.Request) string {
+	if p := system.GetPrincipal(req); p != nil {
+		return "user:" + p.Method + ":" + p.ID
+	}
+	if u, ok := req.Attribute(UserKey).(string); ok && u != "" {
+		return "user:" + u
+	}
+	return KeyByIP(req)
+}
+
+// KeyByRoute counts requests per route and client IP.
+func KeyByRoute(req *restful.Request) string {
+	return req.Request.Method + " " + req.SelectedRoutePath() + " " + KeyByIP(req)
+}
+
+// RateLimiter is a middleware which rejects requests exceeding a limit with
+// a 429 (Too Many Requests) error.
+type RateLimiter struct {
+	Limit  RateLimit
+	Store  RateLimitStore
+	Key    RateLimitKeyFunc
+	Prefix string
+}
+
+// NewRateLimiter creates a rate limiter from the [ratelimit] config section:
+//
+//	[ratelimit]
+//	algorithm = "token_bucket" # or "sliding_window"
+//	limit = 60
+//	window = 60 # seconds
+//	key = "ip" # ip, api_key, user or route
+//	api_key_header = "X-Api-Key"
+//	store = "memory" # or "redis"
+//	redis_plugin = "redis"
+//
+// The redis store looks the pool of the redis plugin up when it's used, so
+// plugins may be registered after the rate limiter is created.
+func NewRateLimiter(a *system.Application) *RateLimiter {
+	rl := &RateLimiter{
+		Limit: RateLimit{
+			Algorithm: a.Config.GetDefault("ratelimit.algorithm", TokenBucket).(string),
+			Limit:     int(a.Config.GetDefault("ratelimit.limit", int64(60)).(int64)),
+			Window:    time.Duration(a.Config.GetDefault("ratelimit.window", int64(60)).(int64)) * time.Second,
+		},
+		Prefix: "ratelimit:",
+	}
+
+	switch rl.Limit.Algorithm {
+	case TokenBucket, SlidingWindow:
+	default:
+		log.Fatalf("Rate limiter: unknown algorithm %q\n", rl.Limit.Algorithm)
+	}
+	if rl.Limit.Limit < 1 {
+		log.Fatalf("Rate limiter: limit must be at least 1, not %d\n", rl.Limit.Limit)
+	}
+	if rl.Limit.Window < time.Second {
+		log.Fatalf("Rate limiter: window must be at least 1 second, not %s\n", rl.Limit.Window)
+	}
+
+	switch k := a.Config.GetDefault("ratelimit.key", "ip").(string); k {
+	case "ip":
+		rl.Key = KeyByIP
+	case "api_key":
+		rl.Key = KeyByAPIKey(a.Config.GetDefault("ratelimit.api_key_header", "X-Api-Key").(string))
+	case "user":
+		rl.Key = KeyByUser
+	case "route":
+		rl.Key = KeyByRoute
+	default:
+		log.Fatalf("Rate limiter: unknown key %q\n", k)
+	}
+
+	switch s := a.Config.GetDefault("ratelimit.store", "memory").(string); s {
+	case "memory":
+		rl.Store = NewMemoryRateLimitStore()
+	case "redis":
+		rl.Store = &RedisRateLimitStore{app: a, plugin: a.Config.GetDefault("ratelimit.redis_plugin", "redis").(string)}
+	default:
+		log.Fatalf("Rate limiter: unknown store %q\n", s)
+	}
+
+	return rl
+}
+
+// Filter enforces the rate limit.
+func (rl *RateLimiter) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	key := rl.Key(req)
+	if key == "" {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	res, err := rl.Store.Allow(rl.Prefix+key, rl.Limit)
+	if err != nil {
+		// don't reject traffic because the store is unavailable
+		log.Errorf("Rate limiter store error: %s", err)
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	reset := int(math.Ceil(res.Reset.Seconds()))
+	h := resp.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(res.Reset).Unix(), 10))
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(reset))
+
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(reset))
+		e := system.NewTypedError(
+			"rate_limited",
+			fmt.Sprintf("rate limit exceeded for %q", key),
+			"Too many requests. Please retry later.",
+		)
+		system.WriteRequestError(e, req, resp)
+		return
+	}
+
+	chain.ProcessFilter(req, resp)
+}
+
+// MemoryRateLimitStore keeps rate limit state in process memory. It is only
+// suitable for single instance deployments.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64   // token bucket: available tokens
+	prev   int       // sliding window: count of previous window
+	curr   int       // sliding window: count of current window
+	start  time.Time // sliding window: start of current window
+	last   time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := new(MemoryRateLimitStore)
+	s.buckets = map[string]*bucket{}
+	return s
+}
+
+func (s *MemoryRateLimitStore) Allow(key string, rl RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now, rl.Window)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rl.Limit), start: now.Truncate(rl.Window), last: now}
+		s.buckets[key] = b
+	}
+
+	switch rl.Algorithm {
+	case SlidingWindow:
+		return b.slidingWindow(now, rl), nil
+	case TokenBucket:
+		return b.tokenBucket(now, rl), nil
+	}
+	return RateLimitResult{}, fmt.Errorf("unknown rate limit algorithm %q", rl.Algorithm)
+}
+
+// sweep drops idle buckets every so often to bound memory usage.
+func (s *MemoryRateLimitStore) sweep(now time.Time, window time.Duration) {
+	s.calls++
+	if s.calls < 1000 {
+		return
+	}
+	s.calls = 0
+	for k, b := range s.buckets {
+		if now.Sub(b.last) > 2*window {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+func (b *bucket) tokenBucket(now time.Time, rl RateLimit) RateLimitResult {
+	rate := float64(rl.Limit) / rl.Window.Seconds() // tokens per second
+	b.tokens = math.Min(float64(rl.Limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	res := RateLimitResult{Limit: rl.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(rl.Limit) - b.tokens) / rate * float64(time.Second))
+	return res
+}
+
+func (b *bucket) slidingWindow(now time.Time, rl RateLimit) RateLimitResult {
+	start := now.Truncate(rl.Window)
+	if !start.Equal(b.start) {
+		if start.Sub(b.start) == rl.Window {
+			b.prev = b.curr
+		} else {
+			b.prev = 0
+		}
+		b.curr = 0
+		b.start = start
+	}
+	b.last = now
+
+	// weight the previous window by how much of it still overlaps
+	overlap := 1 - float64(now.Sub(start))/float64(rl.Window)
+	count := int(float64(b.prev)*overlap) + b.curr
+
+	res := RateLimitResult{Limit: rl.Limit, Reset: start.Add(rl.Window).Sub(now)}
+	if count < rl.Limit {
+		b.curr++
+		count++
+		res.Allowed = true
+	}
+	res.Remaining = rl.Limit - count
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	return res
+}
+
+// RedisRateLimitStore keeps rate limit state in redis so that limits are
+// shared between instances.
+type RedisRateLimitStore struct {
+	pool *redis.Pool
+
+	// stores created by NewRateLimiter look the pool of the plugin up on use
+	app    *system.Application
+	plugin string
+}
+
+func NewRedisRateLimitStore(pool *redis.Pool) *RedisRateLimitStore {
+	return &RedisRateLimitStore{pool: pool}
+}
+
+func (s *RedisRateLimitStore) conn() (redis.Conn, error) {
+	if s.pool != nil {
+		return s.pool.Get(), nil
+	}
+	pool, err := redisPool(s.app, s.plugin)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Get(), nil
+}
+
+// KEYS[1] bucket, ARGV: limit, window (ms), now (ms)
+var tokenBucketScript = redis.NewScript(1, `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local rate = limit / window
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or limit
+local ts = tonumber(state[2]) or now
+tokens = math.min(limit, tokens + (now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], window)
+return {allowed, math.floor(tokens), math.ceil((limit - tokens) / rate)}
+`)
+
+// KEYS[1] request log, ARGV: limit, window (ms), now (ms), member
+var slidingWindowScript = redis.NewScript(1, `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], 0, now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", KEYS[1], window)
+local reset = window
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+var redisSeq uint64
+
+func (s *RedisRateLimitStore) Allow(key string, rl RateLimit) (RateLimitResult, error) {
+	conn, err := s.conn()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	window := int64(rl.Window / time.Millisecond)
+
+	var reply []int
+	switch rl.Algorithm {
+	case TokenBucket:
+		reply, err = redis.Ints(tokenBucketScript.Do(conn, key, rl.Limit, window, now))
+	case SlidingWindow:
+		member := fmt.Sprintf("%d-%s-%d", now, prefix, atomic.AddUint64(&redisSeq, 1))
+		reply, err = redis.Ints(slidingWindowScript.Do(conn, key, rl.Limit, window, now, member))
+	default:
+		return RateLimitResult{}, fmt.Errorf("unknown rate limit algorithm %q", rl.Algorithm)
+	}
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	res := RateLimitResult{
+		Allowed:   reply[0] == 1,
+		Limit:     rl.Limit,
+		Remaining: reply[1],
+		Reset:     time.Duration(reply[2]) * time.Millisecond,
+	}
+	return res, nil
+}
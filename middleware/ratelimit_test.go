@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		allowed   []bool
+		remaining []int
+	}{
+		{TokenBucket, []bool{true, true, true, false}, []int{2, 1, 0, 0}},
+		{SlidingWindow, []bool{true, true, true, false}, []int{2, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			s := NewMemoryRateLimitStore()
+			rl := RateLimit{Algorithm: tt.algorithm, Limit: 3, Window: time.Hour}
+			for i := range tt.allowed {
+				res, err := s.Allow("k", rl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Allowed != tt.allowed[i] || res.Remaining != tt.remaining[i] || res.Limit != 3 {
+					t.Errorf("request %d: %+v, want allowed %v remaining %d", i+1, res, tt.allowed[i], tt.remaining[i])
+				}
+				if res.Reset <= 0 || res.Reset > time.Hour {
+					t.Errorf("request %d: reset in %s", i+1, res.Reset)
+				}
+			}
+
+			// keys are counted separately
+			if res, _ := s.Allow("other", rl); !res.Allowed {
+				t.Error("other key limited")
+			}
+		})
+	}
+
+	if _, err := NewMemoryRateLimitStore().Allow("k", RateLimit{Algorithm: "fixed", Limit: 1, Window: time.Second}); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	rl := RateLimit{Algorithm: TokenBucket, Limit: 2, Window: 2 * time.Second}
+	now := time.Now()
+	b := &bucket{tokens: 2, last: now}
+	b.tokenBucket(now, rl)
+	b.tokenBucket(now, rl)
+	if res := b.tokenBucket(now, rl); res.Allowed {
+		t.Fatal("allowed past the limit")
+	}
+	// one token per second
+	if res := b.tokenBucket(now.Add(time.Second), rl); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("got %+v a second later, want one request allowed", res)
+	}
+}
+
+func TestSlidingWindowWeight(t *testing.T) {
+	rl := RateLimit{Algorithm: SlidingWindow, Limit: 4, Window: time.Minute}
+	start := time.Now().Truncate(time.Minute)
+	b := &bucket{start: start}
+	for i := 0; i < 4; i++ {
+		b.slidingWindow(start, rl)
+	}
+	// the previous window counts for the share of it still overlapping
+	tests := []struct {
+		at      time.Duration
+		allowed bool
+	}{
+		{75 * time.Second, true},  // int(4*0.75) + 0 < 4
+		{76 * time.Second, true},  // int(4*0.73) + 1 < 4
+		{77 * time.Second, false}, // int(4*0.72) + 2 = 4
+	}
+	for _, tt := range tests {
+		if res := b.slidingWindow(start.Add(tt.at), rl); res.Allowed != tt.allowed {
+			t.Errorf("at %s: %+v, want allowed %v", tt.at, res, tt.allowed)
+		}
+	}
+	// a window later the old requests are gone
+	if res := b.slidingWindow(start.Add(3*time.Minute), rl); !res.Allowed || res.Remaining != 3 {
+		t.Errorf("got %+v, want a fresh window", res)
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		key  RateLimitKeyFunc
+		set  func(req *restful.Request)
+		want string
+	}{
+		{"ip", KeyByIP, nil, "192.0.2.1"},
+		{"api key", KeyByAPIKey("X-Api-Key"), func(req *restful.Request) { req.Request.Header.Set("X-Api-Key", "k1") }, "k1"},
+		{"no api key", KeyByAPIKey("X-Api-Key"), nil, ""},
+		{"principal", KeyByUser, func(req *restful.Request) {
+			system.SetPrincipal(req, &system.Principal{ID: "alice", Method: "jwt"})
+		}, "user:jwt:alice"},
+		{"user attribute", KeyByUser, func(req *restful.Request) { req.SetAttribute(UserKey, "bob") }, "user:bob"},
+		{"anonymous", KeyByUser, nil, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := restful.NewRequest(newRequest("GET", "/items", ""))
+			if tt.set != nil {
+				tt.set(req)
+			}
+			if got := tt.key(req); got != tt.want {
+				t.Errorf("key %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Allow(key string, rl RateLimit) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("store down")
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    RateLimitStore
+		key      RateLimitKeyFunc
+		statuses []int
+	}{
+		{"limited", NewMemoryRateLimitStore(), KeyByIP, []int{200, 200, 429}},
+		{"no key", NewMemoryRateLimitStore(), KeyByAPIKey("X-Api-Key"), []int{200, 200, 200}},
+		{"store error", failingStore{}, KeyByIP, []int{200, 200, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, "[errors]\nformat = \"problem\"\n")
+			rl := &RateLimiter{
+				Limit:  RateLimit{Algorithm: TokenBucket, Limit: 2, Window: time.Minute},
+				Store:  tt.store,
+				Key:    tt.key,
+				Prefix: "ratelimit:",
+			}
+			ws := new(restful.WebService).Path("/items")
+			ws.Route(ws.GET("").Filter(rl.Filter).To(func(req *restful.Request, resp *restful.Response) {}))
+			a.Container.Add(ws)
+
+			for i, status := range tt.statuses {
+				w := do(a.Container, "GET", "/items", nil)
+				if w.Code != status {
+					t.Fatalf("request %d: status %d, want %d", i+1, w.Code, status)
+				}
+				limited := w.Header().Get("X-RateLimit-Limit") != ""
+				if limited != (tt.name == "limited") {
+					t.Errorf("request %d: rate limit headers %v", i+1, w.Header())
+				}
+				if status != 429 {
+					continue
+				}
+				if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+					t.Errorf("RateLimit-Remaining %q, want 0", got)
+				}
+				if s, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || s < 1 || s > 60 {
+					t.Errorf("Retry-After %q", w.Header().Get("Retry-After"))
+				}
+				if typ := problemType(t, w); typ != "about:blank#rate_limited" {
+					t.Errorf("error type %q, want rate_limited", typ)
+				}
+			}
+		})
+	}
+}
+
+// TestNewRateLimiter creates rate limiters in a child process, as invalid
+// configurations end it.
+func TestNewRateLimiter(t *testing.T) {
+	if config := os.Getenv("RESTAPI_TEST_RATELIMIT_CONFIG"); config != "" {
+		NewRateLimiter(newTestApp(t, config))
+		return
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		fatal  string
+	}{
+		{"token bucket", "[ratelimit]\nalgorithm = \"token_bucket\"\n", ""},
+		{"sliding window", "[ratelimit]\nalgorithm = \"sliding_window\"\n", ""},
+		{"unknown algorithm", "[ratelimit]\nalgorithm = \"fixed_window\"\n", `unknown algorithm \"fixed_window\"`},
+		{"unknown key", "[ratelimit]\nkey = \"cookie\"\n", `unknown key \"cookie\"`},
+		{"unknown store", "[ratelimit]\nstore = \"disk\"\n", `unknown store \"disk\"`},
+		{"zero limit", "[ratelimit]\nlimit = 0\n", "limit must be at least 1"},
+		{"zero window", "[ratelimit]\nwindow = 0\n", "window must be at least 1 second"},
+		{"negative window", "[ratelimit]\nwindow = -5\n", "window must be at least 1 second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestNewRateLimiter$")
+			cmd.Env = append(os.Environ(), "RESTAPI_TEST_RATELIMIT_CONFIG="+tt.config)
+			out, err := cmd.CombinedOutput()
+			if tt.fatal == "" {
+				if err != nil {
+					t.Errorf("failed: %v\n%s", err, out)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(string(out), tt.fatal) {
+				t.Errorf("got %v, want a fatal %s:\n%s", err, tt.fatal, out)
+			}
+		})
+	}
+}
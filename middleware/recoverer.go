@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"net/http"
 	"runtime/debug"
 
 	"github.com/emicklei/go-restful"
@@ -20,10 +21,14 @@ func Recoverer(req *restful.Request, resp *restful.Response, chain *restful.Filt
 
 	defer func() {
 		if err := recover(); err != nil {
+			if err == http.ErrAbortHandler {
+				// deliberate abort, net/http resets the stream
+				panic(err)
+			}
 			printPanic(reqID, err)
 			debug.PrintStack()
 			e := fmt.Errorf("Application encountered and error. Contact admin.")
-			system.WriteError(e, resp)
+			system.WriteRequestError(e, req, resp)
 		}
 	}()
 
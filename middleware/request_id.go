@@ -9,10 +9,11 @@ import (
 	"sync/atomic"
 
 	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
 )
 
 // Key to use when setting the request ID.
-const RequestIDKey = "reqID"
+const RequestIDKey = system.RequestIDKey
 
 var prefix string
 var reqid uint64
@@ -56,10 +57,14 @@ func init() {
 // where "random" is a base62 random string that uniquely identifies this go
 // process, and where the last number is an atomically incremented request
 // counter.
+//
+// It also starts the trace span of the request, continuing the trace of the
+// caller's traceparent header if there is one, see system.TraceFrom.
 func RequestID(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	myid := atomic.AddUint64(&reqid, 1)
 	val := fmt.Sprintf("%s-%06d", prefix, myid)
-	req.SetAttribute(RequestIDKey, val)
+	system.SetRequestID(req, val)
+	system.SetTrace(req, system.NewTrace(system.ParseTraceparent(req.HeaderParameter("traceparent"))))
 	chain.ProcessFilter(req, resp)
 }
 
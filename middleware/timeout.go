@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+// Timeout returns a route filter which cancels the request context after d.
+// Handlers should pass req.Request.Context() to backends so that they give
+// up too. When the deadline passes first a 504 error is written, a 503 when
+// the client went away; whatever the handler writes afterwards is dropped:
+//
+//	ws.Route(ws.GET("/report").Filter(middleware.Timeout(5 * time.Second)).To(ct.Report))
+//
+// The filter returns once the handler does, so that the filters before it
+// never share the request with a handler still running.
+func Timeout(d time.Duration) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		ctx, cancel := context.WithTimeout(req.Request.Context(), d)
+		defer cancel()
+
+		// what the timeout error needs, read before the handler starts
+		w := resp.ResponseWriter
+		ereq := restful.NewRequest(req.Request)
+		if id, ok := req.Attribute(system.RequestIDKey).(string); ok {
+			ereq.SetAttribute(system.RequestIDKey, id)
+		}
+		method, path := req.Request.Method, req.Request.URL.Path
+
+		// go-restful passes its own request and response to the handler,
+		// so they are switched to a copy of the request and a buffer
+		req.Request = req.Request.Clone(ctx)
+		tw := &timeoutWriter{header: http.Header{}}
+		resp.ResponseWriter = tw
+
+		done := make(chan interface{}, 1) // panic value, nil on return
+		go func() {
+			defer func() {
+				done <- recover()
+			}()
+			chain.ProcessFilter(req, resp)
+		}()
+
+		select {
+		case p := <-done:
+			resp.ResponseWriter = w
+			if p != nil {
+				panic(p) // for the recoverer
+			}
+			for k, v := range tw.header {
+				resp.Header()[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			resp.WriteHeader(tw.status)
+			resp.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			tw.timedOut = true
+			tw.mu.Unlock()
+
+			var err error
+			if ctx.Err() == context.DeadlineExceeded {
+				err = system.NewTypedError(
+					"timeout",
+					fmt.Sprintf("%s %s: timed out after %s", method, path, d),
+					"The request took too long to process.",
+				)
+			} else {
+				err = system.NewTypedError(
+					"service_unavailable",
+					fmt.Sprintf("%s %s: request canceled", method, path),
+					nil,
+				)
+			}
+
+			// send the whole error now, the handler may take a while
+			buf := &bufferedWriter{header: w.Header()}
+			system.WriteRequestError(err, ereq, restful.NewResponse(buf))
+			w.Header().Set("Content-Length", strconv.Itoa(buf.body.Len()))
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+
+			if p := <-done; p != nil {
+				log.Errorf("Panic after timeout of %s %s: %v", method, path, p)
+			}
+			// record the status sent for the filters before
+			resp.WriteHeader(buf.status)
+			resp.ResponseWriter = w
+		}
+	}
+}
+
+// timeoutWriter buffers a response until the handler finishes in time.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.status == 0 {
+		tw.status = status
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(p)
+}
+
+// MaxBodySize returns a route filter which rejects request bodies larger
+// than n bytes with a 413 error:
+//
+//	ws.Route(ws.POST("/upload").Filter(middleware.MaxBodySize(10 << 20)).To(ct.Upload))
+func MaxBodySize(n int64) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		if err := system.LimitBody(req.Request, n); err != nil {
+			system.WriteRequestError(err, req, resp)
+			return
+		}
+		chain.ProcessFilter(req, resp)
+	}
+}
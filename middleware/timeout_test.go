@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/johnwilson/restapi/system"
+)
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		sleep  time.Duration
+		status int
+		body   string
+	}{
+		{"in time", 0, 201, "done"},
+		{"timed out", 200 * time.Millisecond, 504, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, "[errors]\nformat = \"problem\"\n")
+			finished := make(chan struct{})
+			ws := new(restful.WebService).Path("/report")
+			ws.Route(ws.GET("").Filter(Timeout(50 * time.Millisecond)).To(func(req *restful.Request, resp *restful.Response) {
+				defer close(finished)
+				select {
+				case <-time.After(tt.sleep):
+				case <-req.Request.Context().Done():
+					// keep using the request and response after the timeout
+					time.Sleep(20 * time.Millisecond)
+				}
+				req.SetAttribute(system.RequestIDKey, "changed")
+				req.Request.Header.Set("Accept", "application/xml")
+				resp.Header().Set("X-Handler", "yes")
+				resp.WriteHeader(201)
+				resp.Write([]byte("done"))
+			}))
+			a.Container.Add(ws)
+			a.Container.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+				system.SetRequestID(req, "req-1")
+				chain.ProcessFilter(req, resp)
+			})
+
+			w := do(a.Container, "GET", "/report", nil)
+			<-finished
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" {
+				if w.Body.String() != tt.body || w.Header().Get("X-Handler") != "yes" {
+					t.Errorf("body %q X-Handler %q, want the handler response", w.Body.String(), w.Header().Get("X-Handler"))
+				}
+				return
+			}
+
+			var p struct {
+				Type      string `json:"type"`
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatalf("invalid problem %q: %s", w.Body.String(), err)
+			}
+			if !strings.HasSuffix(p.Type, "#timeout") || p.RequestID != "req-1" || w.Header().Get("X-Handler") != "" {
+				t.Errorf("got %+v X-Handler %q, want the timeout of req-1 only", p, w.Header().Get("X-Handler"))
+			}
+		})
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	a := newTestApp(t, "")
+	ws := new(restful.WebService).Path("/boom")
+	ws.Route(ws.GET("").Filter(Timeout(time.Second)).To(func(req *restful.Request, resp *restful.Response) {
+		panic("boom")
+	}))
+	a.Container.Add(ws)
+
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recovered %v, want the handler panic", p)
+		}
+	}()
+	do(a.Container, "GET", "/boom", nil)
+	t.Error("panic not propagated")
+}
+
+func TestMaxBodySize(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"within", "12345", 200},
+		{"exact", "1234567890", 200},
+		{"larger", "12345678901", 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, "")
+			ws := new(restful.WebService).Path("/upload")
+			ws.Route(ws.POST("").Filter(MaxBodySize(10)).To(func(req *restful.Request, resp *restful.Response) {
+				resp.Write([]byte("ok"))
+			}))
+			a.Container.Add(ws)
+
+			r := newRequest("POST", "/upload", tt.body)
+			w := serve(a.Container, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
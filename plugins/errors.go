@@ -0,0 +1,72 @@
+package plugins
+
+import (
+	r "github.com/dancannon/gorethink"
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/mgo.v2"
+)
+
+// Map errors returned by the bundled backends to HTTP statuses.
+func init() {
+	system.RegisterErrorMapper(mapSQLError)
+	system.RegisterErrorMapper(mapMongoError)
+	system.RegisterErrorMapper(mapRedisError)
+	system.RegisterErrorMapper(mapRethinkError)
+}
+
+func typed(code, sm string) (system.ApiError, bool) {
+	return system.NewTypedError(code, sm, nil).(system.ApiError), true
+}
+
+func mapSQLError(err error) (system.ApiError, bool) {
+	if err == gorm.RecordNotFound {
+		return typed("not_found", "gorm: record not found")
+	}
+
+	// unique constraint violations
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		if e.Number == 1062 {
+			return typed("conflict", "mysql: duplicate entry")
+		}
+	case *pq.Error:
+		if e.Code == "23505" {
+			return typed("conflict", "postgres: unique violation")
+		}
+	case sqlite3.Error:
+		// NOT NULL, CHECK and FOREIGN KEY failures aren't conflicts
+		if e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return typed("conflict", "sqlite: unique constraint violation")
+		}
+	}
+	return system.ApiError{}, false
+}
+
+func mapMongoError(err error) (system.ApiError, bool) {
+	if err == mgo.ErrNotFound {
+		return typed("not_found", "mongodb: not found")
+	}
+	if mgo.IsDup(err) {
+		return typed("conflict", "mongodb: duplicate key")
+	}
+	return system.ApiError{}, false
+}
+
+func mapRedisError(err error) (system.ApiError, bool) {
+	if err == redis.ErrPoolExhausted {
+		return typed("service_unavailable", "redis: connection pool exhausted")
+	}
+	return system.ApiError{}, false
+}
+
+func mapRethinkError(err error) (system.ApiError, bool) {
+	if err == r.ErrEmptyResult {
+		return typed("not_found", "rethinkdb: empty result")
+	}
+	return system.ApiError{}, false
+}
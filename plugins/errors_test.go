@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	"github.com/lib/pq"
+	"gopkg.in/mgo.v2"
+)
+
+// sqliteError returns the error of a statement run against a table with
+// unique, NOT NULL, CHECK and foreign key constraints.
+func sqliteError(t *testing.T, stmt string) error {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orm := &db
+	defer orm.Close()
+	orm.DB().SetMaxOpenConns(1)
+	for _, q := range []string{
+		"PRAGMA foreign_keys = ON",
+		"CREATE TABLE owner (id INTEGER PRIMARY KEY)",
+		"CREATE TABLE note (id INTEGER PRIMARY KEY, title TEXT NOT NULL UNIQUE, stars INT CHECK (stars >= 0), owner INT REFERENCES owner(id))",
+		"INSERT INTO note (id, title) VALUES (1, 'a')",
+	} {
+		if err := orm.Exec(q).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return orm.Exec(stmt).Error
+}
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   string
+		status int
+	}{
+		{"gorm not found", gorm.RecordNotFound, "not_found", 404},
+		{"mysql duplicate", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, "conflict", 409},
+		{"mysql other", &mysql.MySQLError{Number: 1048, Message: "Column cannot be null"}, "internal_error", 500},
+		{"postgres unique", &pq.Error{Code: "23505"}, "conflict", 409},
+		{"postgres not null", &pq.Error{Code: "23502"}, "internal_error", 500},
+		{"sqlite unique", sqliteError(t, "INSERT INTO note (title) VALUES ('a')"), "conflict", 409},
+		{"sqlite primary key", sqliteError(t, "INSERT INTO note (id, title) VALUES (1, 'b')"), "conflict", 409},
+		{"sqlite not null", sqliteError(t, "INSERT INTO note (id) VALUES (2)"), "internal_error", 500},
+		{"sqlite check", sqliteError(t, "INSERT INTO note (title, stars) VALUES ('b', -1)"), "internal_error", 500},
+		{"sqlite foreign key", sqliteError(t, "INSERT INTO note (title, owner) VALUES ('b', 9)"), "internal_error", 500},
+		{"mongodb not found", mgo.ErrNotFound, "not_found", 404},
+		{"mongodb duplicate", &mgo.LastError{Code: 11000, Err: "duplicate key"}, "conflict", 409},
+		{"redis pool exhausted", redis.ErrPoolExhausted, "service_unavailable", 503},
+		{"rethinkdb empty result", r.ErrEmptyResult, "not_found", 404},
+		{"wrapped", fmt.Errorf("loading note: %w", mgo.ErrNotFound), "not_found", 404},
+		{"unknown", errors.New("boom"), "internal_error", 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ae := system.MapError(tt.err)
+			if ae.ErrorCode != tt.code || ae.Code != tt.status {
+				t.Errorf("mapped %v to %s %d, want %s %d", tt.err, ae.ErrorCode, ae.Code, tt.code, tt.status)
+			}
+			if ae.Cause != tt.err {
+				t.Errorf("cause %v, want %v", ae.Cause, tt.err)
+			}
+		})
+	}
+}
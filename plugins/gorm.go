@@ -1,6 +1,8 @@
 package plugins
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -50,3 +52,36 @@ func (g *Gorm) Close() error {
 	}
 	return nil
 }
+
+// SQLQuery runs a query on the connection pool of db with ctx, so that it
+// is canceled along with the request. Gorm itself takes no context, use
+// these helpers for queries which may run long:
+//
+//	rows, err := plugins.SQLQuery(ct.Context(req), ct.DB, qm.Get("report"), from, to)
+func SQLQuery(ctx context.Context, db *gorm.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB().QueryContext(ctx, query, args...)
+}
+
+// SQLQueryRow runs a query returning a single row with ctx.
+func SQLQueryRow(ctx context.Context, db *gorm.DB, query string, args ...interface{}) *sql.Row {
+	return db.DB().QueryRowContext(ctx, query, args...)
+}
+
+// SQLExec runs a statement with ctx.
+func SQLExec(ctx context.Context, db *gorm.DB, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB().ExecContext(ctx, query, args...)
+}
+
+// SQLTx runs fn in a transaction bound to ctx: it is committed when fn
+// succeeds, rolled back when fn fails or ctx is done first.
+func SQLTx(ctx context.Context, db *gorm.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("gorm: transaction start failed:\n%s", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
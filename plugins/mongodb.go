@@ -1,7 +1,9 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/johnwilson/restapi/system"
 	"gopkg.in/mgo.v2"
@@ -33,3 +35,22 @@ func (mp *MongoDB) Close() error {
 	mp.session.Close()
 	return nil
 }
+
+// MongoSession returns a copy of s for the work of ctx, its socket timeout
+// set to the time left before the deadline of ctx so that operations give
+// up with the request. Call release once done with it:
+//
+//	s, release := plugins.MongoSession(ct.Context(req), session)
+//	defer release()
+func MongoSession(ctx context.Context, s *mgo.Session) (*mgo.Session, func()) {
+	c := s.Copy()
+	if d, ok := ctx.Deadline(); ok {
+		left := time.Until(d)
+		if left <= 0 {
+			// the smallest timeout, a zero one disables it
+			left = time.Nanosecond
+		}
+		c.SetSocketTimeout(left)
+	}
+	return c, c.Close
+}
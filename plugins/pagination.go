@@ -0,0 +1,176 @@
+package plugins
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var sqlOps = map[string]string{
+	"eq": "=", "ne": "<>", "lt": "<", "lte": "<=",
+	"gt": ">", "gte": ">=", "like": "LIKE", "in": "IN",
+}
+
+// GormFilter applies the filters of a list query. Field names come from the
+// ListOptions allow-lists and values are always bound as parameters.
+func GormFilter(db *gorm.DB, q *system.ListQuery) *gorm.DB {
+	for _, f := range q.Filters {
+		switch f.Op {
+		case "in":
+			db = db.Where(fmt.Sprintf("%s IN (?)", f.Field), f.Values())
+		case "like":
+			db = db.Where(fmt.Sprintf("%s LIKE ? ESCAPE '\\'", f.Field), f.LikePattern())
+		default:
+			db = db.Where(fmt.Sprintf("%s %s ?", f.Field, sqlOps[f.Op]), f.Value)
+		}
+	}
+	return db
+}
+
+// GormList applies the filters, sort order and page of a list query.
+// Cursors holding null values fail the query with a 400 error:
+//
+//	q, err := ct.ParseList(req, opts)
+//	...
+//	var total int64
+//	plugins.GormFilter(db.Model(&User{}), q).Count(&total)
+//	var users []User
+//	plugins.GormList(db, q).Find(&users)
+//	system.WritePage(req, resp, q, q.NewPage(users, total))
+func GormList(db *gorm.DB, q *system.ListQuery) *gorm.DB {
+	db = GormFilter(db, q)
+
+	if q.Cursor != nil {
+		// NULLs sort first or last depending on the database, and never
+		// compare, so there's no telling which rows follow them
+		for _, sf := range q.Sort {
+			if q.Cursor[sf.Field] == nil {
+				db = db.New()
+				db.AddError(system.NewTypedError(
+					"bad_request",
+					fmt.Sprintf("cursor field %q is null", sf.Field),
+					fmt.Sprintf("Cursors can't follow items without %s.", sf.Field),
+				))
+				return db
+			}
+		}
+
+		// rows after the cursor in sort order: (a > ?) OR (a = ? AND b > ?) ...
+		ors := []string{}
+		args := []interface{}{}
+		for i, sf := range q.Sort {
+			ands := []string{}
+			for _, prev := range q.Sort[:i] {
+				ands = append(ands, prev.Field+" = ?")
+				args = append(args, q.Cursor[prev.Field])
+			}
+			op := ">"
+			if sf.Desc {
+				op = "<"
+			}
+			ands = append(ands, fmt.Sprintf("%s %s ?", sf.Field, op))
+			args = append(args, q.Cursor[sf.Field])
+			ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+		}
+		db = db.Where(strings.Join(ors, " OR "), args...)
+	}
+
+	for _, sf := range q.Sort {
+		if sf.Desc {
+			db = db.Order(sf.Field + " DESC")
+		} else {
+			db = db.Order(sf.Field + " ASC")
+		}
+	}
+
+	return db.Offset(q.Offset).Limit(q.Limit)
+}
+
+var mongoOps = map[string]string{
+	"eq": "$eq", "ne": "$ne", "lt": "$lt", "lte": "$lte",
+	"gt": "$gt", "gte": "$gte", "in": "$in",
+}
+
+// MongoFilter builds the selector of a list query. Values of the fields
+// declared in ListOptions.Types are converted since MongoDB compares by
+// type, others stay strings.
+func MongoFilter(q *system.ListQuery) bson.M {
+	sel := bson.M{}
+	for _, f := range q.Filters {
+		cond, ok := sel[f.Field].(bson.M)
+		if !ok {
+			cond = bson.M{}
+			sel[f.Field] = cond
+		}
+		switch f.Op {
+		case "in":
+			values := []interface{}{}
+			for _, v := range f.Values() {
+				values = append(values, mongoValue(q, f.Field, v))
+			}
+			cond["$in"] = values
+		case "like":
+			expr := strings.Replace(regexp.QuoteMeta(f.Value), `\*`, ".*", -1)
+			cond["$regex"] = bson.RegEx{Pattern: "^" + expr + "$", Options: "i"}
+		default:
+			cond[mongoOps[f.Op]] = mongoValue(q, f.Field, f.Value)
+		}
+	}
+
+	if q.Cursor != nil {
+		ors := []bson.M{}
+		for i, sf := range q.Sort {
+			and := bson.M{}
+			for _, prev := range q.Sort[:i] {
+				and[prev.Field] = q.Cursor[prev.Field]
+			}
+			op := "$gt"
+			if sf.Desc {
+				op = "$lt"
+			}
+			and[sf.Field] = bson.M{op: q.Cursor[sf.Field]}
+			ors = append(ors, and)
+		}
+		sel = bson.M{"$and": []bson.M{sel, {"$or": ors}}}
+	}
+
+	return sel
+}
+
+// MongoList applies a list query to a collection:
+//
+//	q, err := ct.ParseList(req, opts)
+//	...
+//	total, _ := c.Find(plugins.MongoFilter(q)).Count()
+//	var users []User
+//	plugins.MongoList(c, q).All(&users)
+func MongoList(c *mgo.Collection, q *system.ListQuery) *mgo.Query {
+	query := c.Find(MongoFilter(q))
+
+	fields := []string{}
+	for _, sf := range q.Sort {
+		if sf.Desc {
+			fields = append(fields, "-"+sf.Field)
+		} else {
+			fields = append(fields, sf.Field)
+		}
+	}
+	if len(fields) > 0 {
+		query = query.Sort(fields...)
+	}
+
+	return query.Skip(q.Offset).Limit(q.Limit)
+}
+
+// mongoValue converts a filter value, already checked by ParseList.
+func mongoValue(q *system.ListQuery, field, s string) interface{} {
+	if v, err := q.TypedValue(field, s); err == nil {
+		return v
+	}
+	return s
+}
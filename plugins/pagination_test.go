@@ -0,0 +1,138 @@
+package plugins
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/system"
+	_ "github.com/mattn/go-sqlite3"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var listOptions = system.ListOptions{
+	Sortable:   []string{"title", "stars", "created"},
+	Filterable: []string{"title", "stars"},
+	Types:      map[string]string{"stars": "int"},
+}
+
+type listNote struct {
+	ID      int64 `json:"id"`
+	Title   string
+	Stars   int
+	Created time.Time
+}
+
+func parseList(t *testing.T, url string) *system.ListQuery {
+	q, err := system.ParseList(restful.NewRequest(httptest.NewRequest("GET", url, nil)), listOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestGormList(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orm := &db
+	defer orm.Close()
+	orm.DB().SetMaxOpenConns(1)
+	if err := orm.AutoMigrate(&listNote{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, title := range []string{"b", "a", "c", "a", "b"} {
+		n := listNote{Title: title, Stars: i, Created: day.Add(time.Duration(i%3) * time.Hour)}
+		if err := orm.Create(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		ids  []int64
+	}{
+		{"offset", "/notes?sort=title,id&limit=2&offset=1", []int64{4, 1}},
+		{"filter", "/notes?stars[gte]=2&sort=-stars&limit=10", []int64{5, 4, 3}},
+		{"cursor", "/notes?sort=title&limit=2&cursor=", []int64{2, 4, 1, 5, 3}},
+		{"time cursor", "/notes?sort=-created&limit=2&cursor=", []int64{3, 2, 5, 1, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []int64{}
+			url := tt.url
+			for page := 0; page < 5; page++ {
+				q := parseList(t, url)
+				var notes []listNote
+				if err := GormList(orm, q).Find(&notes).Error; err != nil {
+					t.Fatal(err)
+				}
+				for _, n := range notes {
+					ids = append(ids, n.ID)
+				}
+				p := q.NewPage(notes, -1)
+				if p.NextCursor == "" {
+					break
+				}
+				url = tt.url + p.NextCursor
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("ids %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestGormListNullCursor(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orm := &db
+	defer orm.Close()
+	if err := orm.AutoMigrate(&listNote{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	q := parseList(t, "/notes?sort=title&cursor="+base64.RawURLEncoding.EncodeToString([]byte(`{"title":null,"id":1}`)))
+	var notes []listNote
+	err = GormList(orm, q).Find(&notes).Error
+	if ae, ok := err.(system.ApiError); !ok || ae.Code != 400 {
+		t.Errorf("error %v, want a 400", err)
+	}
+}
+
+func TestMongoFilter(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"created":{"time":"2026-01-02T03:04:05Z"},"id":7}`))
+	tests := []struct {
+		name string
+		url  string
+		sel  bson.M
+	}{
+		{"filters", "/notes?stars[gte]=3&title[in]=a,b", bson.M{
+			"stars": bson.M{"$gte": int64(3)},
+			"title": bson.M{"$in": []interface{}{"a", "b"}},
+		}},
+		{"string filter", "/notes?title=0123", bson.M{"title": bson.M{"$eq": "0123"}}},
+		{"like", "/notes?title[like]=a*", bson.M{"title": bson.M{"$regex": bson.RegEx{Pattern: "^a.*$", Options: "i"}}}},
+		{"time cursor", "/notes?sort=-created&cursor=" + cursor, bson.M{"$and": []bson.M{{}, {"$or": []bson.M{
+			{"created": bson.M{"$lt": created}},
+			{"created": created, "id": bson.M{"$gt": int64(7)}},
+		}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if sel := MongoFilter(parseList(t, tt.url)); !reflect.DeepEqual(sel, tt.sel) {
+				t.Errorf("selector %#v, want %#v", sel, tt.sel)
+			}
+		})
+	}
+}
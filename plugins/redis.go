@@ -1,6 +1,7 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -57,3 +58,32 @@ func (r *PluginRedis) Close() error {
 	}
 	return nil
 }
+
+// RedisDo runs a command on a connection of pool and returns ctx.Err() when
+// ctx is done first. redigo takes no context, so the command isn't canceled:
+// it keeps running after ctx is done, its side effects still happen, and
+// its connection returns to the pool once it completes.
+func RedisDo(ctx context.Context, pool *redis.Pool, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type reply struct {
+		v   interface{}
+		err error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		c := pool.Get()
+		defer c.Close()
+		v, err := c.Do(cmd, args...)
+		done <- reply{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -14,4 +14,33 @@ CREATE TABLE user (
 	security_role_id INT,
 	created INT,
 	updated INT
-);
\ No newline at end of file
+);
+-- name: create-security-role-table
+CREATE TABLE security_role (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(100) UNIQUE
+);
+-- name: create-security-role-permission-table
+CREATE TABLE security_role_permission (
+	security_role_id INT,
+	permission VARCHAR(100),
+	PRIMARY KEY (security_role_id, permission)
+);
+-- name: user-roles
+SELECT r.name FROM user u
+INNER JOIN security_role r ON r.id = u.security_role_id
+WHERE u.username = ? AND ? IN ('basic', 'jwt') AND u.active = 1;
+-- name: role-permissions
+SELECT p.permission FROM security_role_permission p
+INNER JOIN security_role r ON r.id = p.security_role_id
+WHERE r.name = ?;
+-- name: create-idempotency-key-table
+CREATE TABLE idempotency_key (
+	id CHAR(76) PRIMARY KEY,
+	fingerprint CHAR(64),
+	done TINYINT(1),
+	status INT,
+	header BLOB,
+	body MEDIUMBLOB,
+	expires INT
+);
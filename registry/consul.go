@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ConsulRegistry registers instances with the service endpoints of a
+// Consul agent, or of anything speaking its HTTP API. The agent checks the
+// health URL and drops instances failing for longer than DeregisterAfter.
+type ConsulRegistry struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func NewConsulRegistry(baseURL, token string) *ConsulRegistry {
+	return &ConsulRegistry{
+		URL:    strings.TrimSuffix(baseURL, "/"),
+		Token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type consulCheck struct {
+	HTTP                           string `json:",omitempty"`
+	Interval                       string `json:",omitempty"`
+	Timeout                        string `json:",omitempty"`
+	DeregisterCriticalServiceAfter string `json:",omitempty"`
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Tags    []string          `json:",omitempty"`
+	Address string            `json:",omitempty"`
+	Port    int               `json:",omitempty"`
+	Meta    map[string]string `json:",omitempty"`
+	Check   *consulCheck      `json:",omitempty"`
+}
+
+func (c *ConsulRegistry) Register(ctx context.Context, s *Service) error {
+	cs := consulService{
+		ID:      s.ID,
+		Name:    s.Name,
+		Tags:    s.Tags,
+		Address: s.Address,
+		Port:    s.Port,
+		Meta:    s.Meta,
+	}
+	if s.HealthURL != "" {
+		cs.Check = &consulCheck{HTTP: s.HealthURL}
+		if s.CheckInterval > 0 {
+			cs.Check.Interval = s.CheckInterval.String()
+			cs.Check.Timeout = s.CheckInterval.String()
+		}
+		if s.DeregisterAfter > 0 {
+			cs.Check.DeregisterCriticalServiceAfter = s.DeregisterAfter.String()
+		}
+	}
+
+	b, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	return c.put(ctx, "/v1/agent/service/register", b)
+}
+
+func (c *ConsulRegistry) Deregister(ctx context.Context, s *Service) error {
+	return c.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(s.ID), nil)
+}
+
+func (c *ConsulRegistry) put(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequest("PUT", c.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("consul: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("consul: request failed:\n%s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("consul: PUT %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
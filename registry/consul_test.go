@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type consulRequest struct {
+	method, path, token string
+	body                []byte
+}
+
+func consulServer(t *testing.T, status int) (*httptest.Server, chan consulRequest) {
+	reqs := make(chan consulRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		reqs <- consulRequest{r.Method, r.URL.EscapedPath(), r.Header.Get("X-Consul-Token"), b}
+		if status != http.StatusOK {
+			http.Error(w, "Permission denied", status)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func TestConsulRegistry(t *testing.T) {
+	s := &Service{
+		ID:              "api/1",
+		Name:            "api",
+		Address:         "10.0.0.5",
+		Port:            8080,
+		Tags:            []string{"v2"},
+		HealthURL:       "http://10.0.0.5:9090/health",
+		CheckInterval:   10 * time.Second,
+		DeregisterAfter: time.Minute,
+	}
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		call   func(c *ConsulRegistry) error
+		path   string
+		err    string
+	}{
+		{"register", "", 200, func(c *ConsulRegistry) error { return c.Register(context.Background(), s) }, "/v1/agent/service/register", ""},
+		{"register with token", "secret", 200, func(c *ConsulRegistry) error { return c.Register(context.Background(), s) }, "/v1/agent/service/register", ""},
+		{"deregister", "secret", 200, func(c *ConsulRegistry) error { return c.Deregister(context.Background(), s) }, "/v1/agent/service/deregister/api%2F1", ""},
+		{"denied", "wrong", 403, func(c *ConsulRegistry) error { return c.Register(context.Background(), s) }, "/v1/agent/service/register", "403 Forbidden: Permission denied"},
+		{"agent error", "", 500, func(c *ConsulRegistry) error { return c.Deregister(context.Background(), s) }, "/v1/agent/service/deregister/api%2F1", "500 Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, reqs := consulServer(t, tt.status)
+			err := tt.call(NewConsulRegistry(srv.URL+"/", tt.token))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+
+			r := <-reqs
+			if r.method != "PUT" || r.path != tt.path || r.token != tt.token {
+				t.Errorf("got %s %s with token %q, want PUT %s with %q", r.method, r.path, r.token, tt.path, tt.token)
+			}
+			if tt.path != "/v1/agent/service/register" {
+				return
+			}
+			var cs consulService
+			if err := json.Unmarshal(r.body, &cs); err != nil {
+				t.Fatal(err)
+			}
+			if cs.ID != s.ID || cs.Address != s.Address || cs.Port != s.Port || cs.Check == nil ||
+				cs.Check.HTTP != s.HealthURL || cs.Check.Interval != "10s" || cs.Check.DeregisterCriticalServiceAfter != "1m0s" {
+				t.Errorf("registered %+v with check %+v", cs, cs.Check)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FileRegistry keeps the instances in a JSON file, an object of services by
+// ID, for proxies and scripts on the same host or a shared volume. Instances
+// updating the file concurrently take turns through a lock file.
+type FileRegistry struct {
+	Path string
+}
+
+func NewFileRegistry(path string) *FileRegistry {
+	return &FileRegistry{Path: path}
+}
+
+func (f *FileRegistry) Register(ctx context.Context, s *Service) error {
+	return f.update(func(services map[string]*Service) {
+		services[s.ID] = s
+	})
+}
+
+func (f *FileRegistry) Deregister(ctx context.Context, s *Service) error {
+	return f.update(func(services map[string]*Service) {
+		delete(services, s.ID)
+	})
+}
+
+// Services returns the registered instances by ID.
+func (f *FileRegistry) Services() (map[string]*Service, error) {
+	services := map[string]*Service{}
+	b, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return services, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("registry: read failed:\n%s", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &services); err != nil {
+			return nil, fmt.Errorf("registry: %s is corrupt:\n%s", f.Path, err)
+		}
+	}
+	return services, nil
+}
+
+// update applies fn to the services under the lock and replaces the file
+// atomically.
+func (f *FileRegistry) update(fn func(map[string]*Service)) error {
+	lock, err := os.OpenFile(f.Path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("registry: lock failed:\n%s", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("registry: lock failed:\n%s", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	services, err := f.Services()
+	if err != nil {
+		return err
+	}
+	fn(services)
+
+	b, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("registry: write failed:\n%s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("registry: write failed:\n%s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("registry: write failed:\n%s", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("registry: write failed:\n%s", err)
+	}
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		return fmt.Errorf("registry: write failed:\n%s", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileRegistry(t *testing.T) {
+	f := NewFileRegistry(filepath.Join(t.TempDir(), "services.json"))
+	ctx := context.Background()
+
+	// instances updating the file at once don't lose each other's entries
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := &Service{ID: fmt.Sprintf("api-%d", i), Name: "api", Port: 8000 + i}
+			if err := NewFileRegistry(f.Path).Register(ctx, s); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	services, err := f.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != n {
+		t.Fatalf("%d services registered, want %d", len(services), n)
+	}
+	if s := services["api-3"]; s == nil || s.Port != 8003 {
+		t.Errorf("got %+v, want api-3 on 8003", s)
+	}
+
+	if err := f.Deregister(ctx, &Service{ID: "api-3"}); err != nil {
+		t.Fatal(err)
+	}
+	services, err = f.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := services["api-3"]; ok || len(services) != n-1 {
+		t.Errorf("api-3 still registered among %d services", len(services))
+	}
+}
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/johnwilson/restapi/system"
+)
+
+// Service is an application instance as announced to a registry.
+type Service struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Version   string            `json:"version"`
+	Address   string            `json:"address"`
+	Port      int               `json:"port"`
+	Tags      []string          `json:"tags,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	HealthURL string            `json:"health_url,omitempty"`
+
+	CheckInterval   time.Duration `json:"-"`
+	DeregisterAfter time.Duration `json:"-"`
+}
+
+// Registry announces service instances.
+type Registry interface {
+	Register(ctx context.Context, s *Service) error
+	Deregister(ctx context.Context, s *Service) error
+}
+
+// New returns the registry of the [registry] section:
+//
+//	[registry]
+//	type = "consul" # consul or file
+//	id = "restapi-1" # defaults to name-host-port
+//	address = "10.0.0.5" # advertised address, defaults to app.address or the host name when that is unspecified or loopback
+//	port = 8080 # advertised port, defaults to app.port
+//	health_url = "http://10.0.0.5:9090/health" # defaults to admin.health_path on the admin or service address
+//	tags = ["api"]
+//	check_interval = 10 # seconds
+//	deregister_after = 60 # seconds a failing instance stays registered
+//	path = "/var/run/restapi/services.json" # file registry
+//	url = "http://127.0.0.1:8500" # consul agent
+//	token = "" # consul ACL token
+func New(app *system.Application) (Registry, error) {
+	config := app.Config
+	switch t := config.GetDefault("registry.type", "file").(string); t {
+	case "file":
+		path := config.GetDefault("registry.path", "").(string)
+		if path == "" {
+			return nil, fmt.Errorf("registry: file registry requires a path")
+		}
+		return NewFileRegistry(path), nil
+	case "consul":
+		return NewConsulRegistry(
+			config.GetDefault("registry.url", "http://127.0.0.1:8500").(string),
+			config.GetDefault("registry.token", "").(string),
+		), nil
+	default:
+		return nil, fmt.Errorf("registry: unknown type %q", t)
+	}
+}
+
+// NewService describes the application instance from its configuration.
+func NewService(app *system.Application) (*Service, error) {
+	config := app.Config
+	s := &Service{
+		Name:    config.GetDefault("app.name", "restapi").(string),
+		Version: config.GetDefault("app.version", "").(string),
+		Address: config.GetDefault("registry.address", "").(string),
+		Port:    int(config.GetDefault("registry.port", config.GetDefault("app.port", int64(8000))).(int64)),
+		Meta:    map[string]string{},
+
+		CheckInterval:   time.Duration(config.GetDefault("registry.check_interval", int64(10)).(int64)) * time.Second,
+		DeregisterAfter: time.Duration(config.GetDefault("registry.deregister_after", int64(60)).(int64)) * time.Second,
+	}
+	if s.Version != "" {
+		s.Meta["version"] = s.Version
+	}
+	if tags, ok := config.Get("registry.tags").([]interface{}); ok {
+		for _, t := range tags {
+			s.Tags = append(s.Tags, fmt.Sprint(t))
+		}
+	}
+
+	host, _ := os.Hostname()
+	if s.Address == "" {
+		// other hosts can't reach a loopback address
+		if s.Address = config.GetDefault("app.address", "").(string); loopback(s.Address) {
+			s.Address = ""
+		}
+	}
+	if unspecified(s.Address) {
+		if host == "" {
+			return nil, fmt.Errorf("registry: no address to advertise, set registry.address")
+		}
+		s.Address = host
+	}
+
+	s.ID = config.GetDefault("registry.id", "").(string)
+	if s.ID == "" {
+		s.ID = fmt.Sprintf("%s-%s-%d", s.Name, host, s.Port)
+	}
+
+	s.HealthURL = config.GetDefault("registry.health_url", "").(string)
+	if s.HealthURL == "" {
+		s.HealthURL = healthURL(app, s)
+	}
+	return s, nil
+}
+
+// healthURL points at the health check of the admin listener, or of the
+// service when there is none.
+func healthURL(app *system.Application, s *Service) string {
+	config := app.Config
+	path := config.GetDefault("admin.health_path", "/health").(string)
+	scheme := "http"
+	hostport := net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+
+	admin := config.GetDefault("admin.address", "").(string)
+	if admin != "" && !strings.HasPrefix(admin, "unix:") && !strings.HasPrefix(admin, "systemd") {
+		if host, port, err := net.SplitHostPort(admin); err == nil {
+			if unspecified(host) {
+				host = s.Address
+			}
+			hostport = net.JoinHostPort(host, port)
+		}
+		if config.Has("tls") && config.GetDefault("admin.tls", false).(bool) {
+			scheme = "https"
+		}
+	} else if config.Has("tls") {
+		scheme = "https"
+	}
+	return scheme + "://" + hostport + path
+}
+
+func unspecified(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Attach registers the application in r once it is ready and deregisters it
+// when shutdown begins, before connections are drained. An instance that
+// handed its listeners to an upgraded process leaves the registration to it.
+func Attach(app *system.Application, r Registry) {
+	s, err := NewService(app)
+	if err != nil {
+		log.Fatalf("Registry init failed:\n%s", err)
+	}
+
+	app.AddHook(system.Hook{
+		Name:  "registry",
+		Phase: system.PostListen,
+		Order: 100, // once everything else is up
+		Fn: func(ctx context.Context) error {
+			if err := r.Register(ctx, s); err != nil {
+				return err
+			}
+			log.Infof("Registered %s as %s", s.Name, s.ID)
+			return nil
+		},
+	})
+	app.AddHook(system.Hook{
+		Name:  "registry",
+		Phase: system.PreShutdown,
+		Order: -100, // before anything stops
+		Fn: func(ctx context.Context) error {
+			if app.Upgraded() {
+				return nil
+			}
+			if err := r.Deregister(ctx, s); err != nil {
+				return err
+			}
+			log.Infof("Deregistered %s", s.ID)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,45 @@
+package registry
+
+import (
+	"os"
+	"testing"
+
+	"github.com/johnwilson/restapi/system"
+	"github.com/pelletier/go-toml"
+)
+
+func newTestApp(t *testing.T, config string) *system.Application {
+	tree, err := toml.Load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &system.Application{Config: tree}
+}
+
+func TestNewService(t *testing.T) {
+	host, _ := os.Hostname()
+	tests := []struct {
+		name    string
+		config  string
+		address string
+		health  string
+	}{
+		{"unspecified", "[app]\naddress = \"0.0.0.0\"\nport = 8080\n", host, "http://" + host + ":8080/health"},
+		{"localhost", "[app]\naddress = \"localhost\"\nport = 8080\n", host, "http://" + host + ":8080/health"},
+		{"loopback", "[app]\naddress = \"127.0.0.1\"\nport = 8080\n", host, "http://" + host + ":8080/health"},
+		{"app address", "[app]\naddress = \"10.0.0.5\"\nport = 8080\n", "10.0.0.5", "http://10.0.0.5:8080/health"},
+		{"registry address", "[app]\naddress = \"localhost\"\n[registry]\naddress = \"127.0.0.1\"\n", "127.0.0.1", "http://127.0.0.1:8000/health"},
+		{"admin listener", "[app]\naddress = \"10.0.0.5\"\n[admin]\naddress = \"0.0.0.0:9090\"\nhealth_path = \"/healthz\"\n", "10.0.0.5", "http://10.0.0.5:9090/healthz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewService(newTestApp(t, tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Address != tt.address || s.HealthURL != tt.health {
+				t.Errorf("advertised %s with %s, want %s with %s", s.Address, s.HealthURL, tt.address, tt.health)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package resource
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// columnName returns the database column of a model field, honouring the
+// gorm column tag.
+func columnName(f reflect.StructField) string {
+	for _, opt := range strings.Split(f.Tag.Get("gorm"), ";") {
+		if strings.HasPrefix(strings.ToLower(opt), "column:") {
+			return opt[len("column:"):]
+		}
+	}
+	return toSnake(f.Name)
+}
+
+// toSnake converts a Go field name to snake case the way gorm does, keeping
+// initialisms together: UserID -> user_id, HTTPCode -> http_code.
+func toSnake(s string) string {
+	runes := []rune(s)
+	out := []rune{}
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && unicode.IsLower(runes[i-1])
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				out = append(out, '_')
+			}
+			out = append(out, unicode.ToLower(r))
+			continue
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// columns maps the columns of a model to their values, skipping the primary
+// key, ignored fields, associations and fields hidden from JSON, which
+// clients can't send.
+func columns(rv reflect.Value, pk string) map[string]interface{} {
+	m := map[string]interface{}{}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("gorm") == "-" || f.Tag.Get("sql") == "-" || hidden(f) {
+			continue
+		}
+		fv := rv.Field(i)
+		if f.Anonymous {
+			for k, v := range columns(reflect.Indirect(fv), pk) {
+				m[k] = v
+			}
+			continue
+		}
+		if !isColumn(f.Type) {
+			continue
+		}
+		col := columnName(f)
+		if col == pk {
+			continue
+		}
+		m[col] = fv.Interface()
+	}
+	return m
+}
+
+// isColumn reports whether a field type maps to a column rather than to an
+// association.
+func isColumn(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Struct:
+		// time.Time and sql.Null* types
+		_, isValuer := reflect.PtrTo(t).MethodByName("Scan")
+		return t.PkgPath() == "time" || isValuer
+	case reflect.Map, reflect.Interface, reflect.Func, reflect.Chan:
+		return false
+	}
+	return true
+}
+
+// hidden reports whether a field is left out of JSON documents, like a
+// password hash.
+func hidden(f reflect.StructField) bool {
+	return f.Tag.Get("json") == "-"
+}
+
+// keepHidden copies the fields hidden from JSON from src to dst, so that
+// an item decoded from a request keeps the stored values.
+func keepHidden(dst, src reflect.Value) {
+	rt := dst.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		switch {
+		case hidden(f):
+			dst.Field(i).Set(src.Field(i))
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			keepHidden(dst.Field(i), src.Field(i))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package resource
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Audit struct {
+	UpdatedBy string
+	Token     string `json:"-"`
+}
+
+type testUser struct {
+	ID           uint
+	Name         string
+	PasswordHash string `json:"-"`
+	Cache        string `gorm:"-"`
+	Groups       []string
+	CreatedAt    time.Time
+	Audit
+}
+
+func TestColumns(t *testing.T) {
+	u := testUser{ID: 1, Name: "alice", PasswordHash: "hash", Cache: "x", Audit: Audit{"bob", "secret"}}
+	got := columns(reflect.ValueOf(u), "id")
+	want := map[string]interface{}{
+		"name":       "alice",
+		"created_at": time.Time{},
+		"updated_by": "bob",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+}
+
+func TestKeepHidden(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst testUser
+		want     testUser
+	}{
+		{
+			"hidden fields kept",
+			testUser{Name: "alice", PasswordHash: "hash"},
+			testUser{Name: "alicia"},
+			testUser{Name: "alicia", PasswordHash: "hash"},
+		},
+		{
+			"embedded struct",
+			testUser{Audit: Audit{"bob", "secret"}},
+			testUser{Audit: Audit{UpdatedBy: "carol"}},
+			testUser{Audit: Audit{"carol", "secret"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepHidden(reflect.ValueOf(&tt.dst).Elem(), reflect.ValueOf(tt.src))
+			if !reflect.DeepEqual(tt.dst, tt.want) {
+				t.Errorf("got %+v, want %+v", tt.dst, tt.want)
+			}
+		})
+	}
+}
+
+func TestToSnake(t *testing.T) {
+	tests := map[string]string{
+		"UserID":    "user_id",
+		"HTTPCode":  "http_code",
+		"CreatedAt": "created_at",
+		"ID":        "id",
+	}
+	for in, want := range tests {
+		if got := toSnake(in); got != want {
+			t.Errorf("toSnake(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package resource
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to target: members set
+// to null are removed, objects are merged recursively and anything else
+// replaces the target member.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = map[string]interface{}{}
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(target, k)
+			continue
+		}
+		if pv, ok := v.(map[string]interface{}); ok {
+			tv, _ := target[k].(map[string]interface{})
+			target[k] = mergePatch(tv, pv)
+			continue
+		}
+		target[k] = v
+	}
+	return target
+}
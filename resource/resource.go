@@ -0,0 +1,633 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/middleware"
+	"github.com/johnwilson/restapi/plugins"
+	"github.com/johnwilson/restapi/system"
+)
+
+// Hook runs inside the transaction of a write. Returning an error rolls the
+// transaction back and is written to the client with WriteRequestError.
+type Hook func(req *restful.Request, tx *gorm.DB, item interface{}) error
+
+// Hooks are called around the writes of a resource. item is a pointer to
+// the model.
+type Hooks struct {
+	BeforeCreate Hook
+	AfterCreate  Hook
+	BeforeUpdate Hook
+	AfterUpdate  Hook
+	BeforeDelete Hook
+	AfterDelete  Hook
+}
+
+// Resource exposes a Gorm model as a CRUD web service:
+//
+//	GET    /users        list, see system.ParseList
+//	POST   /users        create
+//	GET    /users/{id}   read
+//	PUT    /users/{id}   replace
+//	PATCH  /users/{id}   JSON Merge Patch (RFC 7396)
+//	DELETE /users/{id}   delete
+//
+// Bodies are validated with the model validate tags. When VersionField is
+// set, updates only succeed if the version sent by the client matches the
+// stored one and the version is incremented; stale writes get a 409. The
+// version is also the ETag of the resource, otherwise the ETag is a hash
+// of its JSON document. Preconditions of writes are checked in their
+// transaction and answered with a 412 on mismatch. Models
+// with a DeletedAt field are soft deleted by Gorm, ?include_deleted=true
+// shows deleted rows on the list and read routes and ?permanent=true
+// deletes for good. Fields tagged json:"-" are never written from requests.
+type Resource struct {
+	Path         string
+	Model        interface{}
+	Plugin       string // name of the Gorm plugin, "orm" by default
+	PrimaryKey   string // name of the primary key field, "ID" by default
+	VersionField string // name of the version field, empty disables locking
+	MaxPatchSize int64  // merge patch size limit, 1 MiB by default
+	List         system.ListOptions
+	Hooks        Hooks
+
+	orm        *gorm.DB // set by Mount
+	typ        reflect.Type
+	pkColumn   string
+	verColumn  string
+	softDelete bool
+}
+
+// New creates the resource of model mounted at path.
+func New(path string, model interface{}) *Resource {
+	return &Resource{Path: path, Model: model}
+}
+
+// Mount adds the web service of the resource to the application. The Gorm
+// plugin is looked up once, so it must be registered before.
+func (r *Resource) Mount(a *system.Application) {
+	ws := r.WebService()
+	orm, ok := a.GetPlugin(r.Plugin).(*gorm.DB)
+	if !ok {
+		log.Fatalf("Resource: %s: plugin %q isn't a registered Gorm plugin\n", r.Path, r.Plugin)
+	}
+	r.orm = orm
+	a.Container.Add(ws)
+}
+
+// Register adds the web service of the resource to the container. The
+// database is then read from the request attribute set by the plugins
+// middleware, see Mount otherwise.
+func (r *Resource) Register(container *restful.Container) {
+	container.Add(r.WebService())
+}
+
+// WebService builds the web service of the resource.
+func (r *Resource) WebService() *restful.WebService {
+	r.init()
+	name := r.typ.Name()
+	sample := reflect.New(r.typ).Elem().Interface()
+	id := restful.PathParameter("id", name+" identifier")
+
+	ws := new(restful.WebService)
+	ws.Path(r.Path).
+		Doc("Manage "+name+" resources").
+		Consumes(restful.MIME_JSON, restful.MIME_XML).
+		Produces(restful.MIME_JSON, restful.MIME_XML)
+
+	ws.Route(ws.GET("").To(r.list).
+		Doc("list "+name+" resources").
+		Do(system.DocList(r.List), r.docDeleted).
+		Returns(200, "OK", system.Page{}).
+		Do(system.DocErrors("bad_request")))
+
+	ws.Route(ws.POST("").To(r.create).
+		Doc("create a "+name).
+		Reads(sample).
+		Returns(201, "Created", sample).
+		Do(system.DocErrors("bad_request", "validation_failed", "conflict")))
+
+	ws.Route(ws.GET("/{id}").To(r.read).
+		Doc("get a "+name).
+		Param(id).
+		Do(r.docDeleted, middleware.Conditional).
+		Returns(200, "OK", sample).
+		Do(system.DocErrors("not_found")))
+
+	ws.Route(ws.PUT("/{id}").To(r.replace).
+		Doc("replace a "+name+r.lockDoc(true)).
+		Param(id).
+		Do(r.conditional).
+		Reads(sample).
+		Returns(200, "OK", sample).
+		Do(system.DocErrors("bad_request", "not_found", "validation_failed", "conflict")))
+
+	ws.Route(ws.PATCH("/{id}").To(r.patch).
+		Doc("update a "+name+" with a JSON Merge Patch"+r.lockDoc(false)).
+		Consumes("application/merge-patch+json", restful.MIME_JSON).
+		Param(id).
+		Do(r.conditional).
+		Reads(sample, "fields to change, null removes a field").
+		Returns(200, "OK", sample).
+		Do(system.DocErrors("bad_request", "not_found", "validation_failed", "conflict")))
+
+	del := ws.DELETE("/{id}").To(r.delete).
+		Doc("delete a "+name).
+		Param(id).
+		Do(r.conditional).
+		Returns(204, "No Content", nil).
+		Do(system.DocErrors("not_found"))
+	if r.softDelete {
+		del.Param(restful.QueryParameter("permanent", "delete for good instead of soft deleting").DataType("boolean"))
+	}
+	ws.Route(del)
+
+	return ws
+}
+
+func (r *Resource) init() {
+	r.typ = reflect.TypeOf(r.Model)
+	if r.typ.Kind() == reflect.Ptr {
+		r.typ = r.typ.Elem()
+	}
+	if r.Plugin == "" {
+		r.Plugin = "orm"
+	}
+	if r.PrimaryKey == "" {
+		r.PrimaryKey = "ID"
+	}
+	if r.MaxPatchSize <= 0 {
+		r.MaxPatchSize = 1 << 20
+	}
+
+	f, ok := r.typ.FieldByName(r.PrimaryKey)
+	if !ok {
+		log.Fatalf("Resource: %s has no primary key field %q\n", r.typ, r.PrimaryKey)
+	}
+	r.pkColumn = columnName(f)
+	if r.List.Key == "" {
+		r.List.Key = r.pkColumn
+	}
+	if r.VersionField != "" {
+		f, ok := r.typ.FieldByName(r.VersionField)
+		if !ok {
+			log.Fatalf("Resource: %s has no version field %q\n", r.typ, r.VersionField)
+		}
+		r.verColumn = columnName(f)
+	}
+	_, r.softDelete = r.typ.FieldByName("DeletedAt")
+}
+
+func (r *Resource) lockDoc(required bool) string {
+	switch {
+	case r.verColumn == "":
+		return ""
+	case required:
+		return ", the current " + r.verColumn + " or ETag in If-Match must be sent"
+	}
+	return ", send the current " + r.verColumn + " to guard against concurrent updates"
+}
+
+// conditional lets the resource check the preconditions of writes instead
+// of the ETags middleware.
+func (r *Resource) conditional(rb *restful.RouteBuilder) {
+	middleware.Conditional(rb)
+	rb.Param(restful.HeaderParameter("If-Match", "ETag the resource must have"))
+	rb.Returns(412, "Precondition Failed (precondition_failed)", system.ProblemDetails{})
+}
+
+func (r *Resource) docDeleted(rb *restful.RouteBuilder) {
+	if r.softDelete {
+		rb.Param(restful.QueryParameter("include_deleted", "include soft deleted rows").DataType("boolean"))
+	}
+}
+
+func (r *Resource) db(req *restful.Request) (*gorm.DB, error) {
+	if r.orm != nil {
+		return r.orm, nil
+	}
+	db, ok := req.Attribute(r.Plugin).(*gorm.DB)
+	if !ok {
+		return nil, system.NewTypedError(
+			"internal_error",
+			fmt.Sprintf("resource: no Gorm plugin %q on the request to %s", r.Plugin, req.Request.URL.Path),
+			nil,
+		)
+	}
+	return db, nil
+}
+
+// readDB returns the database of the list and read routes, which show soft
+// deleted rows with ?include_deleted=true. Writes never see them.
+func (r *Resource) readDB(req *restful.Request) (*gorm.DB, error) {
+	db, err := r.db(req)
+	if err == nil && r.softDelete && flag(req, "include_deleted") {
+		return db.Unscoped(), nil
+	}
+	return db, err
+}
+
+func flag(req *restful.Request, name string) bool {
+	b, _ := strconv.ParseBool(req.QueryParameter(name))
+	return b
+}
+
+// item returns a pointer to a new model value.
+func (r *Resource) item() reflect.Value {
+	return reflect.New(r.typ)
+}
+
+// id converts the id path parameter to the type of the primary key. Ids
+// which can't be converted don't exist.
+func (r *Resource) id(req *restful.Request) (interface{}, error) {
+	s := req.PathParameter("id")
+	pk := r.item().Elem().FieldByName(r.PrimaryKey)
+	var err error
+	switch pk.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		pk.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 64)
+		pk.SetUint(n)
+	case reflect.String:
+		pk.SetString(s)
+	default:
+		return s, nil
+	}
+	if err != nil {
+		return nil, system.NewTypedError("not_found", fmt.Sprintf("resource: invalid id %q", s), nil)
+	}
+	return pk.Interface(), nil
+}
+
+func (r *Resource) find(db *gorm.DB, id interface{}) (reflect.Value, error) {
+	item := r.item()
+	err := db.Where(r.pkColumn+" = ?", id).First(item.Interface()).Error
+	return item, err
+}
+
+// validators returns the ETag and modification time of an item. The ETag
+// is the version of the item, or a hash of its JSON document.
+func (r *Resource) validators(item reflect.Value) (string, time.Time) {
+	var etag string
+	if r.verColumn != "" {
+		etag = system.VersionETag(item.Elem().FieldByName(r.VersionField).Interface())
+	} else if b, err := json.Marshal(item.Interface()); err == nil {
+		etag = system.HashETag(b, false)
+	}
+	var modified time.Time
+	if f := item.Elem().FieldByName("UpdatedAt"); f.IsValid() {
+		modified, _ = f.Interface().(time.Time)
+	}
+	return etag, modified
+}
+
+// setValidators adds the ETag and Last-Modified headers of an item.
+func (r *Resource) setValidators(resp *restful.Response, item reflect.Value) {
+	etag, modified := r.validators(item)
+	if etag != "" {
+		resp.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		resp.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// precondition checks the request preconditions against the current item.
+func (r *Resource) precondition(req *restful.Request, item reflect.Value) error {
+	etag, modified := r.validators(item)
+	if system.EvaluateConditions(req, etag, modified) != 0 {
+		return system.PreconditionError(req)
+	}
+	return nil
+}
+
+func (r *Resource) list(req *restful.Request, resp *restful.Response) {
+	q, err := system.ParseList(req, r.List)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	db, err := r.readDB(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	var total int64
+	if err := plugins.GormFilter(db.Model(r.item().Interface()), q).Count(&total).Error; err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	items := reflect.New(reflect.SliceOf(r.typ))
+	if err := plugins.GormList(db, q).Find(items.Interface()).Error; err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	system.WritePage(req, resp, q, q.NewPage(items.Elem().Interface(), total))
+}
+
+func (r *Resource) read(req *restful.Request, resp *restful.Response) {
+	id, err := r.id(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	db, err := r.readDB(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	item, err := r.find(db, id)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	etag, modified := r.validators(item)
+	if !system.CheckConditions(req, resp, etag, modified) {
+		return
+	}
+	system.WriteResponse(req, resp, 200, item.Interface())
+}
+
+func (r *Resource) create(req *restful.Request, resp *restful.Response) {
+	item := r.item()
+	if err := system.Bind(req, item.Interface()); err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	// the database assigns ids and versions start at 1
+	pk := item.Elem().FieldByName(r.PrimaryKey)
+	pk.Set(reflect.Zero(pk.Type()))
+	if r.verColumn != "" {
+		setInt(item.Elem().FieldByName(r.VersionField), 1)
+	}
+
+	err := r.transaction(req, func(tx *gorm.DB) error {
+		if err := r.call(r.Hooks.BeforeCreate, req, tx, item); err != nil {
+			return err
+		}
+		if err := tx.Create(item.Interface()).Error; err != nil {
+			return err
+		}
+		return r.call(r.Hooks.AfterCreate, req, tx, item)
+	})
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	location := strings.TrimRight(req.Request.URL.Path, "/") + "/" + fmt.Sprint(item.Elem().FieldByName(r.PrimaryKey).Interface())
+	resp.AddHeader("Location", location)
+	r.setValidators(resp, item)
+	system.WriteResponse(req, resp, 201, item.Interface())
+}
+
+func (r *Resource) replace(req *restful.Request, resp *restful.Response) {
+	id, err := r.id(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	db, err := r.db(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	current, err := r.find(db, id)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	item := r.item()
+	if err := system.Bind(req, item.Interface()); err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	keepHidden(item.Elem(), current.Elem())
+	if r.verColumn != "" && req.HeaderParameter("If-Match") != "" {
+		// the precondition already names the version being replaced
+		version := item.Elem().FieldByName(r.VersionField)
+		version.Set(current.Elem().FieldByName(r.VersionField))
+	}
+	if r.verColumn != "" && isZeroValue(item.Elem().FieldByName(r.VersionField)) {
+		errs := system.ValidationError{{Field: r.verColumn, Rule: "required", Message: "is required"}}
+		system.WriteRequestError(errs.ApiError("validation_failed"), req, resp)
+		return
+	}
+
+	r.update(req, resp, id, item)
+}
+
+func (r *Resource) patch(req *restful.Request, resp *restful.Response) {
+	id, err := r.id(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	db, err := r.db(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	current, err := r.find(db, id)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	if err := system.LimitBody(req.Request, r.MaxPatchSize); err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		system.WriteRequestError(system.WrapError(err, "bad_request", "resource: merge patch decoding failed", "Malformed merge patch, a JSON object is expected."), req, resp)
+		return
+	}
+
+	// apply the patch to the JSON document of the stored row
+	doc := map[string]interface{}{}
+	b, err := json.Marshal(current.Interface())
+	if err == nil {
+		err = json.Unmarshal(b, &doc)
+	}
+	if err == nil {
+		b, err = json.Marshal(mergePatch(doc, patch))
+	}
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+	item := r.item()
+	if err := json.Unmarshal(b, item.Interface()); err != nil {
+		system.WriteRequestError(system.WrapError(err, "bad_request", "resource: merge patch decoding failed", "Malformed merge patch."), req, resp)
+		return
+	}
+	keepHidden(item.Elem(), current.Elem())
+	if errs := system.Validate(item.Interface()); len(errs) > 0 {
+		system.WriteRequestError(errs.ApiError("validation_failed"), req, resp)
+		return
+	}
+
+	r.update(req, resp, id, item)
+}
+
+// update writes item over the row with the given id, checking the request
+// preconditions against the row in the transaction and the version when
+// locking is enabled.
+func (r *Resource) update(req *restful.Request, resp *restful.Response, id interface{}, item reflect.Value) {
+	pk := item.Elem().FieldByName(r.PrimaryKey)
+	if v := reflect.ValueOf(id); v.Type().ConvertibleTo(pk.Type()) {
+		pk.Set(v.Convert(pk.Type()))
+	}
+
+	values := columns(item.Elem(), r.pkColumn)
+	delete(values, "created_at")
+	delete(values, "deleted_at")
+	if _, ok := values["updated_at"]; ok {
+		values["updated_at"] = time.Now()
+	}
+
+	err := r.transaction(req, func(tx *gorm.DB) error {
+		current, err := r.find(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := r.precondition(req, current); err != nil {
+			return err
+		}
+		if err := r.call(r.Hooks.BeforeUpdate, req, tx, item); err != nil {
+			return err
+		}
+
+		q := tx.Model(item.Interface()).Where(r.pkColumn+" = ?", id)
+		if r.verColumn != "" {
+			version := item.Elem().FieldByName(r.VersionField)
+			q = q.Where(r.verColumn+" = ?", version.Interface())
+			values[r.verColumn] = gorm.Expr(r.verColumn + " + 1")
+		}
+		res := q.UpdateColumns(values)
+		if res.Error != nil {
+			return res.Error
+		}
+		if r.verColumn != "" && res.RowsAffected == 0 {
+			return system.NewTypedError(
+				"conflict",
+				fmt.Sprintf("resource: stale %s of %s %v", r.verColumn, r.typ.Name(), id),
+				"The resource was modified by another request, reload it and try again.",
+			)
+		}
+
+		// reload to return generated and unchanged columns
+		if err := tx.Where(r.pkColumn+" = ?", id).First(item.Interface()).Error; err != nil {
+			return err
+		}
+		return r.call(r.Hooks.AfterUpdate, req, tx, item)
+	})
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	r.setValidators(resp, item)
+	system.WriteResponse(req, resp, 200, item.Interface())
+}
+
+func (r *Resource) delete(req *restful.Request, resp *restful.Response) {
+	id, err := r.id(req)
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	err = r.transaction(req, func(tx *gorm.DB) error {
+		item, err := r.find(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := r.precondition(req, item); err != nil {
+			return err
+		}
+		if err := r.call(r.Hooks.BeforeDelete, req, tx, item); err != nil {
+			return err
+		}
+		if r.softDelete && flag(req, "permanent") {
+			tx = tx.Unscoped()
+		}
+		if err := tx.Delete(item.Interface()).Error; err != nil {
+			return err
+		}
+		return r.call(r.Hooks.AfterDelete, req, tx, item)
+	})
+	if err != nil {
+		system.WriteRequestError(err, req, resp)
+		return
+	}
+
+	resp.WriteHeader(204)
+}
+
+// transaction runs fn in a transaction which is rolled back when fn fails
+// or panics.
+func (r *Resource) transaction(req *restful.Request, fn func(tx *gorm.DB) error) error {
+	db, err := r.db(req)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return tx.Commit().Error
+}
+
+func (r *Resource) call(h Hook, req *restful.Request, tx *gorm.DB, item reflect.Value) error {
+	if h == nil {
+		return nil
+	}
+	return h(req, tx, item.Interface())
+}
+
+func setInt(f reflect.Value, n int64) {
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.SetUint(uint64(n))
+	}
+}
+
+func isZeroValue(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
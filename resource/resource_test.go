@@ -0,0 +1,158 @@
+package resource
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type testNote struct {
+	ID     uint   `json:"id"`
+	Title  string `json:"title"`
+	Secret string `json:"-"`
+}
+
+// newTestResource serves the notes resource over a database holding note
+// 1, whose secret isn't exposed.
+func newTestResource(t *testing.T) (http.Handler, *gorm.DB) {
+	orm := newTestDB(t)
+	c := restful.NewContainer()
+	c.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		req.SetAttribute("orm", orm)
+		chain.ProcessFilter(req, resp)
+	})
+	New("/notes", testNote{}).Register(c)
+	return c, orm
+}
+
+// newTestDB opens a database holding note 1. It has a single connection,
+// so a transaction left open blocks the next query.
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orm := &db
+	t.Cleanup(func() { orm.Close() })
+	orm.DB().SetMaxOpenConns(1)
+	if err := orm.AutoMigrate(&testNote{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := orm.Create(&testNote{Title: "first", Secret: "s3cret"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return orm
+}
+
+func request(h http.Handler, method, url, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestResourceWrites(t *testing.T) {
+	h, _ := newTestResource(t)
+	etag := request(h, "GET", "/notes/1", "", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on read")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header map[string]string
+		status int
+		title  string
+	}{
+		{"replace", "PUT", `{"title":"second"}`, nil, 200, "second"},
+		{"replace if-match", "PUT", `{"title":"second"}`, map[string]string{"If-Match": etag}, 200, "second"},
+		{"replace stale", "PUT", `{"title":"second"}`, map[string]string{"If-Match": `"stale"`}, 412, "first"},
+		{"patch", "PATCH", `{"title":"third"}`, map[string]string{"Content-Type": "application/merge-patch+json"}, 200, "third"},
+		{"patch stale", "PATCH", `{"title":"third"}`, map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": `"stale"`}, 412, "first"},
+		{"delete stale", "DELETE", "", map[string]string{"If-Match": `"stale"`}, 412, "first"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestResource(t)
+			if w := request(h, tt.method, "/notes/1", tt.body, tt.header); w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+
+			var n testNote
+			if err := db.First(&n, 1).Error; err != nil {
+				t.Fatal(err)
+			}
+			if n.Title != tt.title || n.Secret != "s3cret" {
+				t.Errorf("stored %+v, want title %q and the secret kept", n, tt.title)
+			}
+		})
+	}
+}
+
+func TestResourceReadConditions(t *testing.T) {
+	h, _ := newTestResource(t)
+	w := request(h, "GET", "/notes/1", "", nil)
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("hidden field exposed: %s", w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if w := request(h, "GET", "/notes/1", "", map[string]string{"If-None-Match": etag}); w.Code != 304 {
+		t.Errorf("If-None-Match: status %d, want 304", w.Code)
+	}
+	request(h, "PUT", "/notes/1", `{"title":"second"}`, nil)
+	if w := request(h, "GET", "/notes/1", "", map[string]string{"If-None-Match": etag}); w.Code != 200 || w.Header().Get("ETag") == etag {
+		t.Errorf("after update: status %d ETag %q, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestResourceWithoutPlugin(t *testing.T) {
+	c := restful.NewContainer()
+	New("/notes", testNote{}).Register(c)
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		if w := request(c, method, "/notes/1", `{"title":"second"}`, nil); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status %d, want 500", method, w.Code)
+		}
+	}
+}
+
+func TestResourceHookPanic(t *testing.T) {
+	orm := newTestDB(t)
+	notes := New("/notes", testNote{})
+	notes.orm = orm
+	notes.Hooks.BeforeUpdate = func(req *restful.Request, tx *gorm.DB, item interface{}) error {
+		panic("hook failed")
+	}
+	c := restful.NewContainer()
+	notes.Register(c)
+
+	func() {
+		defer func() { recover() }()
+		request(c, "PUT", "/notes/1", `{"title":"second"}`, nil)
+	}()
+
+	// the transaction holding the only connection was rolled back
+	var n testNote
+	if err := orm.First(&n, 1).Error; err != nil || n.Title != "first" {
+		t.Errorf("stored %+v (%v), want the update rolled back", n, err)
+	}
+}
+
+func TestResourcePatchSize(t *testing.T) {
+	h, _ := newTestResource(t)
+	patch := `{"title":"` + strings.Repeat("x", 1<<20) + `"}`
+	w := request(h, "PATCH", "/notes/1", patch, map[string]string{"Content-Type": "application/merge-patch+json"})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", w.Code)
+	}
+}
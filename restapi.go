@@ -1,7 +1,9 @@
 package restapi
 
 import (
+	log "github.com/Sirupsen/logrus"
 	"github.com/johnwilson/restapi/middleware"
+	"github.com/johnwilson/restapi/registry"
 	"github.com/johnwilson/restapi/system"
 )
 
@@ -10,10 +12,66 @@ func NewApplication(configFile string) *system.Application {
 	app.Init(configFile)
 
 	// add default middleware
-	app.Container.Filter(middleware.RequestID)
-	app.Container.Filter(middleware.Logger)
-	app.Container.Filter(middleware.Recoverer)
-	app.Container.Filter(app.Plugins)
+	app.Middleware.Use("request_id", 10, middleware.RequestID)
+	app.Middleware.Use("logger", 20, middleware.Logger)
+	app.Middleware.Use("recoverer", 30, middleware.Recoverer)
+	app.Middleware.Use("plugins", 40, app.Plugins)
+
+	// cross origin requests
+	if app.Config.Has("cors") {
+		cors, err := middleware.NewCORS(app.Config)
+		if err != nil {
+			log.Fatalf("CORS init failed:\n%s", err)
+		}
+		app.Middleware.Use("cors", 25, cors.Filter)
+		app.WrapHandler(cors.StaticHandler(app.Config.GetDefault("swagger.url", "/apidocs/").(string)))
+	}
+
+	// authentication
+	if app.Config.Has("auth") {
+		auth := middleware.NewAuth(app)
+		app.Middleware.Use("auth", 45, auth.Filter)
+	}
+
+	// rate limiting, after authentication so that requests can be counted
+	// per user
+	if app.Config.Has("ratelimit") {
+		limiter := middleware.NewRateLimiter(app)
+		app.Middleware.Use("ratelimit", 48, limiter.Filter)
+	}
+
+	// authorisation
+	if app.Config.Has("authz") {
+		authz := middleware.NewAuthorizer(app)
+		app.Middleware.Use("authz", 50, authz.Filter)
+	}
+
+	// idempotent retries
+	if app.Config.Has("idempotency") {
+		idem := middleware.NewIdempotency(app)
+		app.Middleware.Use("idempotency", 55, idem.Filter)
+	}
+
+	// conditional requests
+	if app.Config.Has("etag") {
+		etags := middleware.NewETags(app)
+		app.Middleware.Use("etag", 60, etags.Filter)
+	}
+
+	// response cache
+	if app.Config.Has("cache") {
+		cache := middleware.NewCache(app)
+		app.Middleware.Use("cache", 70, cache.Filter)
+	}
+
+	// service discovery
+	if app.Config.Has("registry") {
+		r, err := registry.New(app)
+		if err != nil {
+			log.Fatalf("Registry init failed:\n%s", err)
+		}
+		registry.Attach(app, r)
+	}
 
 	return app
 }
@@ -0,0 +1,172 @@
+package restapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/jinzhu/gorm"
+	"github.com/johnwilson/restapi/middleware"
+	"github.com/johnwilson/restapi/system"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// valuePlugin registers a value as a plugin.
+type valuePlugin struct {
+	v interface{}
+}
+
+func (p valuePlugin) Init(a *system.Application) error { return nil }
+func (p valuePlugin) Close() error                     { return nil }
+func (p valuePlugin) Get() interface{}                 { return p.v }
+
+// newTestApplication creates an application with NewApplication, serving
+// /orders with a handler counting its calls. The middleware are installed
+// by name, as Start would.
+func newTestApplication(t *testing.T, config string, names ...string) (*system.Application, http.Handler, func() int) {
+	dir, err := ioutil.TempDir("", "restapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(f, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	app := NewApplication(f)
+
+	var mu sync.Mutex
+	calls := 0
+	handler := func(req *restful.Request, resp *restful.Response) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		if req.Request.Method == "POST" {
+			resp.WriteHeader(http.StatusCreated)
+		}
+		resp.Write([]byte("order"))
+	}
+	ws := new(restful.WebService).Path("/orders")
+	ws.Route(ws.GET("").Do(middleware.Cached(middleware.CachePolicy{TTL: time.Minute})).To(handler))
+	ws.Route(ws.POST("").To(handler))
+	app.Container.Add(ws)
+	for _, n := range names {
+		app.Container.Filter(app.Middleware.Get(n).Filter)
+	}
+
+	return app, app.Container, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func request(h http.Handler, method, url string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestNewApplicationCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		store string
+		cache string
+		calls int
+	}{
+		{"memory", "memory", "HIT", 1},
+		// the redis plugin isn't registered, responses aren't cached
+		{"redis", "redis", "MISS", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h, calls := newTestApplication(t, "[cache]\nstore = \""+tt.store+"\"\n", "cache")
+			request(h, "GET", "/orders", nil)
+			w := request(h, "GET", "/orders", nil)
+			if w.Code != http.StatusOK || w.Header().Get("X-Cache") != tt.cache {
+				t.Errorf("got %d X-Cache %q, want 200 %q", w.Code, w.Header().Get("X-Cache"), tt.cache)
+			}
+			if calls() != tt.calls {
+				t.Errorf("handler called %d times, want %d", calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestNewApplicationIdempotency(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		orm    bool
+		calls  int
+		replay string
+	}{
+		{"memory", "store = \"memory\"\n", false, 1, "true"},
+		{"sql", "store = \"sql\"\n", true, 1, "true"},
+		// the orm plugin isn't registered, retries aren't deduplicated
+		{"sql unregistered", "store = \"sql\"\n", false, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, h, calls := newTestApplication(t, "[idempotency]\n"+tt.config, "idempotency")
+			if tt.orm {
+				// plugins are registered once the application is created
+				db, err := gorm.Open("sqlite3", ":memory:")
+				if err != nil {
+					t.Fatal(err)
+				}
+				orm := &db
+				defer orm.Close()
+				orm.DB().SetMaxOpenConns(1)
+				err = orm.Exec("CREATE TABLE idempotency_key (id CHAR(76) PRIMARY KEY, fingerprint CHAR(64), done TINYINT(1), status INT, header BLOB, body MEDIUMBLOB, expires INT)").Error
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.RegisterPlugin("orm", valuePlugin{orm})
+			}
+
+			key := map[string]string{"Idempotency-Key": "k1"}
+			request(h, "POST", "/orders", key)
+			w := request(h, "POST", "/orders", key)
+			if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != tt.replay {
+				t.Errorf("retry: got %d Idempotent-Replayed %q, want 201 %q", w.Code, w.Header().Get("Idempotent-Replayed"), tt.replay)
+			}
+			if calls() != tt.calls {
+				t.Errorf("handler called %d times, want %d", calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestNewApplicationRateLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		store  string
+		status int
+	}{
+		{"memory", "memory", http.StatusTooManyRequests},
+		// the redis plugin isn't registered, requests aren't limited
+		{"redis", "redis", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h, _ := newTestApplication(t, "[ratelimit]\nlimit = 1\nstore = \""+tt.store+"\"\n", "ratelimit")
+			request(h, "GET", "/orders", nil)
+			if w := request(h, "GET", "/orders", nil); w.Code != tt.status {
+				t.Errorf("second request: status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+)
+
+// Bind fills the struct pointed to by dst from the request and validates
+// it. Fields are bound according to their tags:
+//
+//	type UpdateUser struct {
+//		ID    int      `path:"id" validate:"required,min=1"`
+//		Force bool     `query:"force"`
+//		Trace string   `header:"X-Trace-Id"`
+//		User  NewUser  `body:"" description:"user details"`
+//	}
+//
+// When no field is tagged body, the request body (if any) is decoded into
+// dst itself. Malformed values return a 400 error, rule violations a 422
+// error; both list every field error in the "errors" member.
+func Bind(req *restful.Request, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind: destination must be a pointer to a struct, got %T", dst)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	// body
+	body := -1
+	for i := 0; i < rt.NumField(); i++ {
+		if _, ok := rt.Field(i).Tag.Lookup("body"); ok {
+			body = i
+		}
+	}
+	if hasBody(req) {
+		target := dst
+		if body >= 0 {
+			target = rv.Field(body).Addr().Interface()
+		}
+		if err := req.ReadEntity(target); err != nil {
+			var ae ApiError
+			if errors.As(err, &ae) {
+				return err // body too large
+			}
+			return WrapError(err, "bad_request", "bind: request body decoding failed", "Malformed request body.")
+		}
+	}
+
+	// parameters
+	errs := ValidationError{}
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		for _, src := range []string{"path", "query", "header"} {
+			name := f.Tag.Get(src)
+			if name == "" {
+				continue
+			}
+			values := paramValues(req, src, name)
+			if len(values) == 0 {
+				continue
+			}
+			if err := setField(rv.Field(i), values); err != nil {
+				errs = append(errs, FieldError{name, "type", err.Error()})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs.ApiError("bad_request")
+	}
+
+	if errs = Validate(dst); len(errs) > 0 {
+		return errs.ApiError("validation_failed")
+	}
+	return nil
+}
+
+// Bind fills dst from the request and validates it. See system.Bind.
+func (ct *Controller) Bind(req *restful.Request, dst interface{}) error {
+	return Bind(req, dst)
+}
+
+func hasBody(req *restful.Request) bool {
+	switch req.Request.Method {
+	case "POST", "PUT", "PATCH":
+		return req.Request.ContentLength != 0
+	}
+	return false
+}
+
+func paramValues(req *restful.Request, src, name string) []string {
+	switch src {
+	case "path":
+		if v, ok := req.PathParameters()[name]; ok {
+			return []string{v}
+		}
+	case "query":
+		return req.Request.URL.Query()[name]
+	case "header":
+		return req.Request.Header[http.CanonicalHeaderKey(name)]
+	}
+	return nil
+}
+
+// setField converts the raw parameter values into the field type.
+func setField(f reflect.Value, values []string) error {
+	if f.Kind() == reflect.Ptr {
+		v := reflect.New(f.Type().Elem())
+		if err := setField(v.Elem(), values); err != nil {
+			return err
+		}
+		f.Set(v)
+		return nil
+	}
+
+	if f.Kind() == reflect.Slice {
+		// accept repeated parameters as well as comma separated lists
+		items := []string{}
+		for _, v := range values {
+			items = append(items, strings.Split(v, ",")...)
+		}
+		s := reflect.MakeSlice(f.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(s.Index(i), item); err != nil {
+				return err
+			}
+		}
+		f.Set(s)
+		return nil
+	}
+
+	return setValue(f, values[0])
+}
+
+func setValue(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a positive integer")
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// DocParams documents the parameters and body of a Bind struct in swagger:
+//
+//	ws.Route(ws.PUT("/users/{id}").Do(system.DocParams(UpdateUser{})).To(ct.Update))
+func DocParams(sample interface{}) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rt := reflect.TypeOf(sample)
+		if rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+
+		bodyFields := false
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if _, ok := f.Tag.Lookup("body"); ok {
+				rb.Reads(reflect.Zero(f.Type).Interface(), f.Tag.Get("description"))
+				continue
+			}
+
+			var p *restful.Parameter
+			switch {
+			case f.Tag.Get("path") != "":
+				p = restful.PathParameter(f.Tag.Get("path"), paramDoc(f))
+			case f.Tag.Get("query") != "":
+				p = restful.QueryParameter(f.Tag.Get("query"), paramDoc(f))
+			case f.Tag.Get("header") != "":
+				p = restful.HeaderParameter(f.Tag.Get("header"), paramDoc(f))
+			default:
+				// untagged fields are decoded from the body
+				bodyFields = bodyFields || f.PkgPath == ""
+				continue
+			}
+			p.DataType(dataType(f.Type))
+			p.Required(hasRule(f, "required") || f.Tag.Get("path") != "")
+			if f.Type.Kind() == reflect.Slice {
+				p.AllowMultiple(true)
+			}
+			rb.Param(p)
+		}
+
+		if bodyFields {
+			rb.Reads(reflect.Zero(rt).Interface())
+		}
+
+		rb.ReturnsError(400, "Bad Request (bad_request)", ProblemDetails{})
+		rb.ReturnsError(422, "Validation Failed (validation_failed)", ProblemDetails{})
+	}
+}
+
+// paramDoc builds a parameter description including its validation rules.
+func paramDoc(f reflect.StructField) string {
+	doc := f.Tag.Get("description")
+	if rules := f.Tag.Get("validate"); rules != "" {
+		if doc != "" {
+			doc += " "
+		}
+		doc += "(" + strings.Join(splitRules(rules), ", ") + ")"
+	}
+	return doc
+}
+
+func hasRule(f reflect.StructField, rule string) bool {
+	for _, r := range splitRules(f.Tag.Get("validate")) {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func dataType(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return "string"
+}
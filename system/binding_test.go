@@ -0,0 +1,92 @@
+package system
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+type bindTestUser struct {
+	Name string `json:"name" validate:"required"`
+	Age  int    `json:"age" validate:"min=18"`
+}
+
+type bindTestRequest struct {
+	ID    int          `path:"id" validate:"min=1"`
+	Force bool         `query:"force"`
+	Tags  []string     `query:"tag"`
+	Limit *int         `query:"limit" validate:"max=100"`
+	Trace string       `header:"X-Trace-Id"`
+	User  bindTestUser `body:""`
+}
+
+// bind binds a PUT /users/{id} request.
+func bind(url, body string, header map[string]string) (*bindTestRequest, error) {
+	dst := &bindTestRequest{}
+	var err error
+	ws := new(restful.WebService).Path("/users")
+	ws.Route(ws.PUT("/{id}").To(func(req *restful.Request, resp *restful.Response) {
+		err = Bind(req, dst)
+	}))
+	c := restful.NewContainer()
+	c.Add(ws)
+
+	r := httptest.NewRequest("PUT", url, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	c.ServeHTTP(httptest.NewRecorder(), r)
+	return dst, err
+}
+
+func TestBind(t *testing.T) {
+	limit := 10
+	tests := []struct {
+		name   string
+		url    string
+		body   string
+		want   *bindTestRequest
+		status int
+		errs   []string
+	}{
+		{"parameters and body", "/users/5?force=true&tag=a,b&tag=c&limit=10", `{"name":"bob","age":30}`,
+			&bindTestRequest{5, true, []string{"a", "b", "c"}, &limit, "t1", bindTestUser{"bob", 30}}, 0, nil},
+		{"path type", "/users/x", `{"name":"bob","age":30}`, nil, 400, []string{"id"}},
+		{"query types", "/users/5?force=maybe&limit=many", `{"name":"bob","age":30}`, nil, 400, []string{"force", "limit"}},
+		{"malformed body", "/users/5", `{"name":`, nil, 400, nil},
+		{"validation", "/users/0?limit=1000", `{"age":0}`, nil, 422, []string{"id", "limit", "User.name", "User.age"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bind(tt.url, tt.body, map[string]string{"X-Trace-Id": "t1"})
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("bound %+v, want %+v", got, tt.want)
+				}
+				return
+			}
+
+			ae, ok := err.(ApiError)
+			if !ok || ae.Code != tt.status {
+				t.Fatalf("error %v, want a %d", err, tt.status)
+			}
+			if tt.errs == nil {
+				return
+			}
+			fields := []string{}
+			for _, fe := range ae.Extensions["errors"].([]FieldError) {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.errs) {
+				t.Errorf("field errors %v, want %v", fields, tt.errs)
+			}
+		})
+	}
+}
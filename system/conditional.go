@@ -0,0 +1,138 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ETag quotes value as an entity tag, weak tags are prefixed with W/.
+func ETag(value string, weak bool) string {
+	if weak {
+		return `W/"` + value + `"`
+	}
+	return `"` + value + `"`
+}
+
+// HashETag returns the entity tag of a representation.
+func HashETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	return ETag(hex.EncodeToString(sum[:16]), weak)
+}
+
+// VersionETag returns the strong entity tag of a resource version, which
+// changes whenever the resource does.
+func VersionETag(version interface{}) string {
+	return ETag(fmt.Sprintf("v%v", version), false)
+}
+
+// ETagMatches reports whether an If-Match or If-None-Match header lists
+// etag. Strong comparison is used for If-Match, weak comparison for
+// If-None-Match.
+func ETagMatches(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "*":
+			return true
+		case weak:
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		case tag == etag && !strings.HasPrefix(tag, "W/"):
+			return true
+		}
+	}
+	return false
+}
+
+// EvaluateConditions evaluates the preconditions of a request against the
+// current validators of the resource in the order of RFC 7232 section 6.
+// It returns 0 when the request may proceed, 304 or 412 otherwise. An
+// empty etag means the resource doesn't exist, a zero time that its
+// modification date is unknown.
+func EvaluateConditions(req *restful.Request, etag string, modified time.Time) int {
+	h := req.Request.Header
+	modified = modified.Truncate(time.Second)
+
+	if im := h.Get("If-Match"); im != "" {
+		if !ETagMatches(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := h.Get("If-Unmodified-Since"); ius != "" && !modified.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && modified.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if inm := h.Get("If-None-Match"); inm != "" {
+		if ETagMatches(inm, etag, true) {
+			if isSafe(req) {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := h.Get("If-Modified-Since"); ims != "" && isSafe(req) && !modified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modified.After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// CheckConditions evaluates the request preconditions and, for GET and HEAD
+// requests, sets the ETag and Last-Modified headers of the response. It
+// returns false after writing a 304 or 412 response, in which case the
+// handler must stop:
+//
+//	if !ct.CheckConditions(req, resp, system.VersionETag(u.Version), u.UpdatedAt) {
+//		return
+//	}
+func CheckConditions(req *restful.Request, resp *restful.Response, etag string, modified time.Time) bool {
+	if isSafe(req) {
+		if etag != "" {
+			resp.Header().Set("ETag", etag)
+		}
+		if !modified.IsZero() {
+			resp.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	switch EvaluateConditions(req, etag, modified) {
+	case http.StatusNotModified:
+		resp.WriteHeader(http.StatusNotModified)
+		return false
+	case http.StatusPreconditionFailed:
+		WriteRequestError(PreconditionError(req), req, resp)
+		return false
+	}
+	return true
+}
+
+// CheckConditions evaluates the request preconditions. See
+// system.CheckConditions.
+func (ct *Controller) CheckConditions(req *restful.Request, resp *restful.Response, etag string, modified time.Time) bool {
+	return CheckConditions(req, resp, etag, modified)
+}
+
+// PreconditionError is the error of requests whose preconditions failed.
+func PreconditionError(req *restful.Request) error {
+	return NewTypedError(
+		"precondition_failed",
+		fmt.Sprintf("%s %s: precondition failed", req.Request.Method, req.Request.URL.Path),
+		"The resource was modified, reload it and try again.",
+	)
+}
+
+func isSafe(req *restful.Request) bool {
+	return req.Request.Method == "GET" || req.Request.Method == "HEAD"
+}
@@ -0,0 +1,118 @@
+package system
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+)
+
+type contextKey int
+
+const (
+	requestIDContextKey contextKey = iota
+	principalContextKey
+	traceContextKey
+	applicationContextKey
+)
+
+// Context returns the context of a request. It is canceled when the client
+// goes away or a deadline set by the Timeout filter passes, and carries the
+// request ID, principal and trace span once the middleware set them. Pass
+// it to backends so that abandoned requests stop their work:
+//
+//	rows, err := plugins.SQLQuery(system.Context(req), db, query)
+func Context(req *restful.Request) context.Context {
+	return req.Request.Context()
+}
+
+// Context returns the context of a request, see system.Context.
+func (ct *Controller) Context(req *restful.Request) context.Context {
+	return Context(req)
+}
+
+// withValue adds a value to the request context.
+func withValue(req *restful.Request, key, v interface{}) {
+	req.Request = req.Request.WithContext(context.WithValue(req.Request.Context(), key, v))
+}
+
+// applicationFilter makes the application serving a request known to
+// WriteResponse and WriteRequestError, for its encoders and error format.
+func (a *Application) applicationFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	withValue(req, applicationContextKey, a)
+	chain.ProcessFilter(req, resp)
+}
+
+// applicationOf returns the application serving req, nil if unknown.
+func applicationOf(req *restful.Request) *Application {
+	if req == nil {
+		return nil
+	}
+	a, _ := req.Request.Context().Value(applicationContextKey).(*Application)
+	return a
+}
+
+// SetRequestID stores the request ID on the request and its context.
+func SetRequestID(req *restful.Request, id string) {
+	req.SetAttribute(RequestIDKey, id)
+	withValue(req, requestIDContextKey, id)
+}
+
+// RequestIDFrom returns the request ID a context carries, "" if none.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// PrincipalFrom returns the principal a context carries, nil for anonymous
+// requests.
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey).(*Principal)
+	return p
+}
+
+// SetTrace stores the trace span of the request in its context.
+func SetTrace(req *restful.Request, t *Trace) {
+	withValue(req, traceContextKey, t)
+}
+
+// TraceFrom returns the trace span a context carries, nil if none.
+func TraceFrom(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceContextKey).(*Trace)
+	return t
+}
+
+// WithTrace returns a context carrying the trace span t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceContextKey, t)
+}
+
+// Detach returns a context for work outliving the request, like jobs: it
+// keeps the request ID, principal and trace, as a child span, but not the
+// cancellation and deadline of ctx.
+func Detach(ctx context.Context) context.Context {
+	d := context.Background()
+	if id := RequestIDFrom(ctx); id != "" {
+		d = context.WithValue(d, requestIDContextKey, id)
+	}
+	if p := PrincipalFrom(ctx); p != nil {
+		d = context.WithValue(d, principalContextKey, p)
+	}
+	if t := TraceFrom(ctx); t != nil {
+		d = WithTrace(d, NewTrace(t))
+	}
+	return d
+}
+
+// Logger returns a logger tagged with the request ID and trace of ctx.
+func Logger(ctx context.Context) *log.Entry {
+	fields := log.Fields{}
+	if id := RequestIDFrom(ctx); id != "" {
+		fields["request_id"] = id
+	}
+	if t := TraceFrom(ctx); t != nil {
+		fields["trace_id"] = t.TraceID
+		fields["span_id"] = t.SpanID
+	}
+	return log.WithFields(fields)
+}
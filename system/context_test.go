@@ -0,0 +1,140 @@
+package system
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+const testTraceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestContext(t *testing.T) {
+	p := &Principal{ID: "42"}
+	tests := []struct {
+		name      string
+		id        string
+		principal *Principal
+		trace     *Trace
+	}{
+		{"empty", "", nil, nil},
+		{"request ID", "host/abc-000001", nil, nil},
+		{"principal and trace", "host/abc-000002", p, NewTrace(ParseTraceparent(testTraceparent))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, cancel := context.WithCancel(context.Background())
+			req := restful.NewRequest(httptest.NewRequest("GET", "/notes", nil).WithContext(parent))
+			if tt.id != "" {
+				SetRequestID(req, tt.id)
+			}
+			if tt.principal != nil {
+				SetPrincipal(req, tt.principal)
+			}
+			if tt.trace != nil {
+				SetTrace(req, tt.trace)
+			}
+
+			ctx := Context(req)
+			if RequestIDFrom(ctx) != tt.id || PrincipalFrom(ctx) != tt.principal || TraceFrom(ctx) != tt.trace {
+				t.Errorf("context carries %q %v %v, want %q %v %v",
+					RequestIDFrom(ctx), PrincipalFrom(ctx), TraceFrom(ctx), tt.id, tt.principal, tt.trace)
+			}
+			// setting values keeps the cancellation of the request
+			cancel()
+			if ctx.Err() != context.Canceled {
+				t.Errorf("context error %v after the request is canceled", ctx.Err())
+			}
+		})
+	}
+}
+
+func TestDetach(t *testing.T) {
+	p := &Principal{ID: "42"}
+	parentTrace := NewTrace(ParseTraceparent(testTraceparent))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx = context.WithValue(ctx, requestIDContextKey, "host/abc-000001")
+	ctx = context.WithValue(ctx, principalContextKey, p)
+	ctx = WithTrace(ctx, parentTrace)
+
+	d := Detach(ctx)
+	cancel()
+	if d.Err() != nil {
+		t.Errorf("detached context canceled with its parent: %v", d.Err())
+	}
+	if _, ok := d.Deadline(); ok {
+		t.Error("detached context keeps the deadline of its parent")
+	}
+	if RequestIDFrom(d) != "host/abc-000001" || PrincipalFrom(d) != p {
+		t.Errorf("detached context carries %q %v", RequestIDFrom(d), PrincipalFrom(d))
+	}
+	tr := TraceFrom(d)
+	if tr == nil || tr.TraceID != parentTrace.TraceID || tr.ParentID != parentTrace.SpanID || tr.SpanID == parentTrace.SpanID || !tr.Sampled {
+		t.Errorf("detached trace %+v, want a child span of %+v", tr, parentTrace)
+	}
+
+	if d := Detach(context.Background()); RequestIDFrom(d) != "" || PrincipalFrom(d) != nil || TraceFrom(d) != nil {
+		t.Error("detaching an empty context added values")
+	}
+}
+
+func TestTraceInheritance(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		trace   string
+		parent  string
+		sampled bool
+	}{
+		{"caller trace", testTraceparent, "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", true},
+		{"not sampled", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", false},
+		{"upper case", "00-0AF7651916CD43DD8448EB211C80319C-B7AD6B7169203331-01", "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", true},
+		{"missing", "", "", "", false},
+		{"zero trace", "00-00000000000000000000000000000000-b7ad6b7169203331-01", "", "", false},
+		{"zero span", "00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", "", "", false},
+		{"garbage", "00-xyz-b7ad6b7169203331-01", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTrace(ParseTraceparent(tt.header))
+			if len(tr.TraceID) != 32 || len(tr.SpanID) != 16 {
+				t.Fatalf("trace %+v", tr)
+			}
+			if tt.trace != "" && tr.TraceID != tt.trace {
+				t.Errorf("trace ID %s, want %s", tr.TraceID, tt.trace)
+			}
+			if tr.ParentID != tt.parent || tr.Sampled != tt.sampled {
+				t.Errorf("parent %q sampled %v, want %q %v", tr.ParentID, tr.Sampled, tt.parent, tt.sampled)
+			}
+			// the span propagates to services called within it
+			if next := ParseTraceparent(tr.Traceparent()); next == nil || next.TraceID != tr.TraceID || next.SpanID != tr.SpanID {
+				t.Errorf("traceparent %s doesn't round trip", tr.Traceparent())
+			}
+		})
+	}
+}
+
+func TestContextJobQueue(t *testing.T) {
+	ct := &Controller{}
+	ct.Register(restful.NewContainer())
+	err := ct.NewContextJobQueue("mail", func(ctx context.Context, p JobParams) interface{} {
+		return []interface{}{RequestIDFrom(ctx), ctx.Err(), p["to"]}
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestIDContextKey, "host/abc-000001"))
+	j := NewAsyncJobContext(ctx, make(chan interface{}, 1))
+	j.Set("to", "a@example.com")
+	cancel()
+	if err := ct.AddJob("mail", j); err != nil {
+		t.Fatal(err)
+	}
+	got := (<-j.Result).([]interface{})
+	if got[0] != "host/abc-000001" || got[1] != nil || got[2] != "a@example.com" {
+		t.Errorf("worker got request ID %v, error %v, params %v", got[0], got[1], got[2])
+	}
+}
@@ -1,8 +1,12 @@
 package system
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
 	"github.com/pelletier/go-toml"
 )
@@ -11,17 +15,34 @@ type JobParams map[string]interface{}
 
 type AsyncJob struct {
 	params JobParams
+	ctx    context.Context
 	Result chan interface{}
 }
 
 func NewAsyncJob(c chan interface{}) *AsyncJob {
 	j := AsyncJob{
 		params: JobParams{},
+		ctx:    context.Background(),
 		Result: c,
 	}
 	return &j
 }
 
+// NewAsyncJobContext returns a job keeping the request ID, principal and
+// trace of ctx, but not its cancellation: jobs may outlive their request.
+//
+//	j := system.NewAsyncJobContext(ct.Context(req), make(chan interface{}))
+func NewAsyncJobContext(ctx context.Context, c chan interface{}) *AsyncJob {
+	j := NewAsyncJob(c)
+	j.ctx = Detach(ctx)
+	return j
+}
+
+// Context returns the context of the job.
+func (a *AsyncJob) Context() context.Context {
+	return a.ctx
+}
+
 func (a *AsyncJob) Get(k string) interface{} {
 	return a.params[k]
 }
@@ -33,19 +54,148 @@ func (a *AsyncJob) Set(k string, v interface{}) {
 type Controller struct {
 	jobQueues  map[string]chan *AsyncJob
 	registered bool
+	container  *restful.Container
+	app        *Application
+	name       string
+	prefix     string
+	version    string
+}
+
+// AppController is the interface of controllers: structs embedding
+// Controller which add their web services in Register. See
+// Application.RegisterController.
+type AppController interface {
+	Register(container *restful.Container)
+	controller() *Controller
 }
 
 type AsyncWorker func(p JobParams) interface{}
 
+// AsyncContextWorker is a worker receiving the context of the job.
+type AsyncContextWorker func(ctx context.Context, p JobParams) interface{}
+
+// Register prepares the controller, controllers embedding Controller call
+// it first from their own Register.
 func (ct *Controller) Register(container *restful.Container) {
 	if ct.registered {
 		return
 	}
 	ct.jobQueues = map[string]chan *AsyncJob{}
+	ct.container = container
 	ct.registered = true
 }
 
+func (ct *Controller) controller() *Controller {
+	return ct
+}
+
+// RegisterController registers a controller: it injects the application
+// and the plugins named by its `inject:"<plugin>"` field tags, then calls
+// its Register with the application container, and registers the
+// lifecycle hooks it implements (OnStart, OnReady, OnShutdown, OnStop).
+// Routes of web services created with Controller.WebService are served
+// under prefix, e.g. "/api/v1":
+//
+//	app.RegisterController(&MainController{}, "/api/v1")
+func (a *Application) RegisterController(ct AppController, prefix string) {
+	a.RegisterVersionedController(ct, prefix, "")
+}
+
+// RegisterVersionedController registers a controller of an API version, see
+// Application.VersionedWebService. Its web services are rooted under
+// prefix and version, e.g. /api/v2/users, and also serve /api/users to
+// requests selecting the version by header or media type:
+//
+//	app.RegisterVersionedController(&UsersV1{}, "/api", "v1")
+//	app.RegisterVersionedController(&UsersV2{}, "/api", "v2")
+func (a *Application) RegisterVersionedController(ct AppController, prefix, version string) {
+	base := ct.controller()
+	if base.app != nil {
+		log.Fatalf("Controller %s already registered", base.name)
+	}
+	base.app = a
+	base.name = reflect.Indirect(reflect.ValueOf(ct)).Type().Name()
+	base.prefix = "/" + strings.Trim(prefix, "/")
+	if base.prefix == "/" {
+		base.prefix = ""
+	}
+	base.version = version
+	if err := a.inject(ct); err != nil {
+		log.Fatalf("Controller %s registration failed:\n%s", base.name, err)
+	}
+
+	ct.Register(a.Container)
+	a.AddHooks(base.name, ct)
+	log.Debugf("Controller %s %s registered under %q", base.name, version, base.prefix+"/")
+}
+
+// App returns the application the controller was registered with, nil when
+// it was registered by hand.
+func (ct *Controller) App() *Application {
+	return ct.app
+}
+
+// Config returns the application configuration.
+func (ct *Controller) Config() *toml.TomlTree {
+	if ct.app == nil {
+		return nil
+	}
+	return ct.app.Config
+}
+
+// Plugin returns the application plugin n, see Application.GetPlugin.
+func (ct *Controller) Plugin(n string) interface{} {
+	if ct.app == nil {
+		return nil
+	}
+	return ct.app.GetPlugin(n)
+}
+
+// Log returns a logger tagged with the controller name.
+func (ct *Controller) Log() *log.Entry {
+	return log.WithField("controller", ct.name)
+}
+
+// Prefix returns the path prefix of the controller routes.
+func (ct *Controller) Prefix() string {
+	return ct.prefix
+}
+
+// Version returns the API version of the controller, "" if unversioned.
+func (ct *Controller) Version() string {
+	return ct.version
+}
+
+// WebService returns a new web service rooted at path under the controller
+// prefix and version.
+func (ct *Controller) WebService(path string) *restful.WebService {
+	if ct.version != "" {
+		return ct.app.versionedWebService(ct.prefix, ct.version, path)
+	}
+	root := ct.prefix + "/" + strings.Trim(path, "/")
+	if root != "/" {
+		root = strings.TrimSuffix(root, "/")
+	}
+	return new(restful.WebService).Path(root)
+}
+
+// Add adds web services to the container the controller was registered
+// with.
+func (ct *Controller) Add(services ...*restful.WebService) {
+	for _, ws := range services {
+		ct.container.Add(ws)
+	}
+}
+
 func (ct *Controller) NewJobQueue(n string, w AsyncWorker, c int) error {
+	return ct.NewContextJobQueue(n, func(ctx context.Context, p JobParams) interface{} {
+		return w(p)
+	}, c)
+}
+
+// NewContextJobQueue creates a job queue whose workers receive the context
+// of each job, see NewAsyncJobContext.
+func (ct *Controller) NewContextJobQueue(n string, w AsyncContextWorker, c int) error {
 	_, ok := ct.jobQueues[n]
 	if ok {
 		return fmt.Errorf("Job Queue %q already exists", n)
@@ -55,9 +205,9 @@ func (ct *Controller) NewJobQueue(n string, w AsyncWorker, c int) error {
 
 	// create worker goroutines
 	for i := 0; i < c; i++ {
-		go func(q chan *AsyncJob, w AsyncWorker) {
+		go func(q chan *AsyncJob, w AsyncContextWorker) {
 			for job := range q {
-				r := w(job.params)
+				r := w(job.ctx, job.params)
 				job.Result <- r
 			}
 		}(q, w)
@@ -85,9 +235,34 @@ func (ct *Controller) GetConfig(req *restful.Request) *toml.TomlTree {
 		val := tmp.(*toml.TomlTree)
 		return val
 	}
-	return nil
+	return ct.Config()
 }
 
+// GetPlugin returns the plugin the plugins middleware set on the request,
+// or the application plugin when the middleware is disabled.
 func (ct *Controller) GetPlugin(name string, req *restful.Request) interface{} {
-	return req.Attribute(name)
+	if p := req.Attribute(name); p != nil {
+		return p
+	}
+	return ct.Plugin(name)
+}
+
+func (ct *Controller) GetPrincipal(req *restful.Request) *Principal {
+	return GetPrincipal(req)
+}
+
+// Write renders v with a 200 status in the format negotiated from the
+// request Accept header.
+func (ct *Controller) Write(req *restful.Request, resp *restful.Response, v interface{}) error {
+	return WriteResponse(req, resp, 200, v)
+}
+
+// WriteStatus renders v with the given status in the negotiated format.
+func (ct *Controller) WriteStatus(req *restful.Request, resp *restful.Response, status int, v interface{}) error {
+	return WriteResponse(req, resp, status, v)
+}
+
+// WriteError renders err in the negotiated format.
+func (ct *Controller) WriteError(req *restful.Request, resp *restful.Response, err error) {
+	WriteRequestError(err, req, resp)
 }
@@ -0,0 +1,124 @@
+package system
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+// notesController serves /notes under its prefix, answering with the
+// controller prefix and the plugin "db".
+type notesController struct {
+	Controller
+	DB string `inject:"db"`
+}
+
+func (ct *notesController) Register(container *restful.Container) {
+	ct.Controller.Register(container)
+	ws := ct.WebService("/notes")
+	ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte(ct.Prefix() + " " + ct.DB + " " + ct.Plugin("db").(string)))
+	}))
+	ct.Add(ws)
+}
+
+func TestRegisterController(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		path   string
+		status int
+		body   string
+	}{
+		{"prefix", "/api/v1", "/api/v1/notes", 200, "/api/v1 main main"},
+		{"prefix without slashes", "api/v1", "/api/v1/notes", 200, "/api/v1 main main"},
+		{"prefix with a trailing slash", "/api/v1/", "/api/v1/notes", 200, "/api/v1 main main"},
+		{"root", "/", "/notes", 200, " main main"},
+		{"empty", "", "/notes", 200, " main main"},
+		{"outside the prefix", "/api/v1", "/notes", 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, "")
+			a.RegisterPlugin("db", injectPlugin{"main"})
+			ct := &notesController{}
+			a.RegisterController(ct, tt.prefix)
+			if ct.App() != a || ct.Config() != a.Config || ct.name != "notesController" {
+				t.Errorf("controller registered with app %p config %p name %q", ct.App(), ct.Config(), ct.name)
+			}
+
+			w := httptest.NewRecorder()
+			a.handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestControllerWebService(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		root   string
+	}{
+		{"/api", "/users", "/api/users"},
+		{"/api", "users/", "/api/users"},
+		{"/api", "", "/api"},
+		{"", "/users", "/users"},
+		{"", "", "/"},
+	}
+	for _, tt := range tests {
+		ct := &Controller{prefix: tt.prefix}
+		if root := ct.WebService(tt.path).RootPath(); root != tt.root {
+			t.Errorf("%q under %q: root %q, want %q", tt.path, tt.prefix, root, tt.root)
+		}
+	}
+}
+
+// hookedController runs lifecycle hooks, recording them in log.
+type hookedController struct {
+	Controller
+	log *hookLog
+}
+
+func (ct *hookedController) OnStart(ctx context.Context) error {
+	return ct.log.hook(ct.name+" start", nil)(ctx)
+}
+
+func (ct *hookedController) OnShutdown(ctx context.Context) error {
+	return ct.log.hook(ct.name+" shutdown", nil)(ctx)
+}
+
+// usersController is a second controller with hooks.
+type usersController struct {
+	hookedController
+}
+
+func TestControllerHooks(t *testing.T) {
+	a := newTestApp(t, "")
+	a.RegisterPlugin("db", injectPlugin{"main"})
+	l := &hookLog{}
+	a.OnStart("db", l.hook("db start", nil))
+	a.OnShutdown("db", l.hook("db shutdown", nil))
+	a.RegisterController(&hookedController{log: l}, "/api")
+	a.RegisterController(&usersController{hookedController{log: l}}, "/api")
+	// controllers without hooks take no part
+	a.RegisterController(&notesController{}, "/api")
+
+	for _, p := range []Phase{PreStart, PostListen, PreShutdown, PostShutdown} {
+		if errs := a.runHooks(p); len(errs) != 0 {
+			t.Errorf("%s: %v", p, errs)
+		}
+	}
+	want := []string{
+		"db start", "hookedController start", "usersController start",
+		"usersController shutdown", "hookedController shutdown", "db shutdown",
+	}
+	if got := l.names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
@@ -1,22 +1,33 @@
 package system
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"net/http"
-	"time"
+	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful/swagger"
 	"github.com/pelletier/go-toml"
-	"gopkg.in/tylerb/graceful.v1"
 )
 
 type Application struct {
 	Config      *toml.TomlTree
 	Container   *restful.Container
+	Middleware  *MiddlewareRegistry
 	pluginsRepo map[string]Plugin
+	routes      map[string]*restful.Route
+	routesOnce  sync.Once
+	wrappers    []func(http.Handler) http.Handler
+	servers     []*server
+	stopping    sync.Once
+	lifecycle   lifecycle
+	versioning  versioning
+	upgraded    int32
+	errors      errorFormat
+	encoders    *encoderRegistry
 }
 
 type Plugin interface {
@@ -42,6 +53,15 @@ func (a *Application) RegisterPlugin(n string, p Plugin) {
 	a.pluginsRepo[n] = p
 }
 
+// GetPlugin returns the resource managed by a registered plugin or nil.
+func (a *Application) GetPlugin(n string) interface{} {
+	p, ok := a.pluginsRepo[n]
+	if !ok {
+		return nil
+	}
+	return p.Get()
+}
+
 func (a *Application) Init(filename string) {
 	// load config file
 	config, err := toml.LoadFile(filename)
@@ -50,46 +70,82 @@ func (a *Application) Init(filename string) {
 	}
 	a.Config = config
 
+	// error responses
+	a.SetErrorFormat(
+		config.GetDefault("errors.format", ErrorFormatLegacy).(string),
+		config.GetDefault("errors.type_base_uri", "").(string),
+	)
+
+	if a.encoders == nil {
+		a.encoders = newEncoderRegistry()
+	}
+
 	// init plugin repository
 	a.pluginsRepo = map[string]Plugin{}
 
 	// init web service container
 	a.initWSContainer()
+
+	// init middleware registry
+	a.Middleware = newMiddlewareRegistry(config)
 }
 
 func (a *Application) serviceAddress() string {
 	addr := fmt.Sprintf(
 		"%s:%d",
 		a.Config.GetDefault("app.address", "localhost").(string),
-		a.Config.GetDefault("app.port", 8000).(int64),
+		a.Config.GetDefault("app.port", int64(8000)).(int64),
 	)
 	return addr
 }
 
 func (a *Application) Start() {
+	// Install global middleware
+	for _, mw := range a.Middleware.global() {
+		a.Container.Filter(mw.Filter)
+	}
+
 	// Initialize swagger
 	a.initSwagger()
 
-	addr := a.serviceAddress()
-	t := time.Duration(a.Config.GetDefault("app.shutdown_timeout", 5).(int64))
-
-	srv := &graceful.Server{
-		Timeout: t * time.Second,
-		Server: &http.Server{
-			Addr:    addr,
-			Handler: a.Container,
-		},
-		ShutdownInitiated: func() {
-			a.stop()
-		},
-	}
-	msg := fmt.Sprintf(
-		"Starting %s on http://%s",
-		a.Config.GetDefault("app.name", "server"),
-		addr,
-	)
-	log.Info(msg)
-	srv.ListenAndServe()
+	// index routes for middleware lookups
+	a.routesOnce.Do(a.indexRoutes)
+
+	if a.Config.GetDefault("middleware.debug", false).(bool) {
+		a.logMiddleware()
+	}
+
+	if errs := a.runHooks(PreStart); len(errs) > 0 {
+		log.Fatalf("Start aborted, %d pre-start hook(s) failed", len(errs))
+	}
+
+	var tlsConfig *tls.Config
+	if a.Config.Has("tls") {
+		var err error
+		tlsConfig, err = newTLSConfig(a.Config)
+		checkErr(err, "TLS configuration failed:")
+	}
+
+	ls, err := a.openListeners()
+	checkErr(err, "Listen failed:")
+
+	log.Infof("Starting %s", a.Config.GetDefault("app.name", "server"))
+	a.serve(ls, tlsConfig)
+}
+
+// WrapHandler adds a net/http level wrapper around the container. Wrappers
+// see every request, including those served outside go-restful web services
+// such as the swagger UI files. The first wrapper added is the outermost.
+func (a *Application) WrapHandler(w func(http.Handler) http.Handler) {
+	a.wrappers = append(a.wrappers, w)
+}
+
+func (a *Application) handler() http.Handler {
+	h := a.versionRouter(a.Container)
+	for i := len(a.wrappers) - 1; i >= 0; i-- {
+		h = a.wrappers[i](h)
+	}
+	return h
 }
 
 // Make plugins available to controllers with this middleware
@@ -110,11 +166,40 @@ func (a *Application) initWSContainer() {
 	container := restful.NewContainer()
 	container.EnableContentEncoding(true)
 	container.DoNotRecover(true)
+	container.ServiceErrorHandler(a.serviceError)
+	container.Filter(a.applicationFilter)
 
 	a.Container = container
 }
 
+// SelectedRoute returns the route matched for the request or nil. Routes
+// are indexed on first use, at the latest when the application starts, so
+// web services must be registered before.
+func (a *Application) SelectedRoute(req *restful.Request) *restful.Route {
+	a.routesOnce.Do(a.indexRoutes)
+	return a.routes[req.Request.Method+" "+req.SelectedRoutePath()]
+}
+
+func (a *Application) indexRoutes() {
+	a.routes = map[string]*restful.Route{}
+	for _, ws := range a.Container.RegisteredWebServices() {
+		routes := ws.Routes()
+		for i := range routes {
+			r := &routes[i]
+			a.routes[r.Method+" "+r.Path] = r
+		}
+	}
+}
+
+// Log the effective middleware chain of every route
+func (a *Application) logMiddleware() {
+	for _, rc := range a.Middleware.Routes(a.Container) {
+		log.Infof("%-7s %s -> %s", rc.Method, rc.Path, strings.Join(rc.Filters, ", "))
+	}
+}
+
 func (a *Application) initSwagger() {
+	a.docErrorBodies()
 	swconfig := swagger.Config{
 		WebServices:     a.Container.RegisteredWebServices(),
 		WebServicesUrl:  a.Config.Get("swagger.ws_url").(string),
@@ -123,11 +208,14 @@ func (a *Application) initSwagger() {
 		SwaggerFilePath: a.Config.Get("swagger.file_path").(string),
 	}
 	swagger.RegisterSwaggerService(swconfig, a.Container)
+	a.initVersionSwagger()
 }
 
 func (a *Application) stop() {
 	log.Info("Shutting down service...")
 
+	a.runHooks(PostShutdown)
+
 	// stop plugins
 	for _, v := range a.pluginsRepo {
 		if err := v.Close(); err != nil {
@@ -143,52 +231,3 @@ func checkErr(err error, msg string) {
 		log.Fatalln(msg, err)
 	}
 }
-
-type ApiError struct {
-	SystemMessage string
-	ClientMessage interface{}
-	Code          int
-}
-
-func (e ApiError) Error() string {
-	return e.SystemMessage
-}
-
-func NewApiError(sm string, cm interface{}, code int) error {
-	return ApiError{sm, cm, code}
-}
-
-func errorResponse(msg interface{}, code int) []byte {
-	res := map[string]interface{}{
-		"status": "error",
-		"msg":    msg,
-		"code":   code,
-	}
-	var b []byte
-	var err error
-	b, err = json.Marshal(res)
-	if err != nil {
-		return []byte{}
-	}
-	return b
-}
-
-func WriteError(err error, r *restful.Response) {
-	log.Error(err)
-
-	ae, ok := err.(ApiError)
-	var b []byte
-	var status int
-
-	if !ok {
-		msg := "Internal Server Error. Please report to admin."
-		status = 500
-		b = errorResponse(msg, 500)
-	} else {
-		status = ae.Code
-		b = errorResponse(ae.ClientMessage, ae.Code)
-	}
-
-	r.AddHeader("Content-Type", "application/json")
-	r.WriteErrorString(status, string(b))
-}
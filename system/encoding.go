@@ -0,0 +1,277 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emicklei/go-restful"
+	"github.com/ugorji/go/codec"
+)
+
+// Encoder renders response payloads for one media type.
+type Encoder interface {
+	MediaType() string
+	Encode(w io.Writer, v interface{}) error
+}
+
+// encoderRegistry holds the encoders of an application in order of
+// registration.
+type encoderRegistry struct {
+	sync.RWMutex
+	list []Encoder
+}
+
+func newEncoderRegistry() *encoderRegistry {
+	r := &encoderRegistry{}
+	r.register(JSONEncoder{})
+	r.register(XMLEncoder{})
+	r.register(MsgpackEncoder{})
+	r.register(CBOREncoder{})
+	return r
+}
+
+// defaultEncoders serve requests outside an application, never modified.
+var defaultEncoders = newEncoderRegistry()
+
+func (r *encoderRegistry) register(e Encoder) {
+	r.Lock()
+	defer r.Unlock()
+	for i, ex := range r.list {
+		if ex.MediaType() == e.MediaType() {
+			r.list[i] = e
+			return
+		}
+	}
+	r.list = append(r.list, e)
+}
+
+// RegisterEncoder adds an encoder used for content negotiation, replacing
+// the one of the same media type. JSON, XML, MessagePack and CBOR are
+// registered, JSON first as the default for clients accepting anything.
+func (a *Application) RegisterEncoder(e Encoder) {
+	if a.encoders == nil {
+		a.encoders = newEncoderRegistry()
+	}
+	a.encoders.register(e)
+}
+
+// encodersOf returns the encoders of the application serving req.
+func encodersOf(req *restful.Request) *encoderRegistry {
+	if a := applicationOf(req); a != nil && a.encoders != nil {
+		return a.encoders
+	}
+	return defaultEncoders
+}
+
+type mediaRange struct {
+	typ string
+	q   float64
+}
+
+// parseAccept returns the media ranges of an Accept header sorted by
+// preference.
+func parseAccept(accept string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mr := mediaRange{strings.ToLower(strings.TrimSpace(fields[0])), 1}
+		if mr.typ == "" {
+			continue
+		}
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+		if mr.q > 0 {
+			ranges = append(ranges, mr)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+// Negotiate selects the encoder for the Accept header of a request.
+// Structured syntax suffixes such as application/vnd.app.v2+json match the
+// encoder of the suffix. It reports false when no encoder is acceptable.
+func Negotiate(req *restful.Request) (Encoder, bool) {
+	list := encodersOf(req).acceptable(req.HeaderParameter("Accept"))
+	if len(list) == 0 {
+		return nil, false
+	}
+	return list[0], true
+}
+
+// acceptable returns the encoders matching an Accept header by preference.
+func (r *encoderRegistry) acceptable(accept string) []Encoder {
+	r.RLock()
+	defer r.RUnlock()
+
+	if strings.TrimSpace(accept) == "" {
+		return append([]Encoder{}, r.list...)
+	}
+
+	list := []Encoder{}
+	added := map[string]bool{}
+	add := func(e Encoder) {
+		if !added[e.MediaType()] {
+			added[e.MediaType()] = true
+			list = append(list, e)
+		}
+	}
+	for _, mr := range parseAccept(accept) {
+		suffix := ""
+		if i := strings.LastIndex(mr.typ, "+"); i > 0 {
+			suffix = "/" + mr.typ[i+1:]
+		}
+		for _, e := range r.list {
+			mt := e.MediaType()
+			switch {
+			case mr.typ == "*/*", mr.typ == mt:
+				add(e)
+			case strings.HasSuffix(mr.typ, "/*") && strings.HasPrefix(mt, mr.typ[:len(mr.typ)-1]):
+				add(e)
+			case suffix != "" && strings.HasSuffix(mt, suffix):
+				add(e)
+			}
+		}
+	}
+	return list
+}
+
+// WriteResponse writes v with the encoder negotiated from the request
+// Accept header. Encoders which can't render v, like XML for structs
+// holding maps, are skipped for the next acceptable one; without any a 406
+// error is written.
+func WriteResponse(req *restful.Request, resp *restful.Response, status int, v interface{}) error {
+	accept := req.HeaderParameter("Accept")
+	var b bytes.Buffer
+	var encErr error
+	for _, e := range encodersOf(req).acceptable(accept) {
+		b.Reset()
+		if encErr = e.Encode(&b, v); encErr != nil {
+			continue
+		}
+		resp.Header().Set("Content-Type", e.MediaType())
+		resp.AddHeader("Vary", "Accept")
+		resp.WriteHeader(status)
+		_, err := resp.Write(b.Bytes())
+		return err
+	}
+
+	msg := fmt.Sprintf("no encoder for %q", accept)
+	if encErr != nil {
+		msg = fmt.Sprintf("no encoder for %q can render %T: %s", accept, v, encErr)
+	}
+	err := NewTypedError("not_acceptable", msg, nil)
+	WriteRequestError(err, req, resp)
+	return err
+}
+
+// JSONEncoder renders application/json.
+type JSONEncoder struct{}
+
+func (JSONEncoder) MediaType() string { return "application/json" }
+
+func (JSONEncoder) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// XMLEncoder renders application/xml. Maps, which encoding/xml doesn't
+// support, are rendered as one element per key.
+type XMLEncoder struct{}
+
+func (XMLEncoder) MediaType() string { return "application/xml" }
+
+func (XMLEncoder) Encode(w io.Writer, v interface{}) error {
+	return encodeXML(w, xmlValue{name: "response", value: v})
+}
+
+// encodeXML writes an XML document with x as its root element.
+func encodeXML(w io.Writer, x xmlValue) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(x)
+}
+
+type xmlValue struct {
+	name  string
+	value interface{}
+	xmlns string // default namespace, set on root elements only
+}
+
+func (x xmlValue) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: x.name}}
+	if x.xmlns != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: x.xmlns}}
+	}
+
+	rv := reflect.ValueOf(x.value)
+	switch rv.Kind() {
+	case reflect.Map:
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			child := xmlValue{name: fmt.Sprint(k.Interface()), value: rv.MapIndex(k).Interface()}
+			if err := e.Encode(child); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.Encode(xmlValue{name: "item", value: rv.Index(i).Interface()}); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Invalid:
+		return e.EncodeElement("", start)
+	}
+	return e.EncodeElement(x.value, start)
+}
+
+// MsgpackEncoder renders application/x-msgpack.
+type MsgpackEncoder struct{}
+
+var msgpackHandle = new(codec.MsgpackHandle)
+
+func (MsgpackEncoder) MediaType() string { return "application/x-msgpack" }
+
+func (MsgpackEncoder) Encode(w io.Writer, v interface{}) error {
+	return codec.NewEncoder(w, msgpackHandle).Encode(v)
+}
+
+// CBOREncoder renders application/cbor.
+type CBOREncoder struct{}
+
+var cborHandle = new(codec.CborHandle)
+
+func (CBOREncoder) MediaType() string { return "application/cbor" }
+
+func (CBOREncoder) Encode(w io.Writer, v interface{}) error {
+	return codec.NewEncoder(w, cborHandle).Encode(v)
+}
@@ -0,0 +1,78 @@
+package system
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+type csvEncoder struct{}
+
+func (csvEncoder) MediaType() string { return "text/csv" }
+
+func (csvEncoder) Encode(w io.Writer, v interface{}) error {
+	_, err := fmt.Fprintf(w, "%v\n", v)
+	return err
+}
+
+type withMap struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+}
+
+func TestWriteResponse(t *testing.T) {
+	plain := newTestApp(t, "")
+	csv := newTestApp(t, "")
+	csv.RegisterEncoder(csvEncoder{})
+	for _, a := range []*Application{plain, csv} {
+		ws := new(restful.WebService).Path("/").Produces("*/*")
+		ws.Route(ws.GET("item").To(func(req *restful.Request, resp *restful.Response) {
+			resp.Header().Set("Content-Type", "text/plain")
+			WriteResponse(req, resp, 200, map[string]int{"id": 1})
+		}))
+		ws.Route(ws.GET("labels").To(func(req *restful.Request, resp *restful.Response) {
+			WriteResponse(req, resp, 200, withMap{"a", map[string]string{"k": "v"}})
+		}))
+		a.Container.Add(ws)
+	}
+
+	tests := []struct {
+		name   string
+		a      *Application
+		path   string
+		accept string
+		status int
+		ct     string
+	}{
+		{"default", plain, "/item", "", 200, "application/json"},
+		{"xml", plain, "/item", "application/xml", 200, "application/xml"},
+		{"suffix", plain, "/item", "application/vnd.app.v2+json", 200, "application/json"},
+		{"registered encoder", csv, "/item", "text/csv", 200, "text/csv"},
+		{"encoder of another app", plain, "/item", "text/csv", 406, "application/json"},
+		{"xml can't render", plain, "/labels", "application/xml", 406, "application/xml"},
+		{"next acceptable", plain, "/labels", "application/xml, application/json;q=0.5", 200, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			tt.a.Container.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if ct := w.Header()["Content-Type"]; len(ct) != 1 || ct[0] != tt.ct {
+				t.Errorf("Content-Type %q, want %q only", ct, tt.ct)
+			}
+			if tt.status == 200 && tt.ct == "application/json" && !strings.HasPrefix(w.Body.String(), "{") {
+				t.Errorf("body %q isn't json", w.Body.String())
+			}
+		})
+	}
+}
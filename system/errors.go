@@ -0,0 +1,457 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+)
+
+// Key to use when setting the request ID.
+const RequestIDKey = "reqID"
+
+// Error response formats.
+const (
+	ErrorFormatLegacy  = "legacy"  // {"status":"error","msg":...,"code":...}
+	ErrorFormatProblem = "problem" // RFC 7807 application/problem+json
+)
+
+// errorFormat is how an application renders errors.
+type errorFormat struct {
+	format   string
+	typeBase string // prepended to error codes to build problem type URIs
+}
+
+var defaultErrorFormat = errorFormat{ErrorFormatLegacy, "about:blank#"}
+
+// SetErrorFormat selects how the application renders errors, see the
+// [errors] section:
+//
+//	[errors]
+//	format = "problem" # or "legacy"
+//	type_base_uri = "https://example.com/errors/"
+func (a *Application) SetErrorFormat(format, typeBase string) {
+	switch format {
+	case ErrorFormatLegacy, ErrorFormatProblem:
+	default:
+		log.Fatalf("Unknown error format %q\n", format)
+	}
+	if typeBase == "" {
+		typeBase = defaultErrorFormat.typeBase
+	}
+	a.errors = errorFormat{format, typeBase}
+}
+
+// errorRequest wraps a request served outside the container for
+// WriteRequestError.
+func (a *Application) errorRequest(r *http.Request) *restful.Request {
+	req := restful.NewRequest(r)
+	withValue(req, applicationContextKey, a)
+	return req
+}
+
+// errorFormatOf returns the error format of the application serving req.
+func errorFormatOf(req *restful.Request) errorFormat {
+	if a := applicationOf(req); a != nil && a.errors.format != "" {
+		return a.errors
+	}
+	return defaultErrorFormat
+}
+
+type ApiError struct {
+	SystemMessage string
+	ClientMessage interface{}
+	Code          int
+	ErrorCode     string                 // stable application error code
+	Extensions    map[string]interface{} // extra members of the error body
+	Cause         error                  // underlying error, never sent to clients
+}
+
+func (e ApiError) Error() string {
+	if e.Cause != nil {
+		return e.SystemMessage + ": " + e.Cause.Error()
+	}
+	return e.SystemMessage
+}
+
+// Unwrap returns the underlying error.
+func (e ApiError) Unwrap() error {
+	return e.Cause
+}
+
+func NewApiError(sm string, cm interface{}, code int) error {
+	return ApiError{SystemMessage: sm, ClientMessage: cm, Code: code}
+}
+
+// NewTypedError creates an error from a registered error type. The client
+// message defaults to the type title when cm is nil.
+func NewTypedError(errorCode, sm string, cm interface{}) error {
+	et, ok := GetErrorType(errorCode)
+	if !ok {
+		log.Errorf("Unknown error code %q", errorCode)
+		et = ErrorType{Code: errorCode, Status: 500, Title: "Internal Server Error"}
+	}
+	if cm == nil {
+		cm = et.Title
+	}
+	return ApiError{SystemMessage: sm, ClientMessage: cm, Code: et.Status, ErrorCode: errorCode}
+}
+
+// WrapError creates an error from a registered error type which keeps err
+// as its cause.
+func WrapError(err error, errorCode, sm string, cm interface{}) error {
+	ae := NewTypedError(errorCode, sm, cm).(ApiError)
+	ae.Cause = err
+	return ae
+}
+
+// With returns a copy of the error with an extension member added.
+func (e ApiError) With(k string, v interface{}) ApiError {
+	ext := map[string]interface{}{}
+	for ek, ev := range e.Extensions {
+		ext[ek] = ev
+	}
+	ext[k] = v
+	e.Extensions = ext
+	return e
+}
+
+// ErrorType is an entry of the error catalogue: a named application error
+// with its HTTP status and a human readable title.
+type ErrorType struct {
+	Code   string `json:"code"`
+	Status int    `json:"status"`
+	Title  string `json:"title"`
+}
+
+var errorTypes = struct {
+	sync.RWMutex
+	m        map[string]ErrorType
+	defaults map[int]string // first code registered for each status
+}{m: map[string]ErrorType{}, defaults: map[int]string{}}
+
+// RegisterErrorType adds an application error code to the catalogue. The
+// first code registered for a status is the default of errors carrying
+// only that status.
+func RegisterErrorType(code string, status int, title string) {
+	errorTypes.Lock()
+	defer errorTypes.Unlock()
+	if _, exists := errorTypes.m[code]; exists {
+		log.Printf("Error type %q already registered", code)
+	}
+	errorTypes.m[code] = ErrorType{code, status, title}
+	if _, ok := errorTypes.defaults[status]; !ok {
+		errorTypes.defaults[status] = code
+	}
+}
+
+// GetErrorType looks an error code up in the catalogue.
+func GetErrorType(code string) (ErrorType, bool) {
+	errorTypes.RLock()
+	defer errorTypes.RUnlock()
+	et, ok := errorTypes.m[code]
+	return et, ok
+}
+
+// ErrorTypes returns the catalogue sorted by code.
+func ErrorTypes() []ErrorType {
+	errorTypes.RLock()
+	defer errorTypes.RUnlock()
+	list := make([]ErrorType, 0, len(errorTypes.m))
+	for _, et := range errorTypes.m {
+		list = append(list, et)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// errorTypeFor returns the default error code of a status.
+func errorTypeFor(status int) string {
+	errorTypes.RLock()
+	defer errorTypes.RUnlock()
+	return errorTypes.defaults[status]
+}
+
+func init() {
+	RegisterErrorType("bad_request", 400, "Bad Request")
+	RegisterErrorType("unauthorized", 401, "Unauthorized")
+	RegisterErrorType("forbidden", 403, "Forbidden")
+	RegisterErrorType("not_found", 404, "Not Found")
+	RegisterErrorType("method_not_allowed", 405, "Method Not Allowed")
+	RegisterErrorType("not_acceptable", 406, "Not Acceptable")
+	RegisterErrorType("conflict", 409, "Conflict")
+	RegisterErrorType("precondition_failed", 412, "Precondition Failed")
+	RegisterErrorType("payload_too_large", 413, "Payload Too Large")
+	RegisterErrorType("unsupported_media_type", 415, "Unsupported Media Type")
+	RegisterErrorType("validation_failed", 422, "Validation Failed")
+	RegisterErrorType("idempotency_key_reused", 422, "Idempotency Key Reused")
+	RegisterErrorType("precondition_required", 428, "Precondition Required")
+	RegisterErrorType("rate_limited", 429, "Too Many Requests")
+	RegisterErrorType("internal_error", 500, "Internal Server Error")
+	RegisterErrorType("service_unavailable", 503, "Service Unavailable")
+	RegisterErrorType("timeout", 504, "Gateway Timeout")
+}
+
+// DocErrors documents the errors a route can return in swagger. Their
+// ProblemDetails models become LegacyError when the application uses the
+// legacy format.
+func DocErrors(codes ...string) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		for _, c := range codes {
+			et, ok := GetErrorType(c)
+			if !ok {
+				log.Fatalf("Unknown error code %q\n", c)
+			}
+			rb.ReturnsError(et.Status, fmt.Sprintf("%s (%s)", et.Title, et.Code), ProblemDetails{})
+		}
+	}
+}
+
+// ProblemDetails is the RFC 7807 error body. Extension members are added
+// at the top level when it is rendered.
+type ProblemDetails struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   interface{} `json:"detail,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+}
+
+// LegacyError is the legacy error body.
+type LegacyError struct {
+	Status string      `json:"status"`
+	Msg    interface{} `json:"msg"`
+	Code   int         `json:"code"`
+}
+
+// docErrorBodies documents the legacy error body instead of problem details
+// on every route when the application uses the legacy format.
+func (a *Application) docErrorBodies() {
+	if a.errors.format == ErrorFormatProblem {
+		return
+	}
+	for _, ws := range a.Container.RegisteredWebServices() {
+		for _, r := range ws.Routes() {
+			for code, re := range r.ResponseErrors {
+				if _, ok := re.Model.(ProblemDetails); ok {
+					re.Model = LegacyError{}
+					r.ResponseErrors[code] = re
+				}
+			}
+		}
+	}
+}
+
+// problemBody builds an RFC 7807 body.
+func problemBody(ae ApiError, req *restful.Request, typeBase string) map[string]interface{} {
+	code := ae.ErrorCode
+	if code == "" {
+		code = errorTypeFor(ae.Code)
+	}
+	et, ok := GetErrorType(code)
+	if !ok {
+		et = ErrorType{Code: code, Status: ae.Code, Title: fmt.Sprintf("Error %d", ae.Code)}
+	}
+
+	res := map[string]interface{}{}
+	for k, v := range ae.Extensions {
+		res[k] = v
+	}
+	res["type"] = typeBase + et.Code
+	res["title"] = et.Title
+	res["status"] = ae.Code
+	if ae.ClientMessage != nil && ae.ClientMessage != et.Title {
+		res["detail"] = ae.ClientMessage
+	}
+	if req != nil {
+		res["instance"] = req.Request.URL.RequestURI()
+		if id, ok := req.Attribute(RequestIDKey).(string); ok {
+			res["request_id"] = id
+		}
+	}
+	return res
+}
+
+// legacyBody builds the original {"status":"error"} body. Error codes and
+// extension members are only sent in problem responses.
+func legacyBody(ae ApiError) map[string]interface{} {
+	return map[string]interface{}{
+		"status": "error",
+		"msg":    ae.ClientMessage,
+		"code":   ae.Code,
+	}
+}
+
+// ErrorMapper translates a known error into an ApiError. It reports false
+// for errors it doesn't know about.
+type ErrorMapper func(err error) (ApiError, bool)
+
+var errorMappers = struct {
+	sync.RWMutex
+	list []ErrorMapper
+}{}
+
+// RegisterErrorMapper adds a mapper consulted by WriteError for errors which
+// aren't ApiErrors. Mappers registered last are tried first.
+func RegisterErrorMapper(m ErrorMapper) {
+	errorMappers.Lock()
+	defer errorMappers.Unlock()
+	errorMappers.list = append([]ErrorMapper{m}, errorMappers.list...)
+}
+
+// MapError converts any error into an ApiError. ApiErrors anywhere in the
+// cause chain are returned as is, otherwise each error of the chain is
+// offered to the registered mappers. Unknown errors become a 500.
+func MapError(err error) ApiError {
+	var ae ApiError
+	if errors.As(err, &ae) {
+		return ae
+	}
+
+	errorMappers.RLock()
+	defer errorMappers.RUnlock()
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		for _, m := range errorMappers.list {
+			if ae, ok := m(e); ok {
+				if ae.Cause == nil {
+					ae.Cause = err
+				}
+				return ae
+			}
+		}
+	}
+
+	return ApiError{
+		SystemMessage: "unhandled error",
+		ClientMessage: "Internal Server Error. Please report to admin.",
+		Code:          500,
+		ErrorCode:     "internal_error",
+		Cause:         err,
+	}
+}
+
+// causeChain lists the messages of every error in the chain.
+func causeChain(err error) []string {
+	chain := []string{}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		chain = append(chain, fmt.Sprintf("%T: %s", e, e))
+	}
+	return chain
+}
+
+// mapStdlibError handles errors common to all backends.
+func mapStdlibError(err error) (ApiError, bool) {
+	switch {
+	case err == context.DeadlineExceeded:
+		return NewTypedError("timeout", "deadline exceeded", nil).(ApiError), true
+	case err == syscall.ECONNREFUSED:
+		return NewTypedError("service_unavailable", "backend connection refused", nil).(ApiError), true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return NewTypedError("timeout", "backend timeout", nil).(ApiError), true
+	}
+	return ApiError{}, false
+}
+
+func init() {
+	RegisterErrorMapper(mapStdlibError)
+}
+
+// WriteError writes an error response in the legacy format, whatever the
+// error format of the application.
+//
+// Deprecated: use WriteRequestError, which knows the application from the
+// request.
+func WriteError(err error, r *restful.Response) {
+	WriteRequestError(err, nil, r)
+}
+
+// WriteRequestError writes an error response. The request is optional and
+// selects the error format of the application serving it, legacy without
+// one; problem responses also get its instance and request ID.
+func WriteRequestError(err error, req *restful.Request, r *restful.Response) {
+	ae := MapError(err)
+
+	// log the full cause chain, clients only get the client message
+	entry := log.WithField("status", ae.Code)
+	if ae.ErrorCode != "" {
+		entry = entry.WithField("error", ae.ErrorCode)
+	}
+	if req != nil {
+		if id, ok := req.Attribute(RequestIDKey).(string); ok {
+			entry = entry.WithField("request_id", id)
+		}
+	}
+	if chain := causeChain(err); len(chain) > 1 {
+		entry = entry.WithField("causes", chain)
+	}
+	entry.Error(err)
+
+	// errors are rendered in the negotiated format, falling back to json
+	var enc Encoder = JSONEncoder{}
+	if req != nil {
+		if e, ok := Negotiate(req); ok {
+			enc = e
+		}
+	}
+
+	var body map[string]interface{}
+	ct := enc.MediaType()
+	if ef := errorFormatOf(req); ef.format == ErrorFormatProblem {
+		body = problemBody(ae, req, ef.typeBase)
+		switch ct {
+		case "application/json":
+			ct = "application/problem+json"
+		case "application/xml":
+			ct = "application/problem+xml"
+		}
+	} else {
+		body = legacyBody(ae)
+	}
+
+	var b bytes.Buffer
+	var encErr error
+	switch ct {
+	case "application/problem+xml":
+		// RFC 7807 appendix A
+		encErr = encodeXML(&b, xmlValue{name: "problem", value: body, xmlns: "urn:ietf:rfc:7807"})
+	case "application/json":
+		// legacy JSON errors keep the exact bytes of json.Marshal, which
+		// unlike json.Encoder don't end with a newline
+		var raw []byte
+		raw, encErr = json.Marshal(body)
+		b.Write(raw)
+	default:
+		encErr = enc.Encode(&b, body)
+	}
+	if encErr != nil {
+		log.Errorf("Error response encoding failed: %s", encErr)
+	}
+
+	r.Header().Set("Content-Type", ct)
+	r.WriteErrorString(ae.Code, b.String())
+}
+
+// serviceError renders go-restful routing errors (404, 405, 406 and 415)
+// like application errors.
+func (a *Application) serviceError(se restful.ServiceError, req *restful.Request, resp *restful.Response) {
+	withValue(req, applicationContextKey, a)
+	code := errorTypeFor(se.Code)
+	e := ApiError{
+		SystemMessage: fmt.Sprintf("%s %s: %s", req.Request.Method, req.Request.URL.Path, se.Message),
+		ClientMessage: strings.TrimSpace(se.Message),
+		Code:          se.Code,
+		ErrorCode:     code,
+	}
+	WriteRequestError(e, req, resp)
+}
@@ -0,0 +1,226 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+func TestErrorTypeFor(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{400, "bad_request"},
+		{404, "not_found"},
+		{409, "conflict"},
+		{422, "validation_failed"},
+		{500, "internal_error"},
+		{418, ""},
+	}
+	for _, tt := range tests {
+		if got := errorTypeFor(tt.status); got != tt.code {
+			t.Errorf("errorTypeFor(%d) = %q, want %q", tt.status, got, tt.code)
+		}
+	}
+}
+
+func TestErrorTypeForKeepsFirstRegistration(t *testing.T) {
+	RegisterErrorType("aaa_test_unprocessable", 422, "Test")
+	if got := errorTypeFor(422); got != "validation_failed" {
+		t.Errorf("errorTypeFor(422) = %q after a later registration, want validation_failed", got)
+	}
+}
+
+func TestProblemBodyType(t *testing.T) {
+	tests := []struct {
+		name string
+		err  ApiError
+		typ  string
+	}{
+		{"typed", NewTypedError("idempotency_key_reused", "reused", nil).(ApiError), "about:blank#idempotency_key_reused"},
+		{"status only", NewApiError("invalid", "Invalid", 422).(ApiError), "about:blank#validation_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := problemBody(tt.err, nil, "about:blank#")
+			if body["type"] != tt.typ || body["status"] != 422 {
+				t.Errorf("type %v status %v, want %s 422", body["type"], body["status"], tt.typ)
+			}
+		})
+	}
+}
+
+// newTestApp initializes an application from a configuration.
+func newTestApp(t *testing.T, config string) *Application {
+	dir, err := ioutil.TempDir("", "restapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(f, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(Application)
+	a.Init(f)
+	return a
+}
+
+func TestErrorFormatPerApplication(t *testing.T) {
+	failing := func(req *restful.Request, resp *restful.Response) {
+		err := NewTypedError("idempotency_key_reused", "reused", nil).(ApiError).With("retry", true)
+		WriteRequestError(err, req, resp)
+	}
+	legacy := newTestApp(t, "")
+	problem := newTestApp(t, "[errors]\nformat = \"problem\"\ntype_base_uri = \"https://example.com/errors/\"\n")
+	for _, a := range []*Application{legacy, problem} {
+		ws := new(restful.WebService).Path("/fail")
+		ws.Route(ws.POST("").To(failing))
+		a.Container.Add(ws)
+	}
+
+	tests := []struct {
+		name   string
+		a      *Application
+		method string
+		ct     string
+		body   map[string]interface{}
+	}{
+		{"legacy", legacy, "POST", "application/json",
+			map[string]interface{}{"status": "error", "msg": "Idempotency Key Reused", "code": float64(422)}},
+		{"legacy routing", legacy, "GET", "application/json",
+			map[string]interface{}{"status": "error", "msg": "405: Method Not Allowed", "code": float64(405)}},
+		{"problem", problem, "POST", "application/problem+json",
+			map[string]interface{}{"type": "https://example.com/errors/idempotency_key_reused", "title": "Idempotency Key Reused",
+				"status": float64(422), "instance": "/fail", "retry": true}},
+		{"problem routing", problem, "GET", "application/problem+json",
+			map[string]interface{}{"type": "https://example.com/errors/method_not_allowed", "title": "Method Not Allowed",
+				"status": float64(405), "detail": "405: Method Not Allowed", "instance": "/fail"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.a.Container.ServeHTTP(w, httptest.NewRequest(tt.method, "/fail", nil))
+			var body map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid body %q: %s", w.Body.String(), err)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.ct {
+				t.Errorf("Content-Type %q, want %q", ct, tt.ct)
+			}
+			if !reflect.DeepEqual(body, tt.body) {
+				t.Errorf("body %v, want %v", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestLegacyErrorBody(t *testing.T) {
+	a := newTestApp(t, "")
+	ws := new(restful.WebService).Path("/fail")
+	ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+		WriteRequestError(NewApiError("missing", "Not here", 404), req, resp)
+	}))
+	a.Container.Add(ws)
+
+	w := httptest.NewRecorder()
+	a.Container.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	// the body written by WriteError before error formats existed
+	want := `{"code":404,"msg":"Not here","status":"error"}`
+	if w.Code != 404 || w.Body.String() != want || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got %d %q %q, want 404 application/json %q", w.Code, w.Header().Get("Content-Type"), w.Body.String(), want)
+	}
+}
+
+func TestProblemXML(t *testing.T) {
+	a := newTestApp(t, "[errors]\nformat = \"problem\"\n")
+	ws := new(restful.WebService).Path("/fail")
+	ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+		WriteRequestError(NewTypedError("not_found", "missing", nil), req, resp)
+	}))
+	a.Container.Add(ws)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/fail", nil)
+	r.Header.Set("Accept", "application/xml")
+	a.Container.ServeHTTP(w, r)
+	want := `<problem xmlns="urn:ietf:rfc:7807"><instance>/fail</instance><status>404</status><title>Not Found</title><type>about:blank#not_found</type></problem>`
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+xml" || !strings.HasSuffix(w.Body.String(), want) {
+		t.Errorf("got %q %q, want application/problem+xml %q", ct, w.Body.String(), want)
+	}
+}
+
+func TestDocErrorBodies(t *testing.T) {
+	tests := []struct {
+		config string
+		model  interface{}
+	}{
+		{"", LegacyError{}},
+		{"[errors]\nformat = \"problem\"\n", ProblemDetails{}},
+	}
+	for _, tt := range tests {
+		a := newTestApp(t, tt.config)
+		ws := new(restful.WebService).Path("/items")
+		ws.Route(ws.GET("").Do(DocErrors("not_found")).To(func(req *restful.Request, resp *restful.Response) {}))
+		a.Container.Add(ws)
+
+		a.docErrorBodies()
+		if got := ws.Routes()[0].ResponseErrors[404].Model; !reflect.DeepEqual(got, tt.model) {
+			t.Errorf("format %q: model %T, want %T", tt.config, got, tt.model)
+		}
+	}
+}
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestMapError(t *testing.T) {
+	conflict := NewTypedError("conflict", "duplicate order", nil)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		name   string
+		err    error
+		code   string
+		status int
+	}{
+		{"deadline", context.DeadlineExceeded, "timeout", 504},
+		{"wrapped deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), "timeout", 504},
+		{"connection refused", refused, "service_unavailable", 503},
+		{"net timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, "timeout", 504},
+		{"api error", conflict, "conflict", 409},
+		{"wrapped api error", fmt.Errorf("saving: %w", conflict), "conflict", 409},
+		{"canceled", context.Canceled, "internal_error", 500},
+		{"unknown", errors.New("boom"), "internal_error", 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ae := MapError(tt.err)
+			if ae.ErrorCode != tt.code || ae.Code != tt.status {
+				t.Errorf("mapped to %s %d, want %s %d", ae.ErrorCode, ae.Code, tt.code, tt.status)
+			}
+			// mapped errors keep the whole chain as their cause
+			var api ApiError
+			if !errors.As(tt.err, &api) && ae.Cause != tt.err {
+				t.Errorf("cause %v, want %v", ae.Cause, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package system
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/pelletier/go-toml"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http2Enabled reports whether HTTP/2 is served over TLS. It is on by
+// default and can be turned off in the [http2] section.
+func http2Enabled(config *toml.TomlTree) bool {
+	return config.GetDefault("http2.enabled", true).(bool)
+}
+
+// newHTTP2Server builds the HTTP/2 server settings from the [http2]
+// section:
+//
+//	[http2]
+//	enabled = true # HTTP/2 over TLS, negotiated with ALPN
+//	h2c = false # cleartext HTTP/2 when serving without [tls]
+//	max_concurrent_streams = 250 # per connection
+//	max_read_frame_size = 1048576
+//	max_upload_buffer_per_stream = 1048576
+//	max_upload_buffer_per_connection = 1048576
+//	idle_timeout = 120 # seconds, defaults to app.idle_timeout
+func newHTTP2Server(config *toml.TomlTree) *http2.Server {
+	get := func(key string) int64 {
+		return config.GetDefault(key, int64(0)).(int64)
+	}
+	return &http2.Server{
+		MaxConcurrentStreams:         uint32(get("http2.max_concurrent_streams")),
+		MaxReadFrameSize:             uint32(get("http2.max_read_frame_size")),
+		MaxUploadBufferPerStream:     int32(get("http2.max_upload_buffer_per_stream")),
+		MaxUploadBufferPerConnection: int32(get("http2.max_upload_buffer_per_connection")),
+		IdleTimeout:                  time.Duration(get("http2.idle_timeout")) * time.Second,
+	}
+}
+
+// configureHTTP2 enables HTTP/2 on the server: over TLS through ALPN and,
+// when h2c is set, in cleartext for clients using prior knowledge or the
+// Upgrade header. Each stream is served as a separate request, so filters
+// run once per stream exactly as they do for HTTP/1.1 requests.
+//
+// The HTTP/2 server is registered with srv in both cases so that shutting
+// srv down sends a GOAWAY on every HTTP/2 connection, the h2c ones which
+// net/http no longer tracks included.
+func (a *Application) configureHTTP2(srv *http.Server, tls bool) error {
+	h2s := newHTTP2Server(a.Config)
+	switch {
+	case tls && http2Enabled(a.Config):
+		return http2.ConfigureServer(srv, h2s)
+	case !tls && a.Config.GetDefault("http2.h2c", false).(bool):
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			return err
+		}
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	}
+	return nil
+}
+
+// Flush sends what was written so far to the client, as a chunk over
+// HTTP/1.1 or data frames over HTTP/2, to stream long responses. Responses
+// buffered by the cache, etag, idempotency and timeout middleware are still
+// only sent when the handler returns.
+func Flush(resp *restful.Response) {
+	if f, ok := resp.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
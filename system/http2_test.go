@@ -0,0 +1,126 @@
+package system
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// startH2C serves h over h2c and returns the server with a client which
+// speaks HTTP/2 with prior knowledge.
+func startH2C(t *testing.T, h http.Handler) (*server, string, *http.Client) {
+	a := newTestApp(t, "[http2]\nh2c = true\n")
+	srv := newServer(h)
+	if err := a.configureHTTP2(srv.Server, false); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	return srv, "http://" + l.Addr().String(), client
+}
+
+// blockingHandler answers once release is closed, signalling entered first.
+func blockingHandler(entered chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func TestDrainH2C(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	srv, url, client := startH2C(t, blockingHandler(entered, release))
+
+	if resp, err := client.Get(url + "/"); err != nil {
+		t.Fatal(err)
+	} else if b, _ := ioutil.ReadAll(resp.Body); string(b) != "HTTP/2.0" {
+		t.Fatalf("served over %q, want HTTP/2.0", b)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(url + "/slow")
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-entered
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		drained <- srv.drain(ctx)
+	}()
+
+	// the GOAWAY stops new streams while the slow one goes on
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.Get(url + "/"); err == nil {
+		t.Error("new request served after shutdown began")
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("drained with a stream in progress: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("in-flight stream failed: %s", err)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("drain failed: %s", err)
+	}
+}
+
+func TestDrainH2CTimeout(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	srv, url, client := startH2C(t, blockingHandler(entered, release))
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(url + "/slow")
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("drain returned %v, want the deadline", err)
+	}
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("stream completed on a closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("h2c connection left open after the timeout")
+	}
+}
@@ -0,0 +1,68 @@
+package system
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// inject fills the fields of a controller tagged with the plugin they
+// take, once at registration instead of through request attributes:
+//
+//	type UserController struct {
+//		system.Controller
+//		DB    *gorm.DB              `inject:"orm"`
+//		Cache *redis.Pool           `inject:"redis"`
+//		QM    *plugins.QueryManager `inject:"qm"`
+//	}
+//
+// Fields already set are kept, so controllers can be given fakes. Embedded
+// structs are filled too.
+func (a *Application) inject(ct interface{}) error {
+	v := reflect.ValueOf(ct)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("inject: %T is not a pointer to a struct", ct)
+	}
+	return a.injectStruct(v.Elem())
+}
+
+func (a *Application) injectStruct(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+
+		name, ok := f.Tag.Lookup("inject")
+		if !ok {
+			if f.Anonymous && fv.Kind() == reflect.Struct && f.Type != reflect.TypeOf(Controller{}) {
+				if err := a.injectStruct(fv); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if f.PkgPath != "" {
+			return fmt.Errorf("inject: field %s.%s is unexported", t.Name(), f.Name)
+		}
+		if !fv.IsZero() {
+			continue
+		}
+		p := a.GetPlugin(name)
+		if p == nil {
+			return fmt.Errorf("inject: plugin %q of field %s.%s isn't registered", name, t.Name(), f.Name)
+		}
+		pv := reflect.ValueOf(p)
+		switch pv.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+			// a typed nil, e.g. a plugin whose Init failed silently
+			if pv.IsNil() {
+				return fmt.Errorf("inject: plugin %q of field %s.%s is a nil %s", name, t.Name(), f.Name, pv.Type())
+			}
+		}
+		if !pv.Type().AssignableTo(f.Type) {
+			return fmt.Errorf("inject: plugin %q is a %s, field %s.%s a %s", name, pv.Type(), t.Name(), f.Name, f.Type)
+		}
+		fv.Set(pv)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package system
+
+import (
+	"strings"
+	"testing"
+)
+
+type injectPlugin struct {
+	v interface{}
+}
+
+func (p injectPlugin) Init(a *Application) error { return nil }
+func (p injectPlugin) Close() error              { return nil }
+func (p injectPlugin) Get() interface{}          { return p.v }
+
+type injectDB struct{ name string }
+
+type injectBase struct {
+	DB *injectDB `inject:"db"`
+}
+
+type injectController struct {
+	Controller
+	injectBase
+	Cache map[string]string `inject:"cache"`
+	Other *injectDB
+}
+
+func newInjectApp(t *testing.T, plugins map[string]interface{}) *Application {
+	a := newTestApp(t, "")
+	for n, v := range plugins {
+		a.RegisterPlugin(n, injectPlugin{v})
+	}
+	return a
+}
+
+func TestInject(t *testing.T) {
+	db := &injectDB{"main"}
+	cache := map[string]string{}
+	a := newInjectApp(t, map[string]interface{}{"db": db, "cache": cache})
+
+	ct := &injectController{}
+	if err := a.inject(ct); err != nil {
+		t.Fatal(err)
+	}
+	if ct.DB != db || ct.Cache == nil || ct.Other != nil {
+		t.Errorf("got DB %v Cache %v Other %v, want the embedded and tagged fields only", ct.DB, ct.Cache, ct.Other)
+	}
+
+	// fields already set are kept
+	fake := &injectDB{"fake"}
+	ct = &injectController{injectBase: injectBase{DB: fake}}
+	if err := a.inject(ct); err != nil {
+		t.Fatal(err)
+	}
+	if ct.DB != fake || ct.Cache == nil {
+		t.Errorf("got DB %v Cache %v, want the fake kept and the cache injected", ct.DB, ct.Cache)
+	}
+}
+
+func TestInjectErrors(t *testing.T) {
+	var nilDB *injectDB
+	tests := []struct {
+		name    string
+		plugins map[string]interface{}
+		ct      interface{}
+		err     string
+	}{
+		{"not a pointer", nil, injectController{}, "not a pointer to a struct"},
+		{"missing plugin", map[string]interface{}{"cache": map[string]string{}}, &injectController{}, `plugin "db" of field injectBase.DB isn't registered`},
+		{"type mismatch", map[string]interface{}{"db": "dsn", "cache": map[string]string{}}, &injectController{}, `plugin "db" is a string, field injectBase.DB a *system.injectDB`},
+		{"typed nil", map[string]interface{}{"db": nilDB, "cache": map[string]string{}}, &injectController{}, `plugin "db" of field injectBase.DB is a nil *system.injectDB`},
+		{"unexported", map[string]interface{}{"db": &injectDB{}}, &struct {
+			db *injectDB `inject:"db"`
+		}{}, "field .db is unexported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newInjectApp(t, tt.plugins).inject(tt.ct)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Phase is a point of the application lifecycle at which hooks run.
+type Phase int
+
+const (
+	// PreStart hooks run before the listeners open. An error aborts the
+	// start.
+	PreStart Phase = iota
+	// PostListen hooks run once every listener accepts connections, the
+	// application reports ready after them.
+	PostListen
+	// PreShutdown hooks run when shutdown begins, after readiness is
+	// withdrawn and before connections are drained.
+	PreShutdown
+	// PostShutdown hooks run once connections are drained, before plugins
+	// are closed.
+	PostShutdown
+)
+
+var phaseNames = []string{"pre-start", "post-listen", "pre-shutdown", "post-shutdown"}
+
+func (p Phase) String() string {
+	return phaseNames[p]
+}
+
+// HookFunc is called at a lifecycle phase. ctx expires after the hook
+// timeout.
+type HookFunc func(ctx context.Context) error
+
+// Hook is a function run at a lifecycle phase. Hooks run by ascending Order,
+// then in registration order for start phases and in reverse registration
+// order for shutdown phases, so that what starts first stops last.
+type Hook struct {
+	Name    string
+	Phase   Phase
+	Order   int
+	Timeout time.Duration // defaults to lifecycle.hook_timeout
+	Fn      HookFunc
+}
+
+// Lifecycle hooks of the application, configured in the [lifecycle]
+// section:
+//
+//	[lifecycle]
+//	hook_timeout = 10 # default seconds a hook may run
+//	shutdown_delay = 5 # seconds between withdrawing readiness and draining
+type lifecycle struct {
+	hooks []Hook
+	ready int32
+}
+
+// AddHook registers a lifecycle hook.
+func (a *Application) AddHook(h Hook) {
+	if h.Fn == nil {
+		log.Fatalf("Lifecycle hook %q has no function", h.Name)
+	}
+	a.lifecycle.hooks = append(a.lifecycle.hooks, h)
+}
+
+// OnStart registers a hook run before the listeners open.
+func (a *Application) OnStart(name string, fn HookFunc) {
+	a.AddHook(Hook{Name: name, Phase: PreStart, Fn: fn})
+}
+
+// OnReady registers a hook run once the listeners accept connections, e.g.
+// to register with service discovery.
+func (a *Application) OnReady(name string, fn HookFunc) {
+	a.AddHook(Hook{Name: name, Phase: PostListen, Fn: fn})
+}
+
+// OnShutdown registers a hook run when shutdown begins, e.g. to deregister
+// from service discovery.
+func (a *Application) OnShutdown(name string, fn HookFunc) {
+	a.AddHook(Hook{Name: name, Phase: PreShutdown, Fn: fn})
+}
+
+// OnStop registers a hook run once connections are drained.
+func (a *Application) OnStop(name string, fn HookFunc) {
+	a.AddHook(Hook{Name: name, Phase: PostShutdown, Fn: fn})
+}
+
+// Starter, Readier, Shutdowner and Stopper are implemented by controllers
+// and other components with lifecycle hooks, see Application.AddHooks.
+type Starter interface {
+	OnStart(ctx context.Context) error
+}
+
+type Readier interface {
+	OnReady(ctx context.Context) error
+}
+
+type Shutdowner interface {
+	OnShutdown(ctx context.Context) error
+}
+
+type Stopper interface {
+	OnStop(ctx context.Context) error
+}
+
+// AddHooks registers the lifecycle methods v implements under name:
+//
+//	ct := &MainController{}
+//	ct.Register(app.Container)
+//	app.AddHooks("main", ct)
+func (a *Application) AddHooks(name string, v interface{}) {
+	if s, ok := v.(Starter); ok {
+		a.OnStart(name, s.OnStart)
+	}
+	if r, ok := v.(Readier); ok {
+		a.OnReady(name, r.OnReady)
+	}
+	if s, ok := v.(Shutdowner); ok {
+		a.OnShutdown(name, s.OnShutdown)
+	}
+	if s, ok := v.(Stopper); ok {
+		a.OnStop(name, s.OnStop)
+	}
+}
+
+// runHooks runs the hooks of a phase and returns their errors. Every hook
+// runs even when an earlier one failed, a hook still running after its
+// timeout is reported as failed and left behind.
+func (a *Application) runHooks(p Phase) []error {
+	hooks := []Hook{}
+	for _, h := range a.lifecycle.hooks {
+		if h.Phase == p {
+			hooks = append(hooks, h)
+		}
+	}
+	if p == PreShutdown || p == PostShutdown {
+		for i, j := 0, len(hooks)-1; i < j; i, j = i+1, j-1 {
+			hooks[i], hooks[j] = hooks[j], hooks[i]
+		}
+	}
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].Order < hooks[j].Order
+	})
+
+	def := time.Duration(a.Config.GetDefault("lifecycle.hook_timeout", int64(10)).(int64)) * time.Second
+	errs := []error{}
+	for _, h := range hooks {
+		timeout := h.Timeout
+		if timeout == 0 {
+			timeout = def
+		}
+		start := time.Now()
+		if err := runHook(h, timeout); err != nil {
+			log.Errorf("Lifecycle %s hook %q failed: %s", p, h.Name, err)
+			errs = append(errs, fmt.Errorf("%s hook %q: %s", p, h.Name, err))
+			continue
+		}
+		log.Debugf("Lifecycle %s hook %q done in %s", p, h.Name, time.Since(start))
+	}
+	return errs
+}
+
+func runHook(h Hook, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- h.Fn(ctx)
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// Ready reports whether the application accepts traffic: between the
+// post-listen and pre-shutdown hooks.
+func (a *Application) Ready() bool {
+	return atomic.LoadInt32(&a.lifecycle.ready) == 1
+}
+
+func (a *Application) setReady(ready bool) {
+	v := int32(0)
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&a.lifecycle.ready, v)
+}
+
+// readiness answers the readiness checks of load balancers and
+// orchestrators: 200 when ready, 503 while starting or shutting down.
+func (a *Application) readiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !a.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, `{"status":"unavailable"}`)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, `{"status":"ready"}`)
+}
@@ -0,0 +1,244 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookLog records the hooks run, in order.
+type hookLog struct {
+	mu  sync.Mutex
+	run []string
+}
+
+func (l *hookLog) hook(name string, err error) HookFunc {
+	return func(ctx context.Context) error {
+		l.mu.Lock()
+		l.run = append(l.run, name)
+		l.mu.Unlock()
+		return err
+	}
+}
+
+func (l *hookLog) names() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.run...)
+}
+
+func TestRunHooks(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name  string
+		phase Phase
+		hooks []Hook // Fn set from Name
+		run   []string
+		errs  []string
+	}{
+		{"start in registration order", PreStart, []Hook{
+			{Name: "db"}, {Name: "cache"}, {Name: "stop", Phase: PostShutdown},
+		}, []string{"db", "cache"}, nil},
+		{"ready in registration order", PostListen, []Hook{
+			{Name: "db", Phase: PostListen}, {Name: "cache", Phase: PostListen},
+		}, []string{"db", "cache"}, nil},
+		{"shutdown in reverse order", PreShutdown, []Hook{
+			{Name: "db", Phase: PreShutdown}, {Name: "cache", Phase: PreShutdown},
+		}, []string{"cache", "db"}, nil},
+		{"stop in reverse order", PostShutdown, []Hook{
+			{Name: "db", Phase: PostShutdown}, {Name: "cache", Phase: PostShutdown}, {Name: "start"},
+		}, []string{"cache", "db"}, nil},
+		{"order first", PreStart, []Hook{
+			{Name: "late", Order: 10}, {Name: "db"}, {Name: "early", Order: -10}, {Name: "cache"},
+		}, []string{"early", "db", "cache", "late"}, nil},
+		{"order first on shutdown", PreShutdown, []Hook{
+			{Name: "late", Phase: PreShutdown, Order: 10}, {Name: "db", Phase: PreShutdown}, {Name: "cache", Phase: PreShutdown},
+		}, []string{"cache", "db", "late"}, nil},
+		{"errors don't stop the phase", PreStart, []Hook{
+			{Name: "db"}, {Name: "broken"}, {Name: "cache"},
+		}, []string{"db", "broken", "cache"}, []string{`pre-start hook "broken": failed`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, "")
+			l := &hookLog{}
+			for _, h := range tt.hooks {
+				var err error
+				if h.Name == "broken" {
+					err = failed
+				}
+				h.Fn = l.hook(h.Name, err)
+				a.AddHook(h)
+			}
+
+			errs := []string{}
+			for _, err := range a.runHooks(tt.phase) {
+				errs = append(errs, err.Error())
+			}
+			if got := l.names(); !reflect.DeepEqual(got, tt.run) {
+				t.Errorf("ran %v, want %v", got, tt.run)
+			}
+			if strings.Join(errs, "\n") != strings.Join(tt.errs, "\n") {
+				t.Errorf("errors %v, want %v", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestHookFailures(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	tests := []struct {
+		name    string
+		config  string
+		timeout time.Duration
+		fn      HookFunc
+		err     string
+	}{
+		{"timeout", "", 20 * time.Millisecond, func(ctx context.Context) error {
+			<-block
+			return nil
+		}, "timed out after 20ms"},
+		// either the hook or runHooks notices first
+		{"context expires", "", 20 * time.Millisecond, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, ""},
+		{"default timeout", "[lifecycle]\nhook_timeout = 30\n", 0, func(ctx context.Context) error {
+			if d, ok := ctx.Deadline(); !ok || time.Until(d) < 29*time.Second {
+				return errors.New("deadline isn't lifecycle.hook_timeout")
+			}
+			return nil
+		}, "none"},
+		{"panic", "", 0, func(ctx context.Context) error {
+			panic("boom")
+		}, "panic: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, tt.config)
+			a.AddHook(Hook{Name: "slow", Timeout: tt.timeout, Fn: tt.fn})
+			l := &hookLog{}
+			a.OnStart("next", l.hook("next", nil))
+
+			start := time.Now()
+			errs := a.runHooks(PreStart)
+			if time.Since(start) > time.Second {
+				t.Errorf("hooks ran for %s", time.Since(start))
+			}
+			switch {
+			case tt.err == "none":
+				if len(errs) != 0 {
+					t.Errorf("errors %v", errs)
+				}
+			case len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err):
+				t.Errorf("errors %v, want one with %q", errs, tt.err)
+			}
+			if got := l.names(); len(got) != 1 {
+				t.Errorf("the hook after a failed one didn't run")
+			}
+		})
+	}
+}
+
+// lifecycleComponent implements some of the lifecycle interfaces.
+type lifecycleComponent struct {
+	*hookLog
+}
+
+func (c lifecycleComponent) OnStart(ctx context.Context) error { return c.hook("start", nil)(ctx) }
+func (c lifecycleComponent) OnStop(ctx context.Context) error  { return c.hook("stop", nil)(ctx) }
+
+func TestAddHooks(t *testing.T) {
+	a := newTestApp(t, "")
+	l := &hookLog{}
+	a.AddHooks("component", lifecycleComponent{l})
+	for _, p := range []Phase{PreStart, PostListen, PreShutdown, PostShutdown} {
+		a.runHooks(p)
+	}
+	if got := l.names(); !reflect.DeepEqual(got, []string{"start", "stop"}) {
+		t.Errorf("ran %v, want start and stop", got)
+	}
+}
+
+// TestReadiness serves the application and checks readiness from its
+// hooks: it is withdrawn before the pre-shutdown hooks and only granted
+// after the post-listen ones.
+func TestReadiness(t *testing.T) {
+	a := newTestApp(t, "[app]\naddress = \"127.0.0.1\"\nport = 0\nshutdown_timeout = 1\n")
+	ls, err := a.openListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ls[0].Addr().String() + "/ready"
+	status := func() int {
+		w := httptest.NewRecorder()
+		a.readiness(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+
+	l := &hookLog{}
+	ready := map[string]int{}
+	check := func(name string) HookFunc {
+		return func(ctx context.Context) error {
+			l.hook(name, nil)(ctx)
+			ready[name] = status()
+			return nil
+		}
+	}
+	a.OnReady("listening", func(ctx context.Context) error {
+		// the listeners accept connections before the application is ready
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		ready["listening"] = resp.StatusCode
+		return nil
+	})
+	a.OnReady("registered", check("registered"))
+	a.OnShutdown("deregistered", check("deregistered"))
+	a.OnStop("stopped", check("stopped"))
+
+	served := make(chan struct{})
+	go func() {
+		a.serve(ls, nil)
+		close(served)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !a.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("not ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("ready: status %d, want 200", resp.StatusCode)
+	}
+
+	a.shutdown(time.Second)
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still serving after shutdown")
+	}
+
+	if got := l.names(); !reflect.DeepEqual(got, []string{"registered", "deregistered", "stopped"}) {
+		t.Errorf("ran %v", got)
+	}
+	want := map[string]int{"listening": 503, "registered": 503, "deregistered": 503, "stopped": 503}
+	if !reflect.DeepEqual(ready, want) {
+		t.Errorf("readiness in hooks %v, want %v", ready, want)
+	}
+}
@@ -0,0 +1,90 @@
+package system
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+// LimitBody caps the size of a request body. Requests announcing a larger
+// body are rejected with a 413 error right away, otherwise reads fail with
+// the same error once the limit is crossed.
+func LimitBody(r *http.Request, n int64) error {
+	if r.ContentLength > n {
+		return bodyTooLarge(n)
+	}
+	if r.Body != nil {
+		r.Body = &limitedBody{r.Body, n, n}
+	}
+	return nil
+}
+
+func bodyTooLarge(n int64) error {
+	return NewTypedError(
+		"payload_too_large",
+		fmt.Sprintf("request body larger than %d bytes", n),
+		fmt.Sprintf("The request body must be at most %d bytes.", n),
+	)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	n     int64 // remaining bytes
+	limit int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, bodyTooLarge(b.limit)
+	}
+	// read one byte past the limit to tell a body of exactly n bytes from
+	// a larger one
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n + int(b.n), bodyTooLarge(b.limit)
+	}
+	return n, err
+}
+
+// limitBodies applies app.max_body_bytes to every request.
+func (a *Application) limitBodies(h http.Handler) http.Handler {
+	max := a.Config.GetDefault("app.max_body_bytes", int64(0)).(int64)
+	if max <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := LimitBody(r, max); err != nil {
+			WriteRequestError(err, a.errorRequest(r), restful.NewResponse(w))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// configureServer applies the timeouts and header size limit of the [app]
+// section to the server:
+//
+//	[app]
+//	read_timeout = 30 # seconds to read a request, body included
+//	read_header_timeout = 10 # seconds to read the request headers
+//	write_timeout = 60 # seconds to write the response
+//	idle_timeout = 120 # seconds to keep idle keep-alive connections
+//	max_header_bytes = 1048576
+//	max_body_bytes = 10485760 # 0 for no limit
+func (a *Application) configureServer(srv *http.Server) {
+	seconds := func(key string) time.Duration {
+		return time.Duration(a.Config.GetDefault(key, int64(0)).(int64)) * time.Second
+	}
+	srv.ReadTimeout = seconds("app.read_timeout")
+	srv.ReadHeaderTimeout = seconds("app.read_header_timeout")
+	srv.WriteTimeout = seconds("app.write_timeout")
+	srv.IdleTimeout = seconds("app.idle_timeout")
+	srv.MaxHeaderBytes = int(a.Config.GetDefault("app.max_header_bytes", int64(http.DefaultMaxHeaderBytes)).(int64))
+}
@@ -0,0 +1,442 @@
+package system
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+)
+
+// listener is a socket the application serves on.
+type listener struct {
+	net.Listener
+	spec  string
+	admin bool
+}
+
+// openListeners opens the sockets of the [listen] and [admin] sections:
+//
+//	[listen]
+//	addresses = ["0.0.0.0:8080", "unix:/run/restapi.sock", "systemd:http"]
+//	socket_mode = "0660" # permissions of unix sockets
+//
+//	[admin]
+//	address = "127.0.0.1:9090" # same forms as listen.addresses
+//	paths = ["/apidocs", "/apidocs.json", "/health", "/ready", "/metrics"]
+//	health_path = "/health"
+//	ready_path = "/ready" # 503 while starting and shutting down
+//	tls = false
+//
+// Without [listen] the application listens on app.address and app.port.
+// systemd:<name> uses the socket passed by systemd socket activation with
+// that FileDescriptorName (or index), plain systemd all of them.
+func (a *Application) openListeners() ([]*listener, error) {
+	specs := []string{a.serviceAddress()}
+	if list, ok := a.Config.Get("listen.addresses").([]interface{}); ok && len(list) > 0 {
+		specs = specs[:0]
+		for _, s := range list {
+			specs = append(specs, fmt.Sprint(s))
+		}
+	}
+
+	// unix sockets keep the mode of the umask unless socket_mode is set
+	var mode os.FileMode
+	if s := a.Config.GetDefault("listen.socket_mode", "").(string); s != "" {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("listen: invalid socket_mode %q", s)
+		}
+		mode = os.FileMode(m)
+	}
+
+	ls := []*listener{}
+	open := func(spec string, admin bool) error {
+		l, err := upgradeListeners(spec, admin)
+		if err == nil && l == nil {
+			l, err = listen(spec, mode)
+		}
+		if err != nil {
+			return err
+		}
+		for _, nl := range l {
+			ls = append(ls, &listener{nl, spec, admin})
+		}
+		return nil
+	}
+	for _, spec := range specs {
+		if err := open(spec, false); err != nil {
+			return nil, err
+		}
+	}
+	if spec := a.Config.GetDefault("admin.address", "").(string); spec != "" {
+		if err := open(spec, true); err != nil {
+			return nil, err
+		}
+	}
+	closeUnusedUpgradeListeners()
+	return ls, nil
+}
+
+// listen opens the sockets of an address: host:port, unix:/path or
+// systemd[:name]. Unix sockets are given mode unless it's zero.
+func listen(spec string, mode os.FileMode) ([]net.Listener, error) {
+	switch {
+	case strings.HasPrefix(spec, "unix:"):
+		path := strings.TrimPrefix(spec, "unix:")
+		// remove the socket of a previous run, unless a server still
+		// answers on it
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("listen: %s is in use", path)
+			}
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("listen: %s", err)
+		}
+		if mode != 0 {
+			if err := os.Chmod(path, mode); err != nil {
+				l.Close()
+				return nil, fmt.Errorf("listen: %s", err)
+			}
+		}
+		return []net.Listener{l}, nil
+	case spec == "systemd" || strings.HasPrefix(spec, "systemd:"):
+		return systemdListeners(strings.TrimPrefix(strings.TrimPrefix(spec, "systemd"), ":"))
+	}
+
+	l, err := net.Listen("tcp", spec)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+	return []net.Listener{tcpKeepAliveListener{l.(*net.TCPListener)}}, nil
+}
+
+var inherited struct {
+	sync.Once
+	names     []string
+	listeners []net.Listener
+	err       error
+}
+
+// systemdListeners returns the sockets passed with the LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES protocol, the one named or numbered name
+// or all of them when name is empty.
+func systemdListeners(name string) ([]net.Listener, error) {
+	inherited.Do(func() {
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if pid != os.Getpid() || n == 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			fd := 3 + i // SD_LISTEN_FDS_START
+			syscall.CloseOnExec(fd)
+			f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				inherited.err = fmt.Errorf("listen: inherited socket %d: %s", fd, err)
+				return
+			}
+			fdName := strconv.Itoa(i)
+			if i < len(names) && names[i] != "" {
+				fdName = names[i]
+			}
+			inherited.names = append(inherited.names, fdName)
+			inherited.listeners = append(inherited.listeners, l)
+		}
+		// don't pass them on to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if inherited.err != nil {
+		return nil, inherited.err
+	}
+
+	if name == "" {
+		if len(inherited.listeners) == 0 {
+			return nil, fmt.Errorf("listen: no socket passed by systemd")
+		}
+		return inherited.listeners, nil
+	}
+	for i, n := range inherited.names {
+		if n == name || strconv.Itoa(i) == name {
+			return []net.Listener{inherited.listeners[i]}, nil
+		}
+	}
+	return nil, fmt.Errorf("listen: no socket %q passed by systemd", name)
+}
+
+// tcpKeepAliveListener enables keep-alives on accepted connections like
+// net/http does for the listeners it opens itself.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l tcpKeepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	c.SetKeepAlive(true)
+	c.SetKeepAlivePeriod(3 * time.Minute)
+	return c, nil
+}
+
+// adminPaths returns the path prefixes served on the admin listener only.
+func (a *Application) adminPaths() []string {
+	def := []interface{}{
+		a.Config.GetDefault("swagger.url", "/apidocs/"),
+		a.Config.GetDefault("swagger.api_path", "/apidocs.json"),
+		a.Config.GetDefault("admin.health_path", "/health"),
+		a.Config.GetDefault("admin.ready_path", "/ready"),
+		"/metrics",
+	}
+	for _, p := range a.versionSwaggerPaths() {
+		def = append(def, p)
+	}
+	list, ok := a.Config.Get("admin.paths").([]interface{})
+	if !ok {
+		list = def
+	}
+	paths := make([]string, len(list))
+	for i, p := range list {
+		paths[i] = strings.TrimSuffix(fmt.Sprint(p), "/")
+	}
+	return paths
+}
+
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// health answers the liveness checks of the admin listener.
+func (a *Application) health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, `{"status":"ok"}`)
+}
+
+// listenerHandler returns the handler of a listener. With an admin listener,
+// admin paths are only served there and public listeners answer them with
+// a 404.
+func (a *Application) listenerHandler(admin, hasAdmin bool) http.Handler {
+	paths := a.adminPaths()
+	healthPath := a.Config.GetDefault("admin.health_path", "/health").(string)
+	readyPath := a.Config.GetDefault("admin.ready_path", "/ready").(string)
+	app := a.limitBodies(a.handler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isAdmin := hasPathPrefix(r.URL.Path, paths)
+		switch {
+		case admin && !isAdmin, !admin && hasAdmin && isAdmin:
+			WriteRequestError(NewTypedError("not_found", "admin path on the wrong listener: "+r.URL.Path, nil), a.errorRequest(r), restful.NewResponse(w))
+		case r.URL.Path == healthPath:
+			a.health(w, r)
+		case r.URL.Path == readyPath:
+			a.readiness(w, r)
+		default:
+			app.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serve serves every listener until the process is signalled, then drains
+// the connections and stops the application.
+func (a *Application) serve(ls []*listener, tlsConfig *tls.Config) {
+	hasAdmin := false
+	for _, l := range ls {
+		hasAdmin = hasAdmin || l.admin
+	}
+	timeout := time.Duration(a.Config.GetDefault("app.shutdown_timeout", int64(5)).(int64)) * time.Second
+	adminTLS := a.Config.GetDefault("admin.tls", false).(bool)
+
+	nls := make([]net.Listener, len(ls))
+	for i, l := range ls {
+		srv := newServer(a.listenerHandler(l.admin, hasAdmin))
+		a.configureServer(srv.Server)
+
+		var nl net.Listener = l
+		useTLS := tlsConfig != nil && l.Addr().Network() != "unix" && (!l.admin || adminTLS)
+		if useTLS {
+			srv.TLSConfig = tlsConfig
+			nl = tls.NewListener(l, tlsConfig)
+		}
+		checkErr(a.configureHTTP2(srv.Server, useTLS), "HTTP/2 configuration failed:")
+
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		kind := "public"
+		if l.admin {
+			kind = "admin"
+		}
+		log.Infof("Listening on %s://%s (%s, %s)", scheme, l.Addr(), l.spec, kind)
+
+		a.servers = append(a.servers, srv)
+		nls[i] = nl
+	}
+
+	var wg sync.WaitGroup
+	for i, srv := range a.servers {
+		wg.Add(1)
+		go func(srv *server, l net.Listener) {
+			defer wg.Done()
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				log.Errorf("Server error on %s: %s", l.Addr(), err)
+				a.shutdown(timeout)
+			}
+			<-srv.drained
+		}(srv, nls[i])
+	}
+
+	a.runHooks(PostListen)
+	a.setReady(true)
+	upgradeReady()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	if upgradesEnabled(a) {
+		signal.Notify(sig, syscall.SIGUSR2)
+	}
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGUSR2 {
+				if err := a.upgrade(ls); err != nil {
+					log.Errorf("Upgrade failed, still serving: %s", err)
+					continue
+				}
+			}
+			a.shutdown(timeout)
+			return
+		}
+	}()
+
+	wg.Wait()
+	a.stop()
+}
+
+// shutdown withdraws readiness, runs the pre-shutdown hooks, then stops
+// accepting connections and lets the servers drain for up to timeout.
+func (a *Application) shutdown(timeout time.Duration) {
+	a.stopping.Do(func() {
+		a.setReady(false)
+		a.runHooks(PreShutdown)
+		// give load balancers time to notice
+		delay := a.Config.GetDefault("lifecycle.shutdown_delay", int64(0)).(int64)
+		time.Sleep(time.Duration(delay) * time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, srv := range a.servers {
+			wg.Add(1)
+			go func(srv *server) {
+				defer wg.Done()
+				if err := srv.drain(ctx); err != nil {
+					log.Errorf("Connections still open after %s were closed: %s", timeout, err)
+				}
+			}(srv)
+		}
+		wg.Wait()
+	})
+}
+
+type connKey struct{}
+
+// server is an http.Server which keeps track of the connections its
+// handlers are serving. net/http forgets the h2c connections once they are
+// hijacked by the HTTP/2 server, so Shutdown alone doesn't wait for them.
+type server struct {
+	*http.Server
+	mu      sync.Mutex
+	active  map[net.Conn]int
+	drained chan struct{}
+}
+
+func newServer(h http.Handler) *server {
+	s := &server{
+		Server:  &http.Server{Handler: h},
+		active:  map[net.Conn]int{},
+		drained: make(chan struct{}),
+	}
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, c)
+	}
+	return s
+}
+
+// Serve serves l. The handler is wrapped here, after configureHTTP2, so that
+// h2c connections count as active for as long as HTTP/2 serves them.
+func (s *server) Serve(l net.Listener) error {
+	h := s.Handler
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Context().Value(connKey{}).(net.Conn)
+		s.mu.Lock()
+		s.active[c]++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			if s.active[c]--; s.active[c] == 0 {
+				delete(s.active, c)
+			}
+			s.mu.Unlock()
+		}()
+		h.ServeHTTP(w, r)
+	})
+	return s.Server.Serve(l)
+}
+
+// drain stops accepting connections, sends HTTP/2 clients a GOAWAY and waits
+// for the requests in progress, h2c connections included. The connections
+// left when ctx is done are closed.
+func (s *server) drain(ctx context.Context) error {
+	defer close(s.drained)
+	err := s.Shutdown(ctx)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for err == nil && s.serving() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-tick.C:
+		}
+	}
+	if err != nil {
+		s.Close()
+		s.mu.Lock()
+		for c := range s.active {
+			c.Close()
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *server) serving() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
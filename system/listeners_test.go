@@ -0,0 +1,232 @@
+package system
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+func TestOpenListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "api.sock")
+
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+
+	tests := []struct {
+		name    string
+		config  string
+		specs   []string
+		admin   []bool
+		mode    os.FileMode
+		invalid bool
+	}{
+		{"app address", "[app]\naddress = \"127.0.0.1\"\nport = 0\n", []string{"127.0.0.1:0"}, []bool{false}, 0, false},
+		{"addresses and admin", "[listen]\naddresses = [\"127.0.0.1:0\", \"unix:" + sock + "\"]\n[admin]\naddress = \"127.0.0.1:0\"\n",
+			[]string{"127.0.0.1:0", "unix:" + sock, "127.0.0.1:0"}, []bool{false, false, true}, 0755, false},
+		{"socket mode", "[listen]\naddresses = [\"unix:" + sock + "\"]\nsocket_mode = \"0600\"\n", []string{"unix:" + sock}, []bool{false}, 0600, false},
+		{"invalid socket mode", "[listen]\naddresses = [\"unix:" + sock + "\"]\nsocket_mode = \"rw\"\n", nil, nil, 0, true},
+		{"unknown systemd socket", "[listen]\naddresses = [\"systemd:http\"]\n", nil, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t, tt.config)
+			ls, err := a.openListeners()
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				for _, l := range ls {
+					l.Close()
+				}
+			}()
+
+			if len(ls) != len(tt.specs) {
+				t.Fatalf("%d listeners, want %d", len(ls), len(tt.specs))
+			}
+			for i, l := range ls {
+				if l.spec != tt.specs[i] || l.admin != tt.admin[i] {
+					t.Errorf("listener %d: %s admin %v, want %s admin %v", i, l.spec, l.admin, tt.specs[i], tt.admin[i])
+				}
+			}
+			if tt.mode != 0 {
+				fi, err := os.Stat(sock)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode().Perm() != tt.mode {
+					t.Errorf("socket mode %o, want %o", fi.Mode().Perm(), tt.mode)
+				}
+			}
+		})
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "api.sock")
+
+	// the socket of a server still running is kept
+	live, err := listen("unix:"+sock, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:"+sock, 0); err == nil {
+		t.Error("listened on the socket of a live server")
+	}
+
+	// a stale socket is replaced
+	live[0].(*net.UnixListener).SetUnlinkOnClose(false)
+	live[0].Close()
+	ls, err := listen("unix:"+sock, 0)
+	if err != nil {
+		t.Fatalf("stale socket: %s", err)
+	}
+	ls[0].Close()
+}
+
+// TestSystemdListeners runs itself with two sockets passed as systemd
+// does, the child checking them in TestSystemdListenersChild.
+func TestSystemdListeners(t *testing.T) {
+	files := []*os.File{}
+	addrs := []string{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListenersChild$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		"RESTAPI_TEST_SYSTEMD_ADDRS="+strings.Join(addrs, ","),
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=http:admin",
+	)
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: TestSystemdListenersChild") {
+		t.Errorf("child failed: %v\n%s", err, out)
+	}
+}
+
+func TestSystemdListenersChild(t *testing.T) {
+	env := os.Getenv("RESTAPI_TEST_SYSTEMD_ADDRS")
+	if env == "" {
+		t.Skip("run by TestSystemdListeners")
+	}
+	addrs := strings.Split(env, ",")
+	// systemd sets the PID of the process it starts
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	tests := []struct {
+		name  string
+		addrs []string
+	}{
+		{"http", addrs[:1]},
+		{"admin", addrs[1:]},
+		{"1", addrs[1:]},
+		{"", addrs},
+		{"metrics", nil},
+	}
+	for _, tt := range tests {
+		ls, err := systemdListeners(tt.name)
+		if tt.addrs == nil {
+			if err == nil {
+				t.Errorf("%q: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tt.name, err)
+		}
+		got := []string{}
+		for _, l := range ls {
+			got = append(got, l.Addr().String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.addrs, ",") {
+			t.Errorf("%q: sockets %v, want %v", tt.name, got, tt.addrs)
+		}
+	}
+
+	for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if v := os.Getenv(k); v != "" {
+			t.Errorf("%s=%s left for child processes", k, v)
+		}
+	}
+}
+
+func TestListenerHandler(t *testing.T) {
+	a := newTestApp(t, "")
+	ws := new(restful.WebService).Path("/users")
+	ws.Route(ws.GET("").To(func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte("users"))
+	}))
+	a.Container.Add(ws)
+	a.setReady(true)
+
+	tests := []struct {
+		name     string
+		admin    bool
+		hasAdmin bool
+		path     string
+		status   int
+	}{
+		{"public route", false, true, "/users", 200},
+		{"admin path on the public listener", false, true, "/health", 404},
+		{"swagger on the public listener", false, true, "/apidocs/index.html", 404},
+		{"health", true, true, "/health", 200},
+		{"ready", true, true, "/ready", 200},
+		{"public route on the admin listener", true, true, "/users", 404},
+		{"health without an admin listener", false, false, "/health", 200},
+		{"route without an admin listener", false, false, "/users", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.listenerHandler(tt.admin, tt.hasAdmin).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+
+	a.setReady(false)
+	w := httptest.NewRecorder()
+	a.listenerHandler(true, true).ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready while not ready: status %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package system
+
+import (
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/pelletier/go-toml"
+)
+
+// Middleware is a named filter which can be installed on the container,
+// on individual web services or on single routes.
+type Middleware struct {
+	Name    string
+	Order   int
+	Filter  restful.FilterFunction
+	Global  bool
+	Enabled bool
+}
+
+// MiddlewareRegistry keeps track of the available middleware and of where
+// each one has been attached.
+//
+// The [middleware] config section can disable entries or override their
+// order:
+//
+//	[middleware]
+//	disabled = ["logger"]
+//	debug = true
+//
+//	[middleware.order]
+//	recoverer = 5
+type MiddlewareRegistry struct {
+	entries  map[string]*Middleware
+	services map[*restful.WebService][]string
+	routes   map[*restful.RouteBuilder][]string
+	config   *toml.TomlTree
+}
+
+// route metadata listing the middleware applied to the route
+const middlewareMetadataKey = "middleware"
+
+// RouteChain describes the effective filter chain of a single route.
+type RouteChain struct {
+	Method  string
+	Path    string
+	Filters []string
+}
+
+func newMiddlewareRegistry(config *toml.TomlTree) *MiddlewareRegistry {
+	m := new(MiddlewareRegistry)
+	m.entries = map[string]*Middleware{}
+	m.services = map[*restful.WebService][]string{}
+	m.routes = map[*restful.RouteBuilder][]string{}
+	m.config = config
+	return m
+}
+
+// Add registers a middleware without installing it anywhere. Use
+// ApplyToWebService or ApplyToRoute to attach it.
+func (m *MiddlewareRegistry) Add(name string, order int, f restful.FilterFunction) *Middleware {
+	if _, exists := m.entries[name]; exists {
+		log.Printf("Middleware %q already registered", name)
+	}
+
+	mw := &Middleware{
+		Name:    name,
+		Order:   order,
+		Filter:  f,
+		Enabled: true,
+	}
+
+	// apply config overrides
+	if m.config != nil {
+		if v := m.config.Get("middleware.order." + name); v != nil {
+			mw.Order = int(v.(int64))
+		}
+		if v, ok := m.config.Get("middleware.disabled").([]interface{}); ok {
+			for _, n := range v {
+				if n.(string) == name {
+					mw.Enabled = false
+				}
+			}
+		}
+	}
+
+	m.entries[name] = mw
+	return mw
+}
+
+// Use registers a middleware which is installed on the container, and
+// therefore runs for every request.
+func (m *MiddlewareRegistry) Use(name string, order int, f restful.FilterFunction) *Middleware {
+	mw := m.Add(name, order, f)
+	mw.Global = true
+	return mw
+}
+
+// Get returns the named middleware or nil.
+func (m *MiddlewareRegistry) Get(name string) *Middleware {
+	return m.entries[name]
+}
+
+// Enable turns a registered middleware on.
+func (m *MiddlewareRegistry) Enable(name string) {
+	if mw, ok := m.entries[name]; ok {
+		mw.Enabled = true
+	}
+}
+
+// Disable turns a registered middleware off. Disabling only affects web
+// services and routes which are wired after the call, and the global chain
+// which is installed when the application starts.
+func (m *MiddlewareRegistry) Disable(name string) {
+	if mw, ok := m.entries[name]; ok {
+		mw.Enabled = false
+	}
+}
+
+// Chain returns the enabled filters for the given names sorted by order.
+func (m *MiddlewareRegistry) Chain(names ...string) []restful.FilterFunction {
+	list := m.sorted(names)
+	filters := make([]restful.FilterFunction, 0, len(list))
+	for _, mw := range list {
+		filters = append(filters, mw.Filter)
+	}
+	return filters
+}
+
+// ApplyToWebService installs the named middleware on all routes of ws.
+func (m *MiddlewareRegistry) ApplyToWebService(ws *restful.WebService, names ...string) {
+	for _, mw := range m.sorted(names) {
+		ws.Filter(mw.Filter)
+		m.services[ws] = append(m.services[ws], mw.Name)
+	}
+}
+
+// FilterWebService installs a filter which isn't registered on all routes
+// of ws. Unlike with ws.Filter, Routes lists it under name.
+func (m *MiddlewareRegistry) FilterWebService(ws *restful.WebService, name string, f restful.FilterFunction) {
+	ws.Filter(f)
+	m.services[ws] = append(m.services[ws], name)
+}
+
+// ApplyToRoute installs the named middleware on a single route.
+func (m *MiddlewareRegistry) ApplyToRoute(rb *restful.RouteBuilder, names ...string) *restful.RouteBuilder {
+	for _, mw := range m.sorted(names) {
+		rb.Filter(mw.Filter)
+		m.routes[rb] = append(m.routes[rb], mw.Name)
+	}
+	return rb.Metadata(middlewareMetadataKey, append([]string{}, m.routes[rb]...))
+}
+
+// Routes returns the effective chain of every route registered on the
+// container: global middleware, then web service middleware, then route
+// filters. Names are recorded when the registry installs a filter, so
+// filters added with Container.Filter or WebService.Filter aren't listed,
+// and those added with RouteBuilder.Filter show as "(unregistered)" after
+// the route middleware.
+func (m *MiddlewareRegistry) Routes(container *restful.Container) []RouteChain {
+	global := []string{}
+	for _, mw := range m.global() {
+		global = append(global, mw.Name)
+	}
+
+	chains := []RouteChain{}
+	for _, ws := range container.RegisteredWebServices() {
+		for _, r := range ws.Routes() {
+			filters := append([]string{}, global...)
+			filters = append(filters, m.services[ws]...)
+			names, _ := r.Metadata[middlewareMetadataKey].([]string)
+			filters = append(filters, names...)
+			for i := len(names); i < len(r.Filters); i++ {
+				filters = append(filters, "(unregistered)")
+			}
+			chains = append(chains, RouteChain{r.Method, r.Path, filters})
+		}
+	}
+	return chains
+}
+
+// global returns the enabled container wide middleware.
+func (m *MiddlewareRegistry) global() []*Middleware {
+	names := []string{}
+	for n, mw := range m.entries {
+		if mw.Global {
+			names = append(names, n)
+		}
+	}
+	return m.sorted(names)
+}
+
+func (m *MiddlewareRegistry) sorted(names []string) []*Middleware {
+	list := []*Middleware{}
+	for _, n := range names {
+		mw, ok := m.entries[n]
+		if !ok {
+			log.Fatalf("Middleware %q isn't registered\n", n)
+		}
+		if mw.Enabled {
+			list = append(list, mw)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Order == list[j].Order {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Order < list[j].Order
+	})
+	return list
+}
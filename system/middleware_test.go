@@ -0,0 +1,44 @@
+package system
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+// tagFilter returns a filter adding tag to the X-Tag header. The closures
+// share one code pointer, so Routes can only tell them apart by name.
+func tagFilter(tag string) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		resp.AddHeader("X-Tag", tag)
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+func TestMiddlewareRoutes(t *testing.T) {
+	m := newMiddlewareRegistry(nil)
+	m.Use("logger", 20, tagFilter("logger"))
+	m.Use("request_id", 10, tagFilter("request_id"))
+	m.Add("auth", 45, tagFilter("auth"))
+	m.Add("cache", 70, tagFilter("cache"))
+	m.Add("etag", 60, tagFilter("etag"))
+
+	ws := new(restful.WebService).Path("/items")
+	m.ApplyToWebService(ws, "auth")
+	m.FilterWebService(ws, "audit", tagFilter("audit"))
+	ws.Route(m.ApplyToRoute(ws.GET(""), "cache", "etag").Filter(tagFilter("direct")).To(func(*restful.Request, *restful.Response) {}))
+	ws.Route(m.ApplyToRoute(ws.GET("/{id}"), "etag").To(func(*restful.Request, *restful.Response) {}))
+	ws.Route(ws.DELETE("/{id}").To(func(*restful.Request, *restful.Response) {}))
+	container := restful.NewContainer()
+	container.Add(ws)
+
+	want := []RouteChain{
+		{"GET", "/items/", []string{"request_id", "logger", "auth", "audit", "etag", "cache", "(unregistered)"}},
+		{"GET", "/items/{id}", []string{"request_id", "logger", "auth", "audit", "etag"}},
+		{"DELETE", "/items/{id}", []string{"request_id", "logger", "auth", "audit"}},
+	}
+	if got := m.Routes(container); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
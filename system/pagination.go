@@ -0,0 +1,458 @@
+package system
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ListOptions restricts what clients may ask of a list endpoint.
+type ListOptions struct {
+	DefaultLimit int
+	MaxLimit     int
+	Sortable     []string // fields allowed in ?sort=
+	Filterable   []string // fields allowed as filters
+	DefaultSort  string   // e.g. "-created"
+	Key          string   // unique field used as cursor tie breaker, "id" by default
+
+	// Types declares the type of filter values, "int", "float" or "bool",
+	// for stores which compare by type. Other fields are strings.
+	Types map[string]string
+}
+
+// SortField is one entry of ?sort=, a leading "-" sorts descending.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Filter is a condition on a field: ?field=value or ?field[op]=value.
+type Filter struct {
+	Field string
+	Op    string // eq, ne, lt, lte, gt, gte, like or in
+	Value string
+}
+
+// Values splits the value of an "in" filter.
+func (f Filter) Values() []string {
+	return strings.Split(f.Value, ",")
+}
+
+// ListQuery holds the parsed pagination, sorting and filtering parameters
+// of a list request. Clients either page with ?page=/?offset= and ?limit=,
+// or with the opaque ?cursor= returned by the previous page.
+type ListQuery struct {
+	Offset  int
+	Limit   int
+	Sort    []SortField
+	Filters []Filter
+	Cursor  map[string]interface{} // values of the sort fields of the last item seen, times as time.Time
+	Key     string
+	Types   map[string]string // declared filter value types, see ListOptions
+
+	useCursor bool
+}
+
+// UsesCursor reports whether the client asked for cursor pagination.
+func (q *ListQuery) UsesCursor() bool {
+	return q.useCursor
+}
+
+var filterOps = map[string]bool{
+	"eq": true, "ne": true, "lt": true, "lte": true,
+	"gt": true, "gte": true, "like": true, "in": true,
+}
+
+var filterParam = regexp.MustCompile(`^([A-Za-z0-9_.]+)(?:\[([a-z]+)\])?$`)
+
+// ParseList reads the list parameters of a request. Sort fields and filters
+// which aren't allowed return a 400 error.
+func ParseList(req *restful.Request, opts ListOptions) (*ListQuery, error) {
+	if opts.DefaultLimit <= 0 {
+		opts.DefaultLimit = 20
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 100
+	}
+	if opts.Key == "" {
+		opts.Key = "id"
+	}
+
+	q := &ListQuery{Limit: opts.DefaultLimit, Key: opts.Key, Types: opts.Types}
+	errs := ValidationError{}
+	params := req.Request.URL.Query()
+
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, FieldError{"limit", "min", "must be a positive integer"})
+		} else if n > opts.MaxLimit {
+			q.Limit = opts.MaxLimit
+		} else {
+			q.Limit = n
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, FieldError{"offset", "min", "must be zero or a positive integer"})
+		}
+		q.Offset = n
+	}
+	if v := params.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, FieldError{"page", "min", "must be a positive integer"})
+		}
+		q.Offset = (n - 1) * q.Limit
+	}
+
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = opts.DefaultSort
+	}
+	for _, s := range strings.Split(sort, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		sf := SortField{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+		if !allowed(opts.Sortable, sf.Field) && sf.Field != opts.Key {
+			errs = append(errs, FieldError{"sort", "enum", fmt.Sprintf("can't sort by %q", sf.Field)})
+			continue
+		}
+		q.Sort = append(q.Sort, sf)
+	}
+
+	for p, values := range params {
+		m := filterParam.FindStringSubmatch(p)
+		if m == nil || !allowed(opts.Filterable, m[1]) {
+			continue
+		}
+		op := m[2]
+		if op == "" {
+			op = "eq"
+		}
+		if !filterOps[op] {
+			errs = append(errs, FieldError{p, "enum", fmt.Sprintf("unknown operator %q", op)})
+			continue
+		}
+		for _, v := range values {
+			f := Filter{m[1], op, v}
+			if err := q.checkType(f); err != nil {
+				errs = append(errs, FieldError{p, "type", err.Error()})
+				continue
+			}
+			q.Filters = append(q.Filters, f)
+		}
+	}
+
+	if _, ok := params["cursor"]; ok {
+		q.useCursor = true
+		// the key makes the order total, which cursors depend on
+		if len(q.Sort) == 0 || q.Sort[len(q.Sort)-1].Field != opts.Key {
+			q.Sort = append(q.Sort, SortField{Field: opts.Key})
+		}
+		if v := params.Get("cursor"); v != "" {
+			c, err := decodeCursor(v, q.Sort)
+			if err != nil {
+				errs = append(errs, FieldError{"cursor", "format", "is invalid"})
+			}
+			q.Cursor = c
+			q.Offset = 0
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs.ApiError("bad_request")
+	}
+	return q, nil
+}
+
+// checkType makes sure the values of a filter have the declared type of
+// its field.
+func (q *ListQuery) checkType(f Filter) error {
+	values := []string{f.Value}
+	if f.Op == "in" {
+		values = f.Values()
+	}
+	for _, v := range values {
+		if _, err := q.TypedValue(f.Field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TypedValue converts a filter value of field to its declared type, int64,
+// float64 or bool. Values of undeclared fields are kept as strings.
+func (q *ListQuery) TypedValue(field, v string) (interface{}, error) {
+	switch t := q.Types[field]; t {
+	case "int":
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, nil
+		}
+		return nil, fmt.Errorf("must be an integer")
+	case "float":
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, nil
+		}
+		return nil, fmt.Errorf("must be a number")
+	case "bool":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, nil
+		}
+		return nil, fmt.Errorf("must be true or false")
+	case "", "string":
+		return v, nil
+	default:
+		return nil, fmt.Errorf("has unknown type %q", t)
+	}
+}
+
+// ParseList reads the list parameters of a request. See system.ParseList.
+func (ct *Controller) ParseList(req *restful.Request, opts ListOptions) (*ListQuery, error) {
+	return ParseList(req, opts)
+}
+
+func allowed(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// cursorTime is the cursor value of a time, which JSON can't tell apart
+// from a string.
+type cursorTime struct {
+	Time time.Time `json:"time"`
+}
+
+// decodeCursor reads the values of the sort fields from a cursor. Cursors
+// come from clients, so values other than strings, numbers, booleans, null
+// and times are rejected: they would be operators to document databases.
+func decodeCursor(s string, sort []SortField) (map[string]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) != len(sort) {
+		return nil, fmt.Errorf("cursor has %d fields, want %d", len(raw), len(sort))
+	}
+
+	c := map[string]interface{}{}
+	for _, sf := range sort {
+		r, ok := raw[sf.Field]
+		if !ok {
+			return nil, fmt.Errorf("cursor lacks field %q", sf.Field)
+		}
+		v, err := cursorValue(r)
+		if err != nil {
+			return nil, fmt.Errorf("cursor field %q: %s", sf.Field, err)
+		}
+		c[sf.Field] = v
+	}
+	return c, nil
+}
+
+func cursorValue(r json.RawMessage) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(r))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		var t cursorTime
+		if _, ok := v["time"]; ok && len(v) == 1 && json.Unmarshal(r, &t) == nil {
+			return t.Time, nil
+		}
+	}
+	return nil, fmt.Errorf("not a scalar")
+}
+
+// CursorFor returns the cursor pointing after item. Sort field values are
+// read from the struct fields whose json tag (or lower cased name) matches.
+func (q *ListQuery) CursorFor(item interface{}) string {
+	rv := reflect.Indirect(reflect.ValueOf(item))
+	c := map[string]interface{}{}
+	for _, sf := range q.Sort {
+		v, ok := fieldByName(rv, sf.Field)
+		if !ok {
+			continue
+		}
+		switch t := v.(type) {
+		case time.Time:
+			v = cursorTime{t}
+		case *time.Time:
+			if t != nil {
+				v = cursorTime{*t}
+			}
+		}
+		c[sf.Field] = v
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func fieldByName(rv reflect.Value, name string) (interface{}, bool) {
+	if rv.Kind() == reflect.Map {
+		v := rv.MapIndex(reflect.ValueOf(name))
+		if !v.IsValid() {
+			return nil, false
+		}
+		return v.Interface(), true
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, false
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.Anonymous {
+			if v, ok := fieldByName(reflect.Indirect(rv.Field(i)), name); ok {
+				return v, true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if n := strings.Split(f.Tag.Get("json"), ",")[0]; n == name || strings.ToLower(f.Name) == name {
+			return rv.Field(i).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// Page is the envelope of list responses.
+type Page struct {
+	Items      interface{} `json:"items"`
+	Total      *int64      `json:"total,omitempty"`
+	Offset     int         `json:"offset"`
+	Limit      int         `json:"limit"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// NewPage builds the envelope of a list response. items must be a slice;
+// total is only reported when it isn't negative. With cursor pagination
+// the next cursor is derived from the last item when the page is full.
+func (q *ListQuery) NewPage(items interface{}, total int64) *Page {
+	p := &Page{Items: items, Offset: q.Offset, Limit: q.Limit}
+	if total >= 0 {
+		p.Total = &total
+	}
+
+	rv := reflect.ValueOf(items)
+	if q.useCursor && rv.Kind() == reflect.Slice && rv.Len() >= q.Limit && rv.Len() > 0 {
+		p.NextCursor = q.CursorFor(rv.Index(rv.Len() - 1).Interface())
+	}
+	return p
+}
+
+// WritePage writes the page envelope and the Link header pointing to the
+// first, previous, next and last pages.
+func WritePage(req *restful.Request, resp *restful.Response, q *ListQuery, p *Page) error {
+	links := []string{}
+	link := func(rel string, params map[string]string) {
+		u := *req.Request.URL
+		v := u.Query()
+		v.Del("page")
+		for k, val := range params {
+			v.Set(k, val)
+		}
+		u.RawQuery = v.Encode()
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel))
+	}
+
+	if q.useCursor {
+		if p.NextCursor != "" {
+			link("next", map[string]string{"cursor": p.NextCursor})
+		}
+	} else {
+		limit := strconv.Itoa(p.Limit)
+		link("first", map[string]string{"offset": "0", "limit": limit})
+		if p.Offset > 0 {
+			prev := p.Offset - p.Limit
+			if prev < 0 {
+				prev = 0
+			}
+			link("prev", map[string]string{"offset": strconv.Itoa(prev), "limit": limit})
+		}
+		rv := reflect.ValueOf(p.Items)
+		more := rv.Kind() == reflect.Slice && rv.Len() >= p.Limit
+		if p.Total != nil {
+			more = int64(p.Offset+p.Limit) < *p.Total
+			last := 0
+			if *p.Total > 0 {
+				last = int((*p.Total - 1) / int64(p.Limit) * int64(p.Limit))
+			}
+			link("last", map[string]string{"offset": strconv.Itoa(last), "limit": limit})
+		}
+		if more {
+			link("next", map[string]string{"offset": strconv.Itoa(p.Offset + p.Limit), "limit": limit})
+		}
+	}
+
+	if len(links) > 0 {
+		resp.AddHeader("Link", strings.Join(links, ", "))
+	}
+	if p.Total != nil {
+		resp.AddHeader("X-Total-Count", strconv.FormatInt(*p.Total, 10))
+	}
+	return WriteResponse(req, resp, 200, p)
+}
+
+// DocList documents the list parameters of a route in swagger.
+func DocList(opts ListOptions) func(*restful.RouteBuilder) {
+	return func(rb *restful.RouteBuilder) {
+		rb.Param(restful.QueryParameter("limit", "maximum number of items").DataType("integer"))
+		rb.Param(restful.QueryParameter("offset", "number of items to skip").DataType("integer"))
+		rb.Param(restful.QueryParameter("page", "page number, starting at 1").DataType("integer"))
+		rb.Param(restful.QueryParameter("cursor", "opaque cursor from the previous page"))
+		if len(opts.Sortable) > 0 {
+			rb.Param(restful.QueryParameter("sort", "comma separated fields, prefix with - to sort descending: "+strings.Join(opts.Sortable, ", ")))
+		}
+		for _, f := range opts.Filterable {
+			rb.Param(restful.QueryParameter(f, "filter, use "+f+"[op] for eq, ne, lt, lte, gt, gte, like or in"))
+		}
+	}
+}
+
+// escapeLike escapes the wildcards of a user supplied like pattern except
+// for "*", which is translated to "%".
+func escapeLike(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return strings.Replace(s, "*", "%", -1)
+}
+
+// LikePattern returns the SQL like pattern of a "like" filter value.
+func (f Filter) LikePattern() string {
+	return escapeLike(f.Value)
+}
@@ -0,0 +1,164 @@
+package system
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+var listTestOptions = ListOptions{
+	Sortable:   []string{"title", "created"},
+	Filterable: []string{"title", "stars"},
+	Types:      map[string]string{"stars": "int"},
+}
+
+func listRequest(url string) *restful.Request {
+	return restful.NewRequest(httptest.NewRequest("GET", url, nil))
+}
+
+func cursor(v string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(v))
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		offset  int
+		limit   int
+		sort    []SortField
+		filters []Filter
+		cursor  map[string]interface{}
+		err     bool
+	}{
+		{"defaults", "/notes", 0, 20, nil, nil, nil, false},
+		{"offset", "/notes?offset=40&limit=10", 40, 10, nil, nil, nil, false},
+		{"page", "/notes?page=3&limit=10", 20, 10, nil, nil, nil, false},
+		{"limit capped", "/notes?limit=1000", 0, 100, nil, nil, nil, false},
+		{"bad limit", "/notes?limit=0", 0, 0, nil, nil, nil, true},
+		{"sort", "/notes?sort=-created,title", 0, 20, []SortField{{"created", true}, {"title", false}}, nil, nil, false},
+		{"sort not allowed", "/notes?sort=secret", 0, 0, nil, nil, nil, true},
+		{"filters", "/notes?title=a&stars[gte]=3&secret=x", 0, 20, nil, []Filter{{"stars", "gte", "3"}, {"title", "eq", "a"}}, nil, false},
+		{"typed filter", "/notes?stars[in]=3,x", 0, 0, nil, nil, nil, true},
+		{"unknown operator", "/notes?stars[near]=3", 0, 0, nil, nil, nil, true},
+		{"first cursor page", "/notes?cursor=&sort=title", 0, 20, []SortField{{"title", false}, {"id", false}}, nil, nil, false},
+		{"cursor", "/notes?sort=title&cursor=" + cursor(`{"title":"b","id":12345678901234567}`), 0, 20,
+			[]SortField{{"title", false}, {"id", false}}, nil,
+			map[string]interface{}{"title": "b", "id": int64(12345678901234567)}, false},
+		{"time cursor", "/notes?sort=created&cursor=" + cursor(`{"created":{"time":"2026-01-02T03:04:05Z"},"id":null}`), 0, 20,
+			[]SortField{{"created", false}, {"id", false}}, nil,
+			map[string]interface{}{"created": time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), "id": nil}, false},
+		{"cursor operator", "/notes?cursor=" + cursor(`{"id":{"$ne":null}}`), 0, 0, nil, nil, nil, true},
+		{"cursor array", "/notes?cursor=" + cursor(`{"id":[1,2]}`), 0, 0, nil, nil, nil, true},
+		{"cursor missing field", "/notes?sort=title&cursor=" + cursor(`{"id":1}`), 0, 0, nil, nil, nil, true},
+		{"cursor extra field", "/notes?cursor=" + cursor(`{"id":1,"secret":"x"}`), 0, 0, nil, nil, nil, true},
+		{"cursor garbage", "/notes?cursor=!!", 0, 0, nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := ParseList(listRequest(tt.url), listTestOptions)
+			if tt.err {
+				if ae, ok := err.(ApiError); !ok || ae.Code != 400 {
+					t.Fatalf("error %v, want a 400", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.Offset != tt.offset || q.Limit != tt.limit {
+				t.Errorf("offset %d limit %d, want %d %d", q.Offset, q.Limit, tt.offset, tt.limit)
+			}
+			if !reflect.DeepEqual(q.Sort, tt.sort) {
+				t.Errorf("sort %v, want %v", q.Sort, tt.sort)
+			}
+			if len(q.Filters) > 1 && q.Filters[0].Field > q.Filters[1].Field {
+				q.Filters[0], q.Filters[1] = q.Filters[1], q.Filters[0]
+			}
+			if !reflect.DeepEqual(q.Filters, tt.filters) {
+				t.Errorf("filters %v, want %v", q.Filters, tt.filters)
+			}
+			if !reflect.DeepEqual(q.Cursor, tt.cursor) {
+				t.Errorf("cursor %#v, want %#v", q.Cursor, tt.cursor)
+			}
+		})
+	}
+}
+
+type listTestNote struct {
+	ID      int64     `json:"id"`
+	Title   string    `json:"title"`
+	Created time.Time `json:"created"`
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	q, err := ParseList(listRequest("/notes?cursor=&sort=-created"), listTestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	c := q.CursorFor(listTestNote{ID: 7, Title: "a", Created: created})
+
+	next, err := ParseList(listRequest("/notes?sort=-created&cursor="+c), listTestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"created": created, "id": int64(7)}
+	if !reflect.DeepEqual(next.Cursor, want) {
+		t.Errorf("cursor %#v, want %#v", next.Cursor, want)
+	}
+}
+
+func TestWritePage(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		items []listTestNote
+		total int64
+		link  string
+		count string
+	}{
+		{"first page", "/notes?limit=2", make([]listTestNote, 2), 5, `</notes?limit=2&offset=0>; rel="first", </notes?limit=2&offset=4>; rel="last", </notes?limit=2&offset=2>; rel="next"`, "5"},
+		{"middle page", "/notes?page=2&limit=2", make([]listTestNote, 2), 5, `</notes?limit=2&offset=0>; rel="first", </notes?limit=2&offset=0>; rel="prev", </notes?limit=2&offset=4>; rel="last", </notes?limit=2&offset=4>; rel="next"`, "5"},
+		{"last page", "/notes?offset=4&limit=2", make([]listTestNote, 1), 5, `</notes?limit=2&offset=0>; rel="first", </notes?limit=2&offset=2>; rel="prev", </notes?limit=2&offset=4>; rel="last"`, "5"},
+		{"no total", "/notes?limit=2", make([]listTestNote, 2), -1, `</notes?limit=2&offset=0>; rel="first", </notes?limit=2&offset=2>; rel="next"`, ""},
+		{"cursor", "/notes?cursor=&limit=2", []listTestNote{{ID: 1}, {ID: 2}}, -1, `</notes?cursor=` + cursor(`{"id":2}`) + `&limit=2>; rel="next"`, ""},
+		{"last cursor page", "/notes?cursor=&limit=2", []listTestNote{{ID: 1}}, -1, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := listRequest(tt.url)
+			q, err := ParseList(req, listTestOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			if err := WritePage(req, restful.NewResponse(w), q, q.NewPage(tt.items, tt.total)); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Link"); got != tt.link {
+				t.Errorf("Link %s, want %s", got, tt.link)
+			}
+			if got := w.Header().Get("X-Total-Count"); got != tt.count {
+				t.Errorf("X-Total-Count %q, want %q", got, tt.count)
+			}
+
+			var page struct {
+				Items  []listTestNote
+				Offset int
+				Limit  int
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatalf("body %q: %s", w.Body.String(), err)
+			}
+			if len(page.Items) != len(tt.items) || page.Limit != q.Limit {
+				t.Errorf("page %+v, want %d items", page, len(tt.items))
+			}
+		})
+	}
+}
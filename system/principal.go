@@ -0,0 +1,55 @@
+package system
+
+import (
+	"github.com/emicklei/go-restful"
+)
+
+// Key to use when setting the authenticated principal.
+const PrincipalKey = "app.principal"
+
+// Principal is the identity a request has been authenticated as.
+type Principal struct {
+	ID     string
+	Name   string
+	Method string // authentication method, e.g. "jwt", "apikey" or "basic"
+	Roles  []string
+	Scopes []string
+	Claims map[string]interface{}
+}
+
+// HasRole reports whether the principal has been granted role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the principal has been granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPrincipal stores the authenticated principal on the request and its
+// context.
+func SetPrincipal(req *restful.Request, p *Principal) {
+	req.SetAttribute(PrincipalKey, p)
+	withValue(req, principalContextKey, p)
+}
+
+// GetPrincipal returns the authenticated principal or nil for anonymous
+// requests.
+func GetPrincipal(req *restful.Request) *Principal {
+	p, ok := req.Attribute(PrincipalKey).(*Principal)
+	if !ok {
+		return nil
+	}
+	return p
+}
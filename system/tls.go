@@ -0,0 +1,208 @@
+package system
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/pelletier/go-toml"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require_any":     tls.RequireAnyClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+// newTLSConfig builds the server TLS configuration from the [tls] section:
+//
+//	[tls]
+//	cert_file = "/path/to/server.crt"
+//	key_file = "/path/to/server.key"
+//	min_version = "1.2" # 1.0, 1.1, 1.2 or 1.3
+//	cipher_suites = ["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"] # TLS 1.2 and below
+//	client_ca_file = "/path/to/clients-ca.pem"
+//	client_auth = "require" # none, request, require_any, verify_if_given or require
+//	reload_interval = 10 # seconds between checks for changed files
+//
+// The certificate, key and client CA files are reloaded when they change,
+// so renewed certificates are picked up without a restart.
+func newTLSConfig(config *toml.TomlTree) (*tls.Config, error) {
+	base := &tls.Config{NextProtos: []string{"http/1.1"}}
+	if http2Enabled(config) {
+		base.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	v := config.GetDefault("tls.min_version", "1.2").(string)
+	min, ok := tlsVersions[v]
+	if !ok {
+		return nil, fmt.Errorf("tls: unknown min_version %q", v)
+	}
+	base.MinVersion = min
+
+	if suites, ok := config.Get("tls.cipher_suites").([]interface{}); ok {
+		ids := map[string]uint16{}
+		for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			ids[cs.Name] = cs.ID
+		}
+		for _, s := range suites {
+			id, ok := ids[fmt.Sprint(s)]
+			if !ok {
+				return nil, fmt.Errorf("tls: unknown cipher suite %q", s)
+			}
+			base.CipherSuites = append(base.CipherSuites, id)
+		}
+	}
+
+	ca := config.GetDefault("tls.client_ca_file", "").(string)
+	mode := "none"
+	if ca != "" {
+		mode = "require"
+	}
+	mode = config.GetDefault("tls.client_auth", mode).(string)
+	auth, ok := clientAuthTypes[mode]
+	if !ok {
+		return nil, fmt.Errorf("tls: unknown client_auth %q", mode)
+	}
+	if ca == "" && (auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("tls: client_auth %q requires a client_ca_file", mode)
+	}
+	base.ClientAuth = auth
+
+	r := &tlsReloader{
+		certFile: config.GetDefault("tls.cert_file", "").(string),
+		keyFile:  config.GetDefault("tls.key_file", "").(string),
+		caFile:   ca,
+		interval: time.Duration(config.GetDefault("tls.reload_interval", int64(10)).(int64)) * time.Second,
+		base:     base,
+		modTimes: map[string]time.Time{},
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return r.config(), nil
+	}
+	return cfg, nil
+}
+
+// tlsReloader keeps the TLS configuration in sync with its files.
+type tlsReloader struct {
+	certFile, keyFile, caFile string
+	interval                  time.Duration
+
+	mu       sync.Mutex
+	base     *tls.Config
+	current  *tls.Config
+	modTimes map[string]time.Time
+	checked  time.Time
+}
+
+// load reads the certificate and CA files.
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: certificate load failed:\n%s", err)
+	}
+
+	cfg := r.base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("tls: client CA load failed:\n%s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificate found in %s", r.caFile)
+		}
+		cfg.ClientCAs = pool
+	}
+
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if fi, err := os.Stat(f); err == nil {
+			r.modTimes[f] = fi.ModTime()
+		}
+	}
+	r.current = cfg
+	return nil
+}
+
+// config returns the current configuration, reloading the files when they
+// changed. Failed reloads keep the previous configuration.
+func (r *tlsReloader) config() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < r.interval {
+		return r.current
+	}
+	r.checked = time.Now()
+
+	changed := false
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && !fi.ModTime().Equal(r.modTimes[f]) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := r.load(); err != nil {
+			log.Errorf("TLS reload failed, keeping the current certificates: %s", err)
+		} else {
+			log.Info("TLS certificates reloaded")
+		}
+	}
+	return r.current
+}
+
+// ClientCertificate returns the verified certificate a client presented
+// over mutual TLS, or nil.
+func ClientCertificate(req *restful.Request) *x509.Certificate {
+	cs := req.Request.TLS
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return cs.VerifiedChains[0][0]
+}
+
+// ClientCertificate returns the verified client certificate of the
+// request, see system.ClientCertificate.
+func (ct *Controller) ClientCertificate(req *restful.Request) *x509.Certificate {
+	return ClientCertificate(req)
+}
+
+// CertificateIdentity returns the name a certificate identifies: the first
+// URI SAN (e.g. a SPIFFE ID), DNS SAN or email address, else the subject
+// common name.
+func CertificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return strings.TrimSpace(cert.Subject.CommonName)
+}
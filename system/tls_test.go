@@ -0,0 +1,219 @@
+package system
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for cn and its key to dir,
+// returning their paths.
+func writeCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir, "server")
+	ca, _ := writeCert(t, dir, "clients")
+	junk := filepath.Join(dir, "junk.pem")
+	if err := ioutil.WriteFile(junk, []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files := "[tls]\ncert_file = \"" + cert + "\"\nkey_file = \"" + key + "\"\n"
+
+	tests := []struct {
+		name    string
+		config  string
+		min     uint16
+		auth    tls.ClientAuthType
+		protos  []string
+		suites  int
+		invalid bool
+	}{
+		{"defaults", files, tls.VersionTLS12, tls.NoClientCert, []string{"h2", "http/1.1"}, 0, false},
+		{"without http2", files + "[http2]\nenabled = false\n", tls.VersionTLS12, tls.NoClientCert, []string{"http/1.1"}, 0, false},
+		{"min version", files + "min_version = \"1.3\"\n", tls.VersionTLS13, tls.NoClientCert, []string{"h2", "http/1.1"}, 0, false},
+		{"cipher suites", files + "cipher_suites = [\"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256\", \"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384\"]\n", tls.VersionTLS12, tls.NoClientCert, []string{"h2", "http/1.1"}, 2, false},
+		{"client CA", files + "client_ca_file = \"" + ca + "\"\n", tls.VersionTLS12, tls.RequireAndVerifyClientCert, []string{"h2", "http/1.1"}, 0, false},
+		{"optional client certificates", files + "client_ca_file = \"" + ca + "\"\nclient_auth = \"verify_if_given\"\n", tls.VersionTLS12, tls.VerifyClientCertIfGiven, []string{"h2", "http/1.1"}, 0, false},
+		{"unverified client certificates", files + "client_auth = \"request\"\n", tls.VersionTLS12, tls.RequestClientCert, []string{"h2", "http/1.1"}, 0, false},
+		{"unknown min version", files + "min_version = \"2.0\"\n", 0, 0, nil, 0, true},
+		{"unknown cipher suite", files + "cipher_suites = [\"TLS_NULL\"]\n", 0, 0, nil, 0, true},
+		{"unknown client auth", files + "client_auth = \"maybe\"\n", 0, 0, nil, 0, true},
+		{"verification without a CA", files + "client_auth = \"require\"\n", 0, 0, nil, 0, true},
+		{"CA without certificates", files + "client_ca_file = \"" + junk + "\"\n", 0, 0, nil, 0, true},
+		{"missing CA", files + "client_ca_file = \"" + filepath.Join(dir, "none.pem") + "\"\n", 0, 0, nil, 0, true},
+		{"missing certificate", "[tls]\ncert_file = \"" + filepath.Join(dir, "none.crt") + "\"\nkey_file = \"" + key + "\"\n", 0, 0, nil, 0, true},
+		{"key of another certificate", "[tls]\ncert_file = \"" + cert + "\"\nkey_file = \"" + filepath.Join(dir, "clients.key") + "\"\n", 0, 0, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := newTLSConfig(newTestApp(t, tt.config).Config)
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MinVersion != tt.min || cfg.ClientAuth != tt.auth || len(cfg.CipherSuites) != tt.suites {
+				t.Errorf("min version %x client auth %v %d suites, want %x %v %d", cfg.MinVersion, cfg.ClientAuth, len(cfg.CipherSuites), tt.min, tt.auth, tt.suites)
+			}
+			if len(cfg.NextProtos) != len(tt.protos) || cfg.NextProtos[0] != tt.protos[0] {
+				t.Errorf("protocols %v, want %v", cfg.NextProtos, tt.protos)
+			}
+
+			// connections get the loaded certificate and client CAs
+			conn, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+			if err != nil || len(conn.Certificates) != 1 {
+				t.Fatalf("connection config %v, %v", conn, err)
+			}
+			if (conn.ClientCAs != nil) != (tt.auth == tls.RequireAndVerifyClientCert || tt.auth == tls.VerifyClientCertIfGiven) {
+				t.Errorf("client CAs %v with client auth %v", conn.ClientCAs, tt.auth)
+			}
+			if conn.MinVersion != tt.min || conn.ClientAuth != tt.auth {
+				t.Errorf("connection min version %x client auth %v, want %x %v", conn.MinVersion, conn.ClientAuth, tt.min, tt.auth)
+			}
+		})
+	}
+}
+
+// leafName returns the common name of the certificate served with cfg.
+func leafName(t *testing.T, cfg *tls.Config) string {
+	conn, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(conn.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir, "old")
+	renewedCert, renewedKey := writeCert(t, dir, "new")
+	server := filepath.Join(dir, "server.crt")
+	serverKey := filepath.Join(dir, "server.key")
+	// install copies the files of a certificate over the served ones, with a
+	// later modification time than the last install
+	stamp := time.Now()
+	install := func(certFile, keyFile string) {
+		for src, dst := range map[string]string{certFile: server, keyFile: serverKey} {
+			b, err := ioutil.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(dst, stamp, stamp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stamp = stamp.Add(time.Second)
+	}
+	install(cert, key)
+
+	tests := []struct {
+		name     string
+		interval int
+		install  func()
+		served   string
+	}{
+		{"renewed", 0, func() { install(renewedCert, renewedKey) }, "new"},
+		{"unchanged", 0, func() {}, "old"},
+		{"within the reload interval", 3600, func() { install(renewedCert, renewedKey) }, "old"},
+		// a half-written renewal keeps the previous certificate
+		{"key of another certificate", 0, func() { install(renewedCert, key) }, "old"},
+		{"invalid certificate", 0, func() {
+			install(cert, key)
+			ioutil.WriteFile(server, []byte("junk"), 0600)
+			os.Chtimes(server, stamp, stamp)
+		}, "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			install(cert, key)
+			config := fmt.Sprintf("[tls]\ncert_file = %q\nkey_file = %q\nreload_interval = %d\n", server, serverKey, tt.interval)
+			cfg, err := newTLSConfig(newTestApp(t, config).Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := leafName(t, cfg); got != "old" {
+				t.Fatalf("serving %q before the change", got)
+			}
+
+			tt.install()
+			if got := leafName(t, cfg); got != tt.served {
+				t.Errorf("serving %q, want %q", got, tt.served)
+			}
+		})
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/billing")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		id   string
+	}{
+		{"URI", &x509.Certificate{URIs: []*url.URL{spiffe}, DNSNames: []string{"billing.example.org"}}, "spiffe://example.org/billing"},
+		{"DNS name", &x509.Certificate{DNSNames: []string{"billing.example.org"}, EmailAddresses: []string{"ops@example.org"}}, "billing.example.org"},
+		{"email", &x509.Certificate{EmailAddresses: []string{"ops@example.org"}, Subject: pkix.Name{CommonName: "ops"}}, "ops@example.org"},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: " billing "}}, "billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := CertificateIdentity(tt.cert); id != tt.id {
+				t.Errorf("identity %q, want %q", id, tt.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package system
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Trace identifies the span of work serving a request, propagated with the
+// W3C traceparent header so that logs and calls to other services can be
+// correlated.
+type Trace struct {
+	TraceID  string // 32 hex digits, shared by all spans of a trace
+	SpanID   string // 16 hex digits
+	ParentID string // span of the caller, "" for a new trace
+	Sampled  bool
+}
+
+var traceparent = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// ParseTraceparent reads a traceparent header, nil if it is missing or
+// invalid.
+func ParseTraceparent(h string) *Trace {
+	m := traceparent.FindStringSubmatch(strings.TrimSpace(strings.ToLower(h)))
+	if m == nil || m[1] == strings.Repeat("0", 32) || m[2] == strings.Repeat("0", 16) {
+		return nil
+	}
+	var flags byte
+	fmt.Sscanf(m[3], "%02x", &flags)
+	return &Trace{TraceID: m[1], SpanID: m[2], Sampled: flags&1 == 1}
+}
+
+// NewTrace starts a span: a child of parent, or the root of a new trace
+// when parent is nil.
+func NewTrace(parent *Trace) *Trace {
+	if parent == nil {
+		return &Trace{TraceID: randomHex(16), SpanID: randomHex(8)}
+	}
+	return &Trace{
+		TraceID:  parent.TraceID,
+		SpanID:   randomHex(8),
+		ParentID: parent.SpanID,
+		Sampled:  parent.Sampled,
+	}
+}
+
+// Traceparent returns the header value propagating the span to a service
+// called within it.
+func (t *Trace) Traceparent() string {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + flags
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
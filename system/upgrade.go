@@ -0,0 +1,253 @@
+package system
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	upgradeFDsEnv   = "RESTAPI_UPGRADE_FDS"
+	upgradeReadyEnv = "RESTAPI_UPGRADE_READY_FD"
+)
+
+// upgradesEnabled reports whether SIGUSR2 upgrades the binary, see the
+// [upgrade] section:
+//
+//	[upgrade]
+//	enabled = true # on SIGUSR2 start the new binary on the same sockets
+//	timeout = 30 # seconds the new process has to become ready
+//
+// The running process starts its executable again with the same arguments
+// and hands it the listening sockets. Once the new process serves them it
+// signals readiness and the old one drains its connections and exits, so
+// no connection is refused during a deploy. If the new process fails or
+// times out the old one keeps serving. Sockets the new configuration no
+// longer lists are closed by the new process.
+//
+// Under systemd the old process reports the new one as the main process
+// through NOTIFY_SOCKET, which takes Type=notify or NotifyAccess=main in the
+// unit; otherwise systemd considers the service stopped when the old
+// process exits.
+func upgradesEnabled(a *Application) bool {
+	return a.Config.GetDefault("upgrade.enabled", false).(bool)
+}
+
+// upgrade starts the new binary on the listeners and waits for it to be
+// ready.
+func (a *Application) upgrade(ls []*listener) error {
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("upgrade: executable lookup failed:\n%s", err)
+	}
+
+	specs := make([]string, len(ls))
+	files := make([]*os.File, 0, len(ls)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, l := range ls {
+		fl, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("upgrade: can't pass listener %s", l.spec)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("upgrade: listener %s:\n%s", l.spec, err)
+		}
+		files = append(files, f)
+		specs[i] = l.spec
+		if l.admin {
+			specs[i] = "admin=" + l.spec
+		}
+	}
+
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: %s", err)
+	}
+	defer ready.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		upgradeFDsEnv+"="+strings.Join(specs, "\n"),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(ls)),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("upgrade: %s start failed:\n%s", path, err)
+	}
+	w.Close() // the child holds the write end now
+	log.Infof("Upgrade started %s as process %d", path, cmd.Process.Pid)
+
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := ready.Read(b); err != nil {
+			done <- fmt.Errorf("upgrade: process %d exited before it was ready", cmd.Process.Pid)
+			return
+		}
+		done <- nil
+	}()
+
+	timeout := time.Duration(a.Config.GetDefault("upgrade.timeout", int64(30)).(int64)) * time.Second
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("upgrade: process %d not ready after %s", cmd.Process.Pid, timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	go cmd.Wait()
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Errorf("Upgrade: systemd notification failed: %s", err)
+	}
+
+	// the sockets now belong to the new process too, don't remove them
+	for _, l := range ls {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	atomic.StoreInt32(&a.upgraded, 1)
+	return nil
+}
+
+// Upgraded reports whether the application handed its listeners over to a
+// new process and shuts down for it. Shutdown hooks use it to leave shared
+// state, like a service registration, to the new process.
+func (a *Application) Upgraded() bool {
+	return atomic.LoadInt32(&a.upgraded) == 1
+}
+
+var upgraded struct {
+	sync.Once
+	specs     []string
+	listeners []net.Listener
+	used      []bool
+	err       error
+}
+
+// upgradeListeners returns the listeners handed over by the previous
+// process for spec, or nil when not started by an upgrade.
+func upgradeListeners(spec string, admin bool) ([]net.Listener, error) {
+	upgraded.Do(func() {
+		env := os.Getenv(upgradeFDsEnv)
+		if env == "" {
+			return
+		}
+		for i, s := range strings.Split(env, "\n") {
+			fd := 3 + i
+			syscall.CloseOnExec(fd)
+			f := os.NewFile(uintptr(fd), "upgrade-"+s)
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				upgraded.err = fmt.Errorf("upgrade: inherited socket %s: %s", s, err)
+				return
+			}
+			if tl, ok := l.(*net.TCPListener); ok {
+				l = tcpKeepAliveListener{tl}
+			}
+			upgraded.specs = append(upgraded.specs, s)
+			upgraded.listeners = append(upgraded.listeners, l)
+			upgraded.used = append(upgraded.used, false)
+		}
+		os.Unsetenv(upgradeFDsEnv)
+	})
+	if upgraded.err != nil {
+		return nil, upgraded.err
+	}
+
+	if admin {
+		spec = "admin=" + spec
+	}
+	ls := []net.Listener{}
+	for i, s := range upgraded.specs {
+		if s == spec {
+			ls = append(ls, upgraded.listeners[i])
+			upgraded.used[i] = true
+		}
+	}
+	if len(ls) == 0 {
+		return nil, nil
+	}
+	return ls, nil
+}
+
+// closeUnusedUpgradeListeners closes the listeners handed over by the
+// previous process which the configuration no longer lists, removing their
+// unix socket files.
+func closeUnusedUpgradeListeners() {
+	for i, l := range upgraded.listeners {
+		if upgraded.used[i] {
+			continue
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		l.Close()
+		upgraded.used[i] = true
+		log.Infof("Upgrade: closed socket %s, no longer configured", upgraded.specs[i])
+	}
+}
+
+// upgradeReady tells the previous process that this one serves, so that it
+// can drain and exit.
+func upgradeReady() {
+	s := os.Getenv(upgradeReadyEnv)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		log.Errorf("Upgrade: invalid %s %q", upgradeReadyEnv, s)
+		return
+	}
+	ppid := os.Getppid()
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Errorf("Upgrade: readiness notification failed: %s", err)
+		return
+	}
+	log.Infof("Upgrade: took over from process %d", ppid)
+}
+
+// sdNotify sends a state to systemd when it passed a NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
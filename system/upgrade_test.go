@@ -0,0 +1,187 @@
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("MAINPID=42"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	if err != nil || string(b[:n]) != "MAINPID=42" {
+		t.Errorf("got %q %v, want MAINPID=42", b[:n], err)
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("MAINPID=42"); err != nil {
+		t.Errorf("without systemd: %s", err)
+	}
+}
+
+func TestCloseUnusedUpgradeListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	kept, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kept.Close()
+	path := filepath.Join(t.TempDir(), "old.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as handed over, the previous process doesn't remove the file
+	unix.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	upgraded.Do(func() {})
+	upgraded.specs = []string{"old:1", "unix:" + path, "admin=kept:2"}
+	upgraded.listeners = []net.Listener{tcp, unix, kept}
+	upgraded.used = make([]bool, 3)
+	defer func() {
+		upgraded.specs, upgraded.listeners, upgraded.used = nil, nil, nil
+	}()
+
+	ls, err := upgradeListeners("kept:2", true)
+	if err != nil || len(ls) != 1 || ls[0] != kept {
+		t.Fatalf("got %v %v, want the kept listener", ls, err)
+	}
+	closeUnusedUpgradeListeners()
+
+	if _, err := net.Dial("tcp", tcp.Addr().String()); err == nil {
+		t.Error("unused tcp listener still open")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unused unix socket file left: %v", err)
+	}
+	if c, err := net.Dial("tcp", kept.Addr().String()); err != nil {
+		t.Errorf("listener in use closed: %s", err)
+	} else {
+		c.Close()
+	}
+}
+
+// TestUpgradeHandoff upgrades to the test binary itself, which serves the
+// inherited listener with its process ID when RESTAPI_TEST_UPGRADE is
+// "serve" and exits before it's ready when it's "fail".
+func TestUpgradeHandoff(t *testing.T) {
+	if mode := os.Getenv("RESTAPI_TEST_UPGRADE"); mode != "" && os.Getenv(upgradeFDsEnv) != "" {
+		upgradeChild(mode)
+		return
+	}
+
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestUpgradeHandoff$"}
+	defer func() { os.Args = args }()
+	defer os.Unsetenv("RESTAPI_TEST_UPGRADE")
+
+	listen := func(t *testing.T) []*listener {
+		ls := []*listener{}
+		for _, spec := range []string{"127.0.0.1:0", "old:1"} {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			ls = append(ls, &listener{Listener: l, spec: spec})
+		}
+		return ls
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		a := newTestApp(t, "[upgrade]\nenabled = true\ntimeout = 10\n")
+		ls := listen(t)
+		os.Setenv("RESTAPI_TEST_UPGRADE", "fail")
+		if err := a.upgrade(ls); err == nil || a.Upgraded() {
+			t.Fatalf("upgrade to a failing process: %v, upgraded %v", err, a.Upgraded())
+		}
+		// the old process keeps serving
+		c, err := net.Dial("tcp", ls[0].Addr().String())
+		if err != nil {
+			t.Fatalf("listener closed after a failed upgrade: %s", err)
+		}
+		c.Close()
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		a := newTestApp(t, "[upgrade]\nenabled = true\ntimeout = 10\n")
+		ls := listen(t)
+		os.Setenv("RESTAPI_TEST_UPGRADE", "serve")
+		if err := a.upgrade(ls); err != nil || !a.Upgraded() {
+			t.Fatalf("upgrade: %v, upgraded %v", err, a.Upgraded())
+		}
+
+		// the old process stops, the new one serves the same socket
+		addr, unused := ls[0].Addr().String(), ls[1].Addr().String()
+		for _, l := range ls {
+			l.Close()
+		}
+		defer http.Get("http://" + addr + "/exit")
+
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatalf("request after the handoff: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if pid, err := strconv.Atoi(string(b)); err != nil || pid == os.Getpid() {
+			t.Errorf("served by %q, want the new process", b)
+		}
+		if c, err := net.Dial("tcp", unused); err == nil {
+			c.Close()
+			t.Error("socket the new process doesn't use still open")
+		}
+	})
+}
+
+// upgradeChild is the new process of TestUpgradeHandoff.
+func upgradeChild(mode string) {
+	if mode == "fail" {
+		os.Exit(1)
+	}
+	ls, err := upgradeListeners("127.0.0.1:0", false)
+	if err != nil || len(ls) != 1 {
+		fmt.Fprintf(os.Stderr, "inherited listeners %v: %v\n", ls, err)
+		os.Exit(1)
+	}
+	closeUnusedUpgradeListeners()
+
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, os.Getpid())
+	})
+	mux.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		close(done)
+	})
+	go http.Serve(ls[0], mux)
+	upgradeReady()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+	}
+	os.Exit(0)
+}
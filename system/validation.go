@@ -0,0 +1,241 @@
+package system
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FieldError describes why a single field failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field error of a request.
+type ValidationError []FieldError
+
+func (ve ValidationError) Error() string {
+	msgs := make([]string, 0, len(ve))
+	for _, fe := range ve {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// ApiError converts the validation error for clients.
+func (ve ValidationError) ApiError(errorCode string) error {
+	ae := NewTypedError(errorCode, ve.Error(), nil).(ApiError)
+	return ae.With("errors", []FieldError(ve))
+}
+
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+var regexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: map[string]*regexp.Regexp{}}
+
+func compileRule(expr string) (*regexp.Regexp, error) {
+	regexps.Lock()
+	defer regexps.Unlock()
+	if re, ok := regexps.m[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexps.m[expr] = re
+	return re, nil
+}
+
+// Validate checks the struct pointed to by v against the rules of its
+// validate tags:
+//
+//	type NewUser struct {
+//		Username string `json:"username" validate:"required,min=3,max=100,regex=^[a-z0-9_]+$"`
+//		Email    string `json:"email" validate:"required,email"`
+//		Role     string `json:"role" validate:"enum=admin|user"`
+//		Age      int    `json:"age" validate:"min=18"`
+//	}
+//
+// min and max apply to the length of strings and slices and to the value of
+// numbers. Nested structs are validated too. Rules other than required are
+// skipped for zero values, except min and max on numbers since 0 is a value:
+// declare optional numbers as pointers.
+func Validate(v interface{}) ValidationError {
+	errs := ValidationError{}
+	validateStruct(reflect.Indirect(reflect.ValueOf(v)), "", &errs)
+	return errs
+}
+
+func validateStruct(rv reflect.Value, prefix string, errs *ValidationError) {
+	if rv.Kind() != reflect.Struct {
+		return
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		fv := rv.Field(i)
+		name := prefix + fieldName(f)
+
+		if rules := f.Tag.Get("validate"); rules != "" && rules != "-" {
+			for _, rule := range splitRules(rules) {
+				if msg := checkRule(fv, rule); msg != "" {
+					r := rule
+					if i := strings.Index(r, "="); i > 0 {
+						r = r[:i]
+					}
+					*errs = append(*errs, FieldError{name, r, msg})
+				}
+			}
+		}
+
+		inner := reflect.Indirect(fv)
+		if inner.Kind() == reflect.Struct && inner.Type().PkgPath() != "time" {
+			p := name + "."
+			if f.Anonymous {
+				p = prefix
+			}
+			validateStruct(inner, p, errs)
+		}
+	}
+}
+
+// splitRules splits a validate tag on commas, except inside a regex rule
+// which must come last.
+func splitRules(tag string) []string {
+	rules := []string{}
+	for tag != "" {
+		if strings.HasPrefix(tag, "regex=") {
+			return append(rules, tag)
+		}
+		i := strings.Index(tag, ",")
+		if i < 0 {
+			return append(rules, tag)
+		}
+		rules = append(rules, tag[:i])
+		tag = tag[i+1:]
+	}
+	return rules
+}
+
+// checkRule returns an error message when the value breaks the rule.
+func checkRule(v reflect.Value, rule string) string {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i > 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+
+	zero := isZero(v)
+	if name == "required" {
+		if zero {
+			return "is required"
+		}
+		return ""
+	}
+	if zero && !((name == "min" || name == "max") && isNumber(v)) {
+		return ""
+	}
+	v = reflect.Indirect(v)
+
+	switch name {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid rule %q", rule)
+		}
+		n, isLen := measure(v)
+		if name == "min" && n < limit {
+			if isLen {
+				return fmt.Sprintf("must be at least %s long", arg)
+			}
+			return fmt.Sprintf("must be at least %s", arg)
+		}
+		if name == "max" && n > limit {
+			if isLen {
+				return fmt.Sprintf("must be at most %s long", arg)
+			}
+			return fmt.Sprintf("must be at most %s", arg)
+		}
+	case "regex":
+		re, err := compileRule(arg)
+		if err != nil {
+			return fmt.Sprintf("invalid rule %q", rule)
+		}
+		if !re.MatchString(fmt.Sprint(v.Interface())) {
+			return fmt.Sprintf("must match %s", arg)
+		}
+	case "enum":
+		s := fmt.Sprint(v.Interface())
+		for _, allowed := range strings.Split(arg, "|") {
+			if s == allowed {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s", strings.Replace(arg, "|", ", ", -1))
+	case "email":
+		if !emailRegexp.MatchString(fmt.Sprint(v.Interface())) {
+			return "must be a valid email address"
+		}
+	default:
+		return fmt.Sprintf("unknown rule %q", name)
+	}
+	return ""
+}
+
+// measure returns the length of strings and collections or the value of
+// numbers.
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(len([]rune(v.String()))), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false
+	}
+	return 0, false
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map:
+		return v.IsNil() || v.Len() == 0
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// fieldName returns the name clients know a field by.
+func fieldName(f reflect.StructField) string {
+	for _, tag := range []string{"path", "query", "header", "json"} {
+		if n := strings.Split(f.Tag.Get(tag), ",")[0]; n != "" && n != "-" {
+			return n
+		}
+	}
+	return f.Name
+}
@@ -0,0 +1,71 @@
+package system
+
+import (
+	"reflect"
+	"testing"
+)
+
+type validateTestAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type validateTestUser struct {
+	Username string              `json:"username" validate:"required,min=3,max=8,regex=^[a-z0-9_]+$"`
+	Email    string              `json:"email" validate:"email"`
+	Role     string              `json:"role" validate:"enum=admin|user"`
+	Age      int                 `json:"age" validate:"min=18"`
+	Score    *float64            `json:"score" validate:"max=10"`
+	Tags     []string            `json:"tags" validate:"max=2"`
+	Address  validateTestAddress `json:"address"`
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() validateTestUser {
+		return validateTestUser{Username: "bob", Age: 30, Address: validateTestAddress{"Paris"}}
+	}
+	score := func(f float64) *float64 { return &f }
+
+	tests := []struct {
+		name   string
+		change func(u *validateTestUser)
+		errs   []FieldError
+	}{
+		{"valid", func(u *validateTestUser) {}, nil},
+		{"required", func(u *validateTestUser) { u.Username = "" }, []FieldError{{"username", "required", "is required"}}},
+		{"too short", func(u *validateTestUser) { u.Username = "bo" }, []FieldError{{"username", "min", "must be at least 3 long"}}},
+		{"too long", func(u *validateTestUser) { u.Username = "bobbybobby" }, []FieldError{{"username", "max", "must be at most 8 long"}}},
+		{"regex", func(u *validateTestUser) { u.Username = "Bob!" }, []FieldError{{"username", "regex", "must match ^[a-z0-9_]+$"}}},
+		{"email", func(u *validateTestUser) { u.Email = "bob" }, []FieldError{{"email", "email", "must be a valid email address"}}},
+		{"empty email skipped", func(u *validateTestUser) { u.Email = "" }, nil},
+		{"enum", func(u *validateTestUser) { u.Role = "root" }, []FieldError{{"role", "enum", "must be one of admin, user"}}},
+		{"number too small", func(u *validateTestUser) { u.Age = 17 }, []FieldError{{"age", "min", "must be at least 18"}}},
+		{"zero number", func(u *validateTestUser) { u.Age = 0 }, []FieldError{{"age", "min", "must be at least 18"}}},
+		{"nil pointer skipped", func(u *validateTestUser) { u.Score = nil }, nil},
+		{"pointer", func(u *validateTestUser) { u.Score = score(11) }, []FieldError{{"score", "max", "must be at most 10"}}},
+		{"zero pointer", func(u *validateTestUser) { u.Score = score(0) }, nil},
+		{"slice length", func(u *validateTestUser) { u.Tags = []string{"a", "b", "c"} }, []FieldError{{"tags", "max", "must be at most 2 long"}}},
+		{"nested", func(u *validateTestUser) { u.Address.City = "" }, []FieldError{{"address.city", "required", "is required"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := valid()
+			tt.change(&u)
+			errs := Validate(&u)
+			if len(errs) == 0 && len(tt.errs) == 0 {
+				return
+			}
+			if !reflect.DeepEqual([]FieldError(errs), tt.errs) {
+				t.Errorf("errors %v, want %v", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestValidateUnknownRule(t *testing.T) {
+	v := struct {
+		Name string `validate:"uppercase"`
+	}{"bob"}
+	if errs := Validate(&v); len(errs) != 1 || errs[0].Message != `unknown rule "uppercase"` {
+		t.Errorf("errors %v, want the unknown rule reported", errs)
+	}
+}
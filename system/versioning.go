@@ -0,0 +1,306 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful/swagger"
+)
+
+// APIVersion is a version of the API. Retired versions get Deprecation,
+// Sunset and Link headers, configured per version in the [versioning]
+// section:
+//
+//	[versioning]
+//	default = "v1" # version of requests naming none, none by default
+//	header = "Accept-Version"
+//	vendor = "app" # Accept: application/vnd.app.v2+json
+//	swagger_path = "/{version}/apidocs.json"
+//
+//	[versioning.versions.v1]
+//	deprecated = 2026-01-01T00:00:00Z
+//	sunset = 2026-12-31T00:00:00Z
+//	link = "https://example.com/docs/migrate-to-v2"
+type APIVersion struct {
+	Name       string
+	Deprecated time.Time
+	Sunset     time.Time
+	Link       string
+	services   []*restful.WebService
+}
+
+// versionRoot maps the unversioned root of a web service to its root under
+// a version, e.g. /users to /v2/users.
+type versionRoot struct {
+	version string
+	base    string
+	root    string
+}
+
+type versioning struct {
+	versions map[string]*APIVersion
+	roots    []versionRoot
+}
+
+type versionKey struct{}
+
+// Version returns the API version name, declaring it on first use.
+func (a *Application) Version(name string) *APIVersion {
+	if v, ok := a.versioning.versions[name]; ok {
+		return v
+	}
+	if a.versioning.versions == nil {
+		a.versioning.versions = map[string]*APIVersion{}
+	}
+
+	v := &APIVersion{Name: name}
+	get := func(key string) interface{} {
+		return a.Config.GetPath([]string{"versioning", "versions", name, key})
+	}
+	if t, ok := get("deprecated").(time.Time); ok {
+		v.Deprecated = t
+	}
+	if t, ok := get("sunset").(time.Time); ok {
+		v.Sunset = t
+	}
+	if s, ok := get("link").(string); ok {
+		v.Link = s
+	}
+	a.versioning.versions[name] = v
+	return v
+}
+
+// VersionedWebService returns a new web service of an API version, rooted
+// at path under the version, e.g. /v2/users for path /users. Requests for
+// path are routed to it when they select the version with the
+// Accept-Version header or a vendor media type:
+//
+//	ws := app.VersionedWebService("v2", "/users")
+//	ws.Route(ws.GET("/{id}").To(getUserV2))
+//	app.Container.Add(ws)
+func (a *Application) VersionedWebService(version, path string) *restful.WebService {
+	return a.versionedWebService("", version, path)
+}
+
+func (a *Application) versionedWebService(prefix, version, path string) *restful.WebService {
+	v := a.Version(version)
+	path = "/" + strings.Trim(path, "/")
+	base := strings.TrimSuffix(prefix+path, "/")
+	root := strings.TrimSuffix(prefix+"/"+version+path, "/")
+
+	ws := new(restful.WebService).Path(root)
+	v.services = append(v.services, ws)
+	a.versioning.roots = append(a.versioning.roots, versionRoot{version, base, root})
+	return ws
+}
+
+// RequestVersion returns the API version a request was routed to, "" for
+// unversioned routes.
+func RequestVersion(req *restful.Request) string {
+	v, _ := req.Request.Context().Value(versionKey{}).(string)
+	return v
+}
+
+// under reports whether path is base or below it.
+func under(path, base string) bool {
+	return base == "" || path == base || strings.HasPrefix(path, base+"/")
+}
+
+// versionRouter routes requests to versioned web services. A version in
+// the path wins over the Accept-Version header, which wins over a vendor
+// media type, then the default version applies. Routes served without a
+// version are left alone.
+func (a *Application) versionRouter(next http.Handler) http.Handler {
+	if len(a.versioning.roots) == 0 {
+		return next
+	}
+
+	header := a.Config.GetDefault("versioning.header", "Accept-Version").(string)
+	var vendor *regexp.Regexp
+	if name := a.Config.GetDefault("versioning.vendor", "").(string); name != "" {
+		vendor = regexp.MustCompile(`^application/vnd\.` + regexp.QuoteMeta(name) + `\.([^+;]+)\+([^;\s]+)`)
+	}
+	def := a.Config.GetDefault("versioning.default", "").(string)
+
+	// roots served without a version
+	versioned := map[string]bool{}
+	for _, r := range a.versioning.roots {
+		versioned[r.root] = true
+	}
+	plain := []string{strings.TrimSuffix(a.Config.GetDefault("swagger.url", "/apidocs/").(string), "/")}
+	for _, ws := range a.Container.RegisteredWebServices() {
+		if root := strings.TrimSuffix(ws.RootPath(), "/"); root != "" && !versioned[root] {
+			plain = append(plain, root)
+		}
+	}
+
+	// longest roots first
+	roots := append([]versionRoot{}, a.versioning.roots...)
+	sort.SliceStable(roots, func(i, j int) bool {
+		return len(roots[i].base) > len(roots[j].base)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+
+		version := ""
+		for _, vr := range roots {
+			if under(path, vr.root) {
+				version = vr.version
+				break
+			}
+		}
+
+		// only requests for versioned roots select a version
+		if version == "" && versionable(path, roots, plain) {
+			requested, err := a.requestedVersion(r, header, vendor)
+			if err != nil {
+				WriteRequestError(err, a.errorRequest(r), restful.NewResponse(w))
+				return
+			}
+			if requested == "" {
+				requested = def
+			}
+			if requested != "" {
+				for _, vr := range roots {
+					if vr.version != requested || !under(path, vr.base) {
+						continue
+					}
+					if shadowed(path, vr.base, plain) {
+						break
+					}
+					r.URL.Path = vr.root + strings.TrimPrefix(path, vr.base)
+					r.URL.RawPath = ""
+					version = requested
+					// Accept is added by negotiation
+					w.Header().Add("Vary", header)
+					break
+				}
+			}
+		}
+
+		if version != "" {
+			a.versioning.versions[version].setHeaders(w.Header())
+			r = r.WithContext(context.WithValue(r.Context(), versionKey{}, version))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// versionable reports whether path is served by the versions of some
+// root.
+func versionable(path string, roots []versionRoot, plain []string) bool {
+	for _, vr := range roots {
+		if under(path, vr.base) && !shadowed(path, vr.base, plain) {
+			return true
+		}
+	}
+	return false
+}
+
+// shadowed reports whether path belongs to an unversioned route more
+// specific than base.
+func shadowed(path, base string, plain []string) bool {
+	for _, p := range plain {
+		if len(p) > len(base) && under(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedVersion reads the version of the Accept-Version header or of a
+// vendor media type, which is replaced by its plain type for negotiation.
+func (a *Application) requestedVersion(r *http.Request, header string, vendor *regexp.Regexp) (string, error) {
+	if h := strings.TrimSpace(r.Header.Get(header)); h != "" {
+		if v := a.lookupVersion(h); v != "" {
+			return v, nil
+		}
+		return "", NewTypedError("bad_request", fmt.Sprintf("%s: unknown version %q", header, h), "Unknown API version "+h)
+	}
+
+	if vendor == nil {
+		return "", nil
+	}
+	accept := strings.Split(r.Header.Get("Accept"), ",")
+	for i, mt := range accept {
+		mt = strings.TrimSpace(mt)
+		m := vendor.FindStringSubmatch(mt)
+		if m == nil {
+			continue
+		}
+		v := a.lookupVersion(m[1])
+		if v == "" {
+			return "", NewTypedError("not_acceptable", fmt.Sprintf("Accept: unknown version %q", m[1]), "Unknown API version "+m[1])
+		}
+		accept[i] = strings.Replace(mt, m[0], "application/"+m[2], 1)
+		r.Header.Set("Accept", strings.Join(accept, ","))
+		return v, nil
+	}
+	return "", nil
+}
+
+// lookupVersion finds a version by name, "2" also matches "v2".
+func (a *Application) lookupVersion(name string) string {
+	if _, ok := a.versioning.versions[name]; ok {
+		return name
+	}
+	if _, ok := a.versioning.versions["v"+name]; ok {
+		return "v" + name
+	}
+	return ""
+}
+
+// setHeaders announces the retirement of a version: Deprecation as in
+// RFC 9745, Sunset as in RFC 8594. The link is a deprecation link, or a
+// sunset link for versions only given a sunset.
+func (v *APIVersion) setHeaders(h http.Header) {
+	if !v.Deprecated.IsZero() {
+		h.Set("Deprecation", fmt.Sprintf("@%d", v.Deprecated.Unix()))
+	}
+	if !v.Sunset.IsZero() {
+		h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if v.Link == "" {
+		return
+	}
+	switch {
+	case !v.Deprecated.IsZero():
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, v.Link))
+	case !v.Sunset.IsZero():
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="sunset"`, v.Link))
+	}
+}
+
+// versionSwaggerPaths returns the swagger path of each version.
+func (a *Application) versionSwaggerPaths() map[string]string {
+	tmpl := a.Config.GetDefault("versioning.swagger_path", "/{version}/apidocs.json").(string)
+	paths := map[string]string{}
+	for name, v := range a.versioning.versions {
+		if len(v.services) > 0 {
+			paths[name] = strings.Replace(tmpl, "{version}", name, -1)
+		}
+	}
+	return paths
+}
+
+// initVersionSwagger documents each API version separately, next to the
+// documentation of the whole API.
+func (a *Application) initVersionSwagger() {
+	for name, path := range a.versionSwaggerPaths() {
+		swagger.RegisterSwaggerService(swagger.Config{
+			WebServices:    a.versioning.versions[name].services,
+			WebServicesUrl: a.Config.Get("swagger.ws_url").(string),
+			ApiPath:        path,
+			ApiVersion:     name,
+		}, a.Container)
+		log.Debugf("API %s documented at %s", name, path)
+	}
+}
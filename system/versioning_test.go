@@ -0,0 +1,118 @@
+package system
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+const versioningTestConfig = `
+[versioning]
+default = "v1"
+vendor = "app"
+
+[versioning.versions.v1]
+deprecated = 2026-01-01T00:00:00Z
+sunset = 2026-12-31T00:00:00Z
+link = "https://example.com/migrate"
+`
+
+// newVersioningTestApp serves /users/{id} in v1 and v2, answering with the
+// version, and /users/export and /health without a version.
+func newVersioningTestApp(t *testing.T) http.Handler {
+	a := newTestApp(t, versioningTestConfig)
+	for _, v := range []string{"v1", "v2"} {
+		ws := a.VersionedWebService(v, "/users").Produces("*/*")
+		ws.Route(ws.GET("/{id}").To(func(req *restful.Request, resp *restful.Response) {
+			resp.Write([]byte(RequestVersion(req) + " " + req.PathParameter("id")))
+		}))
+		a.Container.Add(ws)
+	}
+	plain := func(req *restful.Request, resp *restful.Response) {
+		resp.Write([]byte("plain " + RequestVersion(req)))
+	}
+	ws := new(restful.WebService).Path("/users/export").Produces("*/*")
+	ws.Route(ws.GET("").To(plain))
+	a.Container.Add(ws)
+	ws = new(restful.WebService).Path("/health").Produces("*/*")
+	ws.Route(ws.GET("").To(plain))
+	a.Container.Add(ws)
+	return a.handler()
+}
+
+func TestVersionRouter(t *testing.T) {
+	h := newVersioningTestApp(t)
+	tests := []struct {
+		name       string
+		path       string
+		header     map[string]string
+		status     int
+		body       string
+		deprecated bool
+	}{
+		{"path v2", "/v2/users/1", nil, 200, "v2 1", false},
+		{"path v1", "/v1/users/1", nil, 200, "v1 1", true},
+		{"default", "/users/1", nil, 200, "v1 1", true},
+		{"header", "/users/1", map[string]string{"Accept-Version": "v2"}, 200, "v2 1", false},
+		{"header without v", "/users/1", map[string]string{"Accept-Version": "2"}, 200, "v2 1", false},
+		{"path wins over header", "/v1/users/1", map[string]string{"Accept-Version": "v2"}, 200, "v1 1", true},
+		{"unknown header version", "/users/1", map[string]string{"Accept-Version": "v9"}, 400, "", false},
+		{"vendor type", "/users/1", map[string]string{"Accept": "application/vnd.app.v2+json"}, 200, "v2 1", false},
+		{"unknown vendor version", "/users/1", map[string]string{"Accept": "application/vnd.app.v9+json"}, 406, "", false},
+		{"shadowed plain route", "/users/export", map[string]string{"Accept-Version": "v2"}, 200, "plain ", false},
+		{"plain route", "/health", nil, 200, "plain ", false},
+		{"plain route unknown header version", "/health", map[string]string{"Accept-Version": "v9"}, 200, "plain ", false},
+		{"plain route unknown vendor version", "/health", map[string]string{"Accept": "application/vnd.app.v9+json"}, 200, "plain ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+				t.Fatalf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.status, tt.body)
+			}
+
+			want := map[string]string{"Deprecation": "", "Sunset": "", "Link": ""}
+			if tt.deprecated {
+				want = map[string]string{
+					"Deprecation": "@1767225600",
+					"Sunset":      "Thu, 31 Dec 2026 00:00:00 GMT",
+					"Link":        `<https://example.com/migrate>; rel="deprecation"`,
+				}
+			}
+			for k, v := range want {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("%s %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestVersionHeaders(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		v    APIVersion
+		link string
+	}{
+		{"deprecated", APIVersion{Deprecated: day, Link: "https://example.com/migrate"}, `<https://example.com/migrate>; rel="deprecation"`},
+		{"deprecated with sunset", APIVersion{Deprecated: day, Sunset: day, Link: "https://example.com/migrate"}, `<https://example.com/migrate>; rel="deprecation"`},
+		{"sunset only", APIVersion{Sunset: day, Link: "https://example.com/migrate"}, `<https://example.com/migrate>; rel="sunset"`},
+		{"current", APIVersion{Link: "https://example.com/migrate"}, ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		tt.v.setHeaders(h)
+		if got := h.Get("Link"); got != tt.link {
+			t.Errorf("%s: Link %q, want %q", tt.name, got, tt.link)
+		}
+	}
+}